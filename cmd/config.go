@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"minimalpanel/internal/conf"
+	"os"
+)
+
+// runConfig handles the config subcommands, which work without a loaded config
+// param: path: config file given by -config
+func runConfig(args []string, path string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing config command, see -help")
+	}
+
+	switch args[0] {
+	case "print-default":
+		if _, err := os.Stdout.Write(conf.DefaultFile()); err != nil {
+			return err
+		}
+
+	case "validate":
+		if len(args) > 2 {
+			return fmt.Errorf("expected at most one config file")
+		}
+		if len(args) == 2 {
+			path = args[1]
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		// Environment overrides are checked too, as serve would see them
+		if _, err := conf.Parse(path, data); err != nil {
+			return err
+		}
+		fmt.Printf("%s is valid\n", path)
+
+	default:
+		return fmt.Errorf("unknown config command: %s", args[0])
+	}
+	return nil
+}
@@ -1,14 +1,87 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"minimalpanel/internal/auth"
 	"minimalpanel/internal/conf"
 	"minimalpanel/internal/netx"
 	"minimalpanel/internal/web"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 )
 
+const usage = `Usage: minimalpanel [-config path] <command> [arguments]
+
+Commands:
+  serve                          Start the panel (default)
+  user add [-admin] <name>       Add a user, the password is read from stdin
+  user passwd <name>             Change a user's password, read from stdin
+  user del <name>                Delete a user
+  user list                      List users
+  config print-default           Print a config file with every setting at its default
+  config validate [path]         Check a config file, including environment overrides
+`
+
 func main() {
-	conf.LoadConfig("config.toml")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	configPath := flag.String("config", "config.toml", "path to the config file")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if args[0] == "config" {
+		// Checking a broken config must not fail on loading it
+		if err := runConfig(args[1:], *configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := conf.LoadConfig(*configPath); err != nil {
+		log.Fatalf("Failed to load config %s:\n%v", *configPath, err)
+	}
+
+	switch args[0] {
+	case "serve":
+		serve()
+	case "user":
+		if err := runUser(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// serve starts the HTTP and Socket.IO server
+func serve() {
+	if err := auth.LoadTokens(); err != nil {
+		log.Printf("Failed to load API tokens: %v", err)
+	}
+	if err := auth.LoadPasskeys(); err != nil {
+		log.Printf("Failed to load passkeys: %v", err)
+	}
+	if state := netx.InheritedState(); state != nil {
+		// Restarted by a previous process, keep its users logged in
+		if err := auth.ImportSessions(state); err != nil {
+			log.Printf("Failed to take over sessions: %v", err)
+		}
+		state.Close()
+	}
 
 	// Initialize the global Socket.IO server with all namespaces
 	netx.SetupGlobalServer()
@@ -25,6 +98,157 @@ func main() {
 	web.StartAssets(http.DefaultServeMux)
 	web.StartIndex(http.DefaultServeMux)
 	web.StartLogin(http.DefaultServeMux)
+	web.StartOIDC(http.DefaultServeMux)
+	web.StartWebAuthn(http.DefaultServeMux)
+	web.StartAdmin(http.DefaultServeMux)
+	web.StartSnippets(http.DefaultServeMux)
+	web.StartTokens(http.DefaultServeMux)
+	web.StartMetrics(http.DefaultServeMux)
+	web.StartUsers(http.DefaultServeMux)
+	web.StartSessions(http.DefaultServeMux)
+	web.StartConfig(http.DefaultServeMux)
+
+	// Socket.IO checks the Origin of its handshake instead of a CSRF token
+	handler := auth.RequireCSRF(http.DefaultServeMux, "/socket.io/")
+	handler = auth.RecordForwardedRole(handler)
+	// The address policy comes first so denied clients learn nothing else
+	handler = auth.RequireAccess(handler)
+	handler = netx.StripBasePath(handler)
+	handler = netx.StrictTransportSecurity(handler)
+
+	tlsConfig, challenges, err := netx.SetupTLS()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	listeners, err := netx.Listen(tlsConfig != nil)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	servers := []*http.Server{{Handler: handler, TLSConfig: tlsConfig}}
+	errs := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		go func(l netx.Listener) {
+			if l.Secure {
+				errs <- servers[0].ServeTLS(l, "", "")
+			} else {
+				errs <- servers[0].Serve(l)
+			}
+		}(l)
+	}
+
+	if challenges != nil {
+		// Plain HTTP only answers ACME challenges and redirects everything else to HTTPS
+		l, err := netx.ListenTCP(conf.GetTLS().ACME.HTTPAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen for ACME challenges: %v", err)
+		}
+		listeners = append(listeners, l)
+		servers = append(servers, &http.Server{Handler: challenges})
+		go func() {
+			errs <- servers[1].Serve(l)
+		}()
+	}
+
+	// Everything else follows config changes while running, sockets and certificates only change by restarting
+	rebind := make(chan struct{}, 1)
+	conf.Subscribe(auth.ConfigChanged)
+	conf.Subscribe(web.ConfigChanged)
+	conf.Subscribe(func(old conf.Config, new conf.Config) {
+		restart, pending := netx.RestartNeeded(old, new)
+		if !restart {
+			if len(pending) > 0 {
+				log.Printf("Changed %s, send SIGUSR2 to restart and apply it", strings.Join(pending, ", "))
+			}
+			return
+		}
+		select {
+		case rebind <- struct{}{}:
+		default:
+		}
+	})
+	if err := conf.Watch(); err != nil {
+		log.Printf("Config changes need SIGHUP to take effect: %v", err)
+	}
+
+	// Tell the process we were restarted from that it can go now
+	netx.Ready()
+	waitForShutdown(servers, listeners, errs, rebind)
+}
+
+// waitForShutdown serves until a listener fails or a signal arrives
+// SIGINT and SIGTERM shut down gracefully, SIGUSR2 and changed listeners restart without dropping
+// connections, SIGHUP reloads the config
+func waitForShutdown(servers []*http.Server, listeners []netx.Listener, errs chan error, rebind chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+
+	for {
+		restarting := false
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case <-rebind:
+			log.Printf("Listeners or TLS certificate source changed, restarting")
+			restarting = true
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				conf.Reload()
+				continue
+			}
+			restarting = sig == syscall.SIGUSR2
+			if !restarting {
+				log.Printf("Received %v, shutting down", sig)
+			}
+		}
+
+		if restarting {
+			if err := restart(listeners); err != nil {
+				log.Printf("Restart failed, still serving: %v", err)
+				continue
+			}
+			log.Printf("Restarted, draining connections and terminals")
+			// Signals now belong to the new process, a stop during the drain ends this one right away
+			signal.Reset()
+		}
+		shutdown(servers, restarting)
+		return
+	}
+}
+
+// restart hands the listeners and login sessions over to a new process
+func restart(listeners []netx.Listener) error {
+	state, err := auth.ExportSessions()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	return netx.Handoff(listeners, state)
+}
+
+// shutdown stops accepting connections, notifies the browsers and waits for requests to finish
+// On a restart open terminals stay with this process until they end or Web.ShutdownTimeout passes
+func shutdown(servers []*http.Server, restarting bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.GetWeb().ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			// Closes the listeners right away, then waits for active requests
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Failed to drain connections: %v", err)
+			}
+		}(server)
+	}
 
-	http.ListenAndServe(":8080", nil)
+	if !restarting {
+		netx.Notify("STOPPING=1")
+	}
+	// Socket.IO connections are hijacked, so they have to be closed here
+	web.Shutdown(ctx, restarting)
+	netx.CloseGlobalServer()
+	wg.Wait()
 }
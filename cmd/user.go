@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"minimalpanel/internal/auth"
+	"os"
+	"os/user"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// runUser handles the user subcommands
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing user command, see -help")
+	}
+
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("user add", flag.ExitOnError)
+		admin := flags.Bool("admin", false, "grant admin rights")
+		flags.Parse(args[1:])
+		name, err := userArg(flags.Args())
+		if err != nil {
+			return err
+		}
+
+		password, err := readPassword(fmt.Sprintf("Password for %s: ", name))
+		if err != nil {
+			return err
+		}
+		if err := auth.NewUser(name, password, *admin, operator()); err != nil {
+			return err
+		}
+		fmt.Printf("User %s added\n", name)
+
+	case "passwd":
+		name, err := userArg(args[1:])
+		if err != nil {
+			return err
+		}
+
+		password, err := readPassword(fmt.Sprintf("New password for %s: ", name))
+		if err != nil {
+			return err
+		}
+		if err := auth.SetPassword(name, password, operator()); err != nil {
+			return err
+		}
+		fmt.Printf("Password of %s changed\n", name)
+
+	case "del":
+		name, err := userArg(args[1:])
+		if err != nil {
+			return err
+		}
+
+		// Revoked here as well in case the panel is not running, it revokes them itself on the config change
+		if err := auth.LoadTokens(); err != nil {
+			return err
+		}
+		if err := auth.LoadPasskeys(); err != nil {
+			return err
+		}
+		if err := auth.DeleteUser(name, operator()); err != nil {
+			return err
+		}
+		fmt.Printf("User %s deleted\n", name)
+
+	case "list":
+		for _, user := range auth.ListUsers() {
+			if user.Admin {
+				fmt.Printf("%s (admin)\n", user.Username)
+			} else {
+				fmt.Println(user.Username)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown user command: %s", args[0])
+	}
+	return nil
+}
+
+// userArg returns the single username argument
+func userArg(args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("expected exactly one username")
+	}
+	return args[0], nil
+}
+
+// operator names who runs the command, for the config history
+func operator() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return name + " (command line)"
+}
+
+// readPassword asks for a password without echoing it and has it typed twice on a terminal
+// A piped password is read as a single line, so scripts can set passwords
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	password, err := promptPassword(fd, prompt)
+	if err != nil {
+		return "", err
+	}
+	if _, err := checkPassword(password); err != nil {
+		return "", err
+	}
+	again, err := promptPassword(fd, "Repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if again != password {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return password, nil
+}
+
+// promptPassword reads one password from the terminal with echo turned off
+func promptPassword(fd int, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return string(password), nil
+}
+
+// checkPassword rejects empty passwords
+func checkPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"time"
+)
+
+// AddressAllowed reports whether the global policy lets an address reach the panel
+func AddressAllowed(ip string) bool {
+	return addressAllowed(ip, conf.GetAccess().AllowCIDRs, conf.GetAccess().DenyCIDRs)
+}
+
+// UserAddressAllowed reports whether a user may use the panel from an address
+// The user's own lists only narrow the global policy, they never widen it
+func UserAddressAllowed(username string, ip string) bool {
+	access := conf.GetAccess()
+	return addressAllowed(ip, access.AllowCIDRs, access.DenyCIDRs) &&
+		addressAllowed(ip, access.UserAllowCIDRs[username], access.UserDenyCIDRs[username])
+}
+
+// addressAllowed applies one allow and deny list pair, an empty allow list allows everything not denied
+func addressAllowed(ip string, allow []string, deny []string) bool {
+	if netx.MatchAddress(ip, deny) {
+		return false
+	}
+	return len(allow) == 0 || netx.MatchAddress(ip, allow)
+}
+
+// RequireAccess is a middleware that answers requests from disallowed addresses with 403
+// Requests carrying credentials are also checked against their user's lists
+func RequireAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := netx.ClientIP(r)
+		if !AddressAllowed(ip) {
+			netx.WriteForbidden(w, "Access from "+ip+" is not allowed")
+			return
+		}
+		if username, ok := requestUsername(r); ok && !UserAddressAllowed(username, ip) {
+			netx.WriteForbidden(w, "Access for "+username+" from "+ip+" is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestUsername finds who a request claims to be without recording any activity
+func requestUsername(r *http.Request) (string, bool) {
+	if username, ok := ForwardedUser(r); ok {
+		return username, true
+	}
+
+	now := time.Now()
+	if token, exists := GetSessionToken(r); exists {
+		Sessions.mu.RLock()
+		session, found := Sessions.sessions[token]
+		Sessions.mu.RUnlock()
+		if found && now.Before(session.ExpiresAt) {
+			return session.Username, true
+		}
+
+		Tokens.mu.RLock()
+		apiToken, found := Tokens.tokens[hashToken(token)]
+		Tokens.mu.RUnlock()
+		if found && !apiToken.Expired() {
+			return apiToken.Username, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+)
+
+// Identity is a user whose password a backend has accepted
+type Identity struct {
+	Username string // Panel username, external backends may prefix the name the user logged in with
+	Admin    bool   // Granted by the backend, users listed in Admins are administrators regardless
+}
+
+// Backend checks passwords against a user store
+type Backend interface {
+	// Authenticate returns perr.UserNotFound or perr.WrongPassword for bad credentials,
+	// any other error means the store could not be asked
+	Authenticate(username string, password string) (*Identity, error)
+	// Lookup finds a user by panel username without their password, perr.UserNotFound if the store
+	// does not know them or would no longer let them log in
+	Lookup(username string) (*Identity, error)
+}
+
+// backends maps the names used in the Backends setting to their implementation
+var backends = map[string]func() Backend{
+	"local":  func() Backend { return localBackend{} },
+	"ldap":   func() Backend { return currentLDAP() },
+	"system": func() Backend { return systemBackend{settings: conf.GetSystem()} },
+}
+
+// VerifyPassword checks a password against each configured backend in turn
+// The first backend that knows the user decides, an unreachable backend is skipped
+// Returns the panel username of the accepted identity
+func VerifyPassword(name string, password string) (string, bool) {
+	if name == "" || password == "" {
+		return "", false
+	}
+
+	for _, backendName := range conf.GetAuth().Backends {
+		newBackend, exists := backends[backendName]
+		if !exists {
+			log.Printf("Unknown auth backend %s", backendName)
+			continue
+		}
+
+		identity, err := newBackend().Authenticate(name, password)
+		switch {
+		case err == nil:
+			SetExternalAdmin(identity.Username, identity.Admin)
+			return identity.Username, true
+		case errors.Is(err, perr.WrongPassword):
+			return "", false
+		case !errors.Is(err, perr.UserNotFound):
+			log.Printf("Auth backend %s failed: %v", backendName, err)
+		}
+	}
+	return "", false
+}
+
+// LookupUser confirms that a user proven by other means than a password, such as a passkey, may still log in
+// Each configured backend is asked in turn like by VerifyPassword, perr.UserNotFound if none accepts the user
+func LookupUser(username string) (*Identity, error) {
+	for _, backendName := range conf.GetAuth().Backends {
+		newBackend, exists := backends[backendName]
+		if !exists {
+			continue
+		}
+
+		identity, err := newBackend().Lookup(username)
+		switch {
+		case err == nil:
+			SetExternalAdmin(identity.Username, identity.Admin)
+			return identity, nil
+		case !errors.Is(err, perr.UserNotFound):
+			log.Printf("Auth backend %s failed: %v", backendName, err)
+		}
+	}
+	return nil, perr.UserNotFound
+}
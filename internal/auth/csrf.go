@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// CSRFCookieName holds the double-submit token, readable by the pages' scripts
+	CSRFCookieName = "mp-csrf"
+	// CSRFHeaderName is where state-changing requests echo the token back
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// RequireCSRF is a middleware that rejects state-changing requests without a matching CSRF token
+// Every response to a request without the cookie sets a fresh one
+// exempt: path prefixes with their own cross-site protection, such as Socket.IO
+func RequireCSRF(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(CSRFCookieName)
+		if err != nil || cookie.Value == "" {
+			token, err := GenerateToken()
+			if err != nil {
+				netx.WriteInternalServerError(w, "Failed to create CSRF token", err)
+				return
+			}
+			setCSRFCookie(w, token)
+			cookie = &http.Cookie{Name: CSRFCookieName}
+		}
+
+		if !csrfProtected(r, exempt) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(CSRFHeaderName)
+		if cookie.Value == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			netx.WriteForbidden(w, "Invalid CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfProtected reports whether a request must carry a CSRF token
+func csrfProtected(r *http.Request, exempt []string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	for _, prefix := range exempt {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+
+	// Browsers never attach an Authorization header on their own, so scripts
+	// using API tokens without the session cookie cannot be forged.
+	// An authenticating proxy may add one to every request, forged or not
+	if _, forwarded := ForwardedUser(r); forwarded {
+		return true
+	}
+	if _, hasCookie := GetTokenFromCookie(r); !hasCookie && r.Header.Get("Authorization") != "" {
+		return false
+	}
+	return true
+}
+
+// setCSRFCookie sets the CSRF cookie, it must stay readable by JavaScript
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     netx.Path("/"),
+		Secure:   netx.TLSActive(),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// CheckOriginSocketIO is a middleware that rejects Socket.IO connections from foreign origins
+// The panel's own origin is always allowed, others must be listed in AllowedOrigins
+// Clients that send no Origin, such as scripts, are left to authentication
+func CheckOriginSocketIO(client *socket.Socket, next func(*socket.ExtendedError)) {
+	origin, ok := handshakeHeader(client, "Origin")
+	if !ok || OriginAllowed(origin, client.Request().Request().Host) {
+		next(nil)
+		return
+	}
+	next(socket.NewExtendedError("Forbidden", "Origin not allowed"))
+}
+
+// OriginAllowed reports whether a browser origin may talk to the panel
+// host: the Host the request was sent to
+func OriginAllowed(origin string, host string) bool {
+	parsed, err := url.Parse(origin)
+	if err == nil && parsed.Host != "" && strings.EqualFold(parsed.Host, host) {
+		return true
+	}
+
+	for _, allowed := range conf.GetWeb().AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"strings"
+)
+
+// ForwardedUser returns the user an authenticating reverse proxy vouched for
+// The header is only believed from TrustedProxies, any client could send it directly
+// The user needs no entry in Users, their role comes from the groups header if one is configured
+func ForwardedUser(r *http.Request) (string, bool) {
+	identity, ok := forwardedIdentity(r)
+	if !ok {
+		return "", false
+	}
+	return identity.Username, true
+}
+
+// forwardedIdentity maps the forwarded name to a panel user, see ForwardAuth.UserMap and UserPrefix
+// Admin is only meaningful if a groups header is configured
+func forwardedIdentity(r *http.Request) (*Identity, bool) {
+	settings := conf.GetForwardAuth()
+	if settings.Header == "" {
+		return nil, false
+	}
+
+	forwarded := strings.TrimSpace(r.Header.Get(settings.Header))
+	if forwarded == "" || !netx.FromTrustedProxy(r) {
+		return nil, false
+	}
+
+	username, mapped := settings.UserMap[forwarded]
+	if !mapped {
+		username = settings.UserPrefix + forwarded
+	}
+
+	identity := &Identity{Username: username}
+	if settings.GroupsHeader != "" {
+		var groups []string
+		for _, group := range strings.Split(r.Header.Get(settings.GroupsHeader), ",") {
+			groups = append(groups, strings.TrimSpace(group))
+		}
+		identity.Admin = intersects(groups, settings.AdminGroups)
+	}
+	return identity, true
+}
+
+// RecordForwardedRole is a middleware that keeps the role of proxy users in line with their groups header
+// The proxy sends the groups with every request, so a change applies on the next one
+func RecordForwardedRole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := forwardedIdentity(r); ok && conf.GetForwardAuth().GroupsHeader != "" {
+			SetExternalAdmin(identity.Username, identity.Admin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
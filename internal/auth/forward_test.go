@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"minimalpanel/internal/conf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useForwardAuth trusts requests from 192.0.2.1 to name their user in X-Forwarded-User
+func useForwardAuth(t *testing.T) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+
+	conf.Conf.Web.TrustedProxies = []string{"192.0.2.1"}
+	conf.Conf.Auth.ForwardAuth = conf.ForwardAuth{
+		Header:       "X-Forwarded-User",
+		UserPrefix:   "proxy:",
+		UserMap:      map[string]string{"root": "admin"},
+		GroupsHeader: "X-Forwarded-Groups",
+		AdminGroups:  []string{"ops"},
+	}
+	conf.Conf.Auth.Admins = []string{"admin"}
+}
+
+// proxied returns a request a trusted proxy forwarded for the user
+func proxied(user string, groups string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:40000"
+	r.Header.Set("X-Forwarded-User", user)
+	r.Header.Set("X-Forwarded-Groups", groups)
+	return r
+}
+
+func TestForwardedUserMapping(t *testing.T) {
+	useForwardAuth(t)
+
+	for forwarded, want := range map[string]string{"alice": "proxy:alice", "admin": "proxy:admin", "root": "admin"} {
+		if username, ok := ForwardedUser(proxied(forwarded, "")); !ok || username != want {
+			t.Errorf("%s: got %q %v, want %q", forwarded, username, ok, want)
+		}
+	}
+
+	direct := proxied("root", "")
+	direct.RemoteAddr = "198.51.100.7:40000"
+	if username, ok := ForwardedUser(direct); ok {
+		t.Errorf("header from an untrusted client was believed as %q", username)
+	}
+}
+
+func TestForwardedUserWinsOverCookie(t *testing.T) {
+	useForwardAuth(t)
+
+	token, err := CreateSession("admin", false, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteSession(token) })
+
+	r := proxied("bob", "")
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	if username, ok := IsAuthenticated(r); !ok || username != "proxy:bob" {
+		t.Errorf("got %q, want the proxy's user proxy:bob instead of the cookie's admin", username)
+	}
+}
+
+func TestRecordForwardedRole(t *testing.T) {
+	useForwardAuth(t)
+	t.Cleanup(func() { SetExternalAdmin("proxy:carol", false) })
+	handler := RecordForwardedRole(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Looking the user up alone grants nothing
+	ForwardedUser(proxied("carol", "ops"))
+	if IsAdmin("proxy:carol") {
+		t.Fatal("ForwardedUser changed the user's role")
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), proxied("carol", "staff, ops"))
+	if !IsAdmin("proxy:carol") {
+		t.Error("member of an admin group is no admin")
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), proxied("carol", "staff"))
+	if IsAdmin("proxy:carol") {
+		t.Error("user left the admin group but stays admin")
+	}
+}
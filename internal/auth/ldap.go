@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapBackend checks passwords by binding as the user found in a directory
+type ldapBackend struct {
+	settings conf.LDAP
+	idle     chan *ldap.Conn // Connections bound as the service account
+}
+
+// ldapCurrent is the backend for the current settings, replaced when they change
+var ldapCurrent = struct {
+	sync.Mutex
+	backend *ldapBackend
+}{}
+
+// currentLDAP returns the backend for the current settings
+func currentLDAP() *ldapBackend {
+	settings := conf.GetLDAP()
+
+	ldapCurrent.Lock()
+	defer ldapCurrent.Unlock()
+	if ldapCurrent.backend != nil && reflect.DeepEqual(ldapCurrent.backend.settings, settings) {
+		return ldapCurrent.backend
+	}
+
+	if ldapCurrent.backend != nil {
+		ldapCurrent.backend.closeIdle()
+	}
+	size := settings.PoolSize
+	if size < 0 {
+		size = 0
+	}
+	ldapCurrent.backend = &ldapBackend{settings: settings, idle: make(chan *ldap.Conn, size)}
+	return ldapCurrent.backend
+}
+
+// Authenticate looks up the user, binds with their password and maps their groups to a role
+func (b *ldapBackend) Authenticate(username string, password string) (*Identity, error) {
+	// An empty password would be an unauthenticated bind, which servers accept
+	if password == "" {
+		return nil, perr.WrongPassword
+	}
+
+	conn, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+
+	userDN, groups, err := b.lookup(conn, username)
+	if err != nil {
+		b.release(conn, err)
+		return nil, err
+	}
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		err = perr.WrongPassword
+	} else if err != nil {
+		err = fmt.Errorf("failed to bind as %s: %w", userDN, err)
+	}
+	// The connection is now bound as the user, switch back before reuse
+	if rebindErr := b.bind(conn); rebindErr != nil {
+		conn.Close()
+	} else {
+		b.release(conn, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.settings.AllowedGroups) > 0 && !intersects(groups, b.settings.AllowedGroups) {
+		return nil, fmt.Errorf("%s is not a member of an allowed group: %w", username, perr.WrongPassword)
+	}
+	return &Identity{Username: b.settings.UserPrefix + username, Admin: intersects(groups, b.settings.AdminGroups)}, nil
+}
+
+// Lookup searches for the user and checks they are still a member of an allowed group
+func (b *ldapBackend) Lookup(username string) (*Identity, error) {
+	name, found := strings.CutPrefix(username, b.settings.UserPrefix)
+	if !found || name == "" {
+		return nil, perr.UserNotFound
+	}
+
+	conn, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	_, groups, err := b.lookup(conn, name)
+	b.release(conn, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.settings.AllowedGroups) > 0 && !intersects(groups, b.settings.AllowedGroups) {
+		return nil, fmt.Errorf("%s is not a member of an allowed group: %w", name, perr.UserNotFound)
+	}
+	return &Identity{Username: username, Admin: intersects(groups, b.settings.AdminGroups)}, nil
+}
+
+// lookup finds the user's DN and the names of their groups
+func (b *ldapBackend) lookup(conn *ldap.Conn, username string) (string, []string, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		b.settings.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(b.settings.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", nil, fmt.Errorf("failed to search for user: %w", err)
+	}
+	// Ambiguous filters must not let one account log in as another
+	if result == nil || len(result.Entries) != 1 {
+		return "", nil, perr.UserNotFound
+	}
+	userDN := result.Entries[0].DN
+
+	if b.settings.GroupBaseDN == "" {
+		return userDN, nil, nil
+	}
+	result, err = conn.Search(ldap.NewSearchRequest(
+		b.settings.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(b.settings.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{b.settings.GroupAttribute}, nil,
+	))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to search for groups: %w", err)
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetAttributeValues(b.settings.GroupAttribute)...)
+	}
+	return userDN, groups, nil
+}
+
+// get takes an idle connection from the pool or opens a new one
+func (b *ldapBackend) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-b.idle:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+		default:
+			return b.dial()
+		}
+	}
+}
+
+// release returns a connection to the pool, unless err shows it is broken or the pool is full
+func (b *ldapBackend) release(conn *ldap.Conn, err error) {
+	var ldapErr *ldap.Error
+	if err != nil && errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.ErrorNetwork {
+		conn.Close()
+		return
+	}
+
+	select {
+	case b.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// closeIdle closes every pooled connection
+func (b *ldapBackend) closeIdle() {
+	for {
+		select {
+		case conn := <-b.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dial opens a connection, secures it if configured and binds as the service account
+func (b *ldapBackend) dial() (*ldap.Conn, error) {
+	if b.settings.URL == "" {
+		return nil, fmt.Errorf("LDAP URL is not configured")
+	}
+	tlsConfig, err := b.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ldap.DialURL(b.settings.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: b.settings.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	if b.settings.Timeout > 0 {
+		conn.SetTimeout(b.settings.Timeout)
+	}
+
+	if b.settings.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if err := b.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bind authenticates a connection as the service account
+func (b *ldapBackend) bind(conn *ldap.Conn) error {
+	if b.settings.BindDN == "" {
+		if err := conn.UnauthenticatedBind(""); err != nil {
+			return fmt.Errorf("failed to bind anonymously: %w", err)
+		}
+		return nil
+	}
+	if err := conn.Bind(b.settings.BindDN, b.settings.BindPassword); err != nil {
+		return fmt.Errorf("failed to bind as service account: %w", err)
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS settings for LDAPS and StartTLS
+func (b *ldapBackend) tlsConfig() (*tls.Config, error) {
+	parsed, err := url.Parse(b.settings.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+
+	config := &tls.Config{
+		ServerName:         parsed.Hostname(),
+		InsecureSkipVerify: b.settings.InsecureSkipVerify,
+	}
+	if b.settings.CACertPath != "" {
+		pem, err := os.ReadFile(b.settings.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP CA certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", b.settings.CACertPath)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"errors"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP protocol operations the stub understands
+const (
+	ldapBindRequest    = 0
+	ldapBindResponse   = 1
+	ldapUnbindRequest  = 2
+	ldapSearchRequest  = 3
+	ldapSearchEntry    = 4
+	ldapSearchDone     = 5
+	ldapResultSuccess  = 0
+	ldapResultBadCreds = 49
+)
+
+// ldapStub is an in-process directory answering simple binds and searches from fixed tables
+type ldapStub struct {
+	listener  net.Listener
+	passwords map[string]string              // Password by DN
+	entries   map[string][]map[string]string // Entries by "base filter", each attribute with one value
+	dials     atomic.Int32                   // Connections accepted
+	binds     atomic.Int32                   // Successful binds
+	mu        sync.Mutex
+	bound     map[net.Conn]string // DN each connection is bound as
+}
+
+func newLDAPStub(t *testing.T) *ldapStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &ldapStub{
+		listener: listener,
+		passwords: map[string]string{
+			"cn=panel,dc=example":            "service",
+			"uid=alice,ou=people,dc=example": "alice-pw",
+			"uid=bob,ou=people,dc=example":   "bob-pw",
+			"uid=admin,ou=people,dc=example": "admin-pw",
+		},
+		entries: map[string][]map[string]string{
+			"ou=people,dc=example (uid=alice)": {{"dn": "uid=alice,ou=people,dc=example"}},
+			"ou=people,dc=example (uid=bob)":   {{"dn": "uid=bob,ou=people,dc=example"}},
+			"ou=people,dc=example (uid=admin)": {{"dn": "uid=admin,ou=people,dc=example"}},
+			"ou=groups,dc=example (member=uid=alice,ou=people,dc=example)": {
+				{"dn": "cn=staff,ou=groups,dc=example", "cn": "staff"},
+				{"dn": "cn=ops,ou=groups,dc=example", "cn": "ops"},
+			},
+			"ou=groups,dc=example (member=uid=bob,ou=people,dc=example)": {},
+			"ou=groups,dc=example (member=uid=admin,ou=people,dc=example)": {
+				{"dn": "cn=staff,ou=groups,dc=example", "cn": "staff"},
+			},
+		},
+		bound: make(map[net.Conn]string),
+	}
+	go stub.serve()
+	t.Cleanup(func() { listener.Close() })
+	return stub
+}
+
+func (self *ldapStub) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+		self.dials.Add(1)
+		go self.handle(conn)
+	}
+}
+
+// handle answers the requests of one connection until it is closed or unbound
+func (self *ldapStub) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldapBindRequest:
+			dn := request.Children[1].Value.(string)
+			password := string(request.Children[2].Data.Bytes())
+			code := ldapResultBadCreds
+			if expected, exists := self.passwords[dn]; (exists && expected == password) || (dn == "" && password == "") {
+				code = ldapResultSuccess
+				self.binds.Add(1)
+				self.mu.Lock()
+				self.bound[conn] = dn
+				self.mu.Unlock()
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldapBindResponse, code)).Bytes())
+
+		case ldapSearchRequest:
+			base := request.Children[0].Value.(string)
+			filter, _ := ldap.DecompileFilter(request.Children[6])
+			self.mu.Lock()
+			authorized := self.bound[conn] == "cn=panel,dc=example"
+			self.mu.Unlock()
+			if authorized {
+				for _, entry := range self.entries[base+" "+filter] {
+					conn.Write(ldapMessage(id, ldapEntry(entry)).Bytes())
+				}
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldapSearchDone, ldapResultSuccess)).Bytes())
+
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// ldapMessage wraps a protocol operation into an LDAP message
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	message.AppendChild(op)
+	return message
+}
+
+// ldapResult builds a response carrying only a result code
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	return op
+}
+
+// ldapEntry builds a search result entry, the "dn" key is its DN
+func ldapEntry(entry map[string]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchEntry, nil, "entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry["dn"], "dn"))
+	attributes := ber.NewSequence("attributes")
+	for name, value := range entry {
+		if name == "dn" {
+			continue
+		}
+		attribute := ber.NewSequence("attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+// useLDAP points the LDAP settings at the stub and makes the local users and admins known
+func useLDAP(t *testing.T, stub *ldapStub) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+
+	settings := conf.Defaults().Auth.LDAP
+	settings.URL = "ldap://" + stub.listener.Addr().String()
+	settings.BindDN = "cn=panel,dc=example"
+	settings.BindPassword = "service"
+	settings.UserBaseDN = "ou=people,dc=example"
+	settings.GroupBaseDN = "ou=groups,dc=example"
+	settings.AdminGroups = []string{"ops"}
+	conf.Conf.Auth.LDAP = settings
+	conf.Conf.Auth.Backends = []string{"ldap", "local"}
+	conf.Conf.Auth.Users = map[string]string{"admin": "$2a$10$unused"}
+	conf.Conf.Auth.Admins = []string{"admin"}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	stub := newLDAPStub(t)
+	useLDAP(t, stub)
+	backend := currentLDAP()
+
+	identity, err := backend.Authenticate("alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.Username != "ldap:alice" || !identity.Admin {
+		t.Errorf("got %+v, want ldap:alice as member of the ops admin group", identity)
+	}
+
+	if _, err := backend.Authenticate("alice", "wrong"); !errors.Is(err, perr.WrongPassword) {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if _, err := backend.Authenticate("carol", "carol-pw"); !errors.Is(err, perr.UserNotFound) {
+		t.Errorf("unknown user: got %v", err)
+	}
+	// The filter must not be injectable
+	if _, err := backend.Authenticate("*", "alice-pw"); !errors.Is(err, perr.UserNotFound) {
+		t.Errorf("wildcard username: got %v", err)
+	}
+}
+
+func TestLDAPAllowedGroups(t *testing.T) {
+	stub := newLDAPStub(t)
+	useLDAP(t, stub)
+	conf.Conf.Auth.LDAP.AllowedGroups = []string{"staff"}
+
+	if _, err := currentLDAP().Authenticate("alice", "alice-pw"); err != nil {
+		t.Errorf("member of an allowed group: %v", err)
+	}
+	if _, err := currentLDAP().Authenticate("bob", "bob-pw"); !errors.Is(err, perr.WrongPassword) {
+		t.Errorf("user outside the allowed groups: got %v", err)
+	}
+}
+
+func TestLDAPPoolReuse(t *testing.T) {
+	stub := newLDAPStub(t)
+	useLDAP(t, stub)
+
+	for i := 0; i < 5; i++ {
+		if _, err := currentLDAP().Authenticate("alice", "alice-pw"); err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+	}
+	if _, err := currentLDAP().Authenticate("alice", "wrong"); !errors.Is(err, perr.WrongPassword) {
+		t.Fatalf("wrong password: got %v", err)
+	}
+	// Searches after a failed user bind only work if the connection was bound back to the service account
+	if _, err := currentLDAP().Authenticate("alice", "alice-pw"); err != nil {
+		t.Fatalf("login after a wrong password: %v", err)
+	}
+	if dials := stub.dials.Load(); dials != 1 {
+		t.Errorf("opened %d connections, want one reused from the pool", dials)
+	}
+}
+
+func TestLDAPUserCannotBecomeLocalAdmin(t *testing.T) {
+	stub := newLDAPStub(t)
+	useLDAP(t, stub)
+
+	username, ok := VerifyPassword("admin", "admin-pw")
+	if !ok {
+		t.Fatal("directory user admin was rejected")
+	}
+	if username != "ldap:admin" {
+		t.Fatalf("directory user logged in as %q, want ldap:admin", username)
+	}
+	if IsAdmin(username) {
+		t.Error("directory user inherits the rights of the local admin")
+	}
+}
+
+func TestLDAPLookup(t *testing.T) {
+	stub := newLDAPStub(t)
+	useLDAP(t, stub)
+	conf.Conf.Auth.LDAP.AllowedGroups = []string{"staff"}
+
+	identity, err := LookupUser("ldap:alice")
+	if err != nil || identity.Username != "ldap:alice" || !identity.Admin {
+		t.Errorf("member of an allowed group: got %+v %v", identity, err)
+	}
+	// Left the allowed groups, or only known without the prefix
+	for _, username := range []string{"ldap:bob", "ldap:carol", "alice"} {
+		if _, err := LookupUser(username); !errors.Is(err, perr.UserNotFound) {
+			t.Errorf("%s: got %v, want perr.UserNotFound", username, err)
+		}
+	}
+	if _, err := LookupUser("admin"); err != nil {
+		t.Errorf("local user: %v", err)
+	}
+}
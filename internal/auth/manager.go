@@ -3,14 +3,24 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"minimalpanel/internal/netx"
 	"net/http"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
 )
 
 var (
-	CookieName     = "mp-auth"
-	cookieLifespan = 24 * time.Hour
+	CookieName = "mp-auth"
+	// rotationGrace keeps a rotated token usable for requests already in flight
+	rotationGrace = time.Minute
 )
 
 // SessionStore holds active user sessions
@@ -21,9 +31,29 @@ type SessionStore struct {
 
 // SessionData contains user session information
 type SessionData struct {
-	Username  string
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	Id           string // Public id, the token itself is never shown
+	Username     string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time // Slides forward on activity, never past MaxExpiresAt
+	MaxExpiresAt time.Time // Absolute end of the session
+	LastSeen     time.Time
+	ClientIP     string
+	UserAgent    string
+	Remember     bool      // Remember-me sessions survive browser restarts and rotate their token
+	IssuedAt     time.Time // When the current token was issued
+	Superseded   bool      // Token was rotated and only lives out its grace period
+}
+
+// SessionInfo describes a login session for listing
+type SessionInfo struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"` // The session making the request
 }
 
 // Global session store
@@ -41,7 +71,14 @@ func GenerateToken() (string, error) {
 }
 
 // CreateSession creates a new session for the user and returns a token
-func CreateSession(username string) (string, error) {
+// remember: create a long-lived remember-me session instead of a browser session
+// r: the login request, its client address and user agent are recorded
+// Returns perr.AccessDenied if the user may not log in from the client address
+func CreateSession(username string, remember bool, r *http.Request) (string, error) {
+	if !UserAddressAllowed(username, netx.ClientIP(r)) {
+		return "", perr.AccessDenied
+	}
+
 	token, err := GenerateToken()
 	if err != nil {
 		return "", err
@@ -50,58 +87,274 @@ func CreateSession(username string) (string, error) {
 	Sessions.mu.Lock()
 	defer Sessions.mu.Unlock()
 
-	expiresAt := time.Now().Add(cookieLifespan)
-	Sessions.sessions[token] = SessionData{
+	limits := conf.GetAuth()
+	now := time.Now()
+	session := SessionData{
+		Id:        hashToken(token)[:16],
 		Username:  username,
-		CreatedAt: time.Now(),
-		ExpiresAt: expiresAt,
+		CreatedAt: now,
+		LastSeen:  now,
+		ClientIP:  netx.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Remember:  remember,
+		IssuedAt:  now,
+	}
+	if remember {
+		session.MaxExpiresAt = now.Add(limits.RememberMeMaxAge)
+	} else {
+		session.MaxExpiresAt = now.Add(limits.SessionMaxAge)
 	}
+	session.ExpiresAt = session.slide(now, limits)
+	Sessions.sessions[token] = session
 
 	return token, nil
 }
 
+// slide returns the session expiry after activity at now
+// Remember-me sessions have no idle timeout, staying logged in while away is what they are for.
+// They are bounded by RememberMeMaxAge instead, and their token is replaced every RememberMeRotate
+func (s SessionData) slide(now time.Time, limits conf.Auth) time.Time {
+	switch {
+	case s.Superseded:
+		return s.ExpiresAt // Lives out its grace period
+	case s.Remember:
+		return s.MaxExpiresAt
+	}
+	expiresAt := now.Add(limits.SessionIdleTimeout)
+	if expiresAt.After(s.MaxExpiresAt) {
+		return s.MaxExpiresAt
+	}
+	return expiresAt
+}
+
 // ValidateSession checks if a token is valid and returns the username
+// A valid session has its last-seen time updated
 func ValidateSession(token string) (string, bool) {
-	Sessions.mu.RLock()
-	defer Sessions.mu.RUnlock()
+	session, valid := validateSession(token)
+	return session.Username, valid
+}
+
+// validateSession is ValidateSession returning the whole session
+func validateSession(token string) (SessionData, bool) {
+	Sessions.mu.Lock()
+	defer Sessions.mu.Unlock()
 
 	session, exists := Sessions.sessions[token]
 	if !exists {
-		return "", false
+		return SessionData{}, false
 	}
 
 	// Check if session has expired
-	if time.Now().After(session.ExpiresAt) {
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
 		// Remove expired session
-		Sessions.mu.RUnlock()
-		Sessions.mu.Lock()
 		delete(Sessions.sessions, token)
-		Sessions.mu.Unlock()
-		Sessions.mu.RLock()
-		return "", false
+		return SessionData{}, false
+	}
+
+	session.LastSeen = now
+	session.ExpiresAt = session.slide(now, conf.GetAuth())
+	Sessions.sessions[token] = session
+	return session, true
+}
+
+// RotateSession replaces a remember-me token that is due for rotation
+// The old token stays valid for a short grace period. Both keep the public id, they are one login of one device
+// Returns the new token and true if the token was rotated
+func RotateSession(token string) (string, bool, error) {
+	Sessions.mu.Lock()
+	defer Sessions.mu.Unlock()
+
+	session, exists := Sessions.sessions[token]
+	now := time.Now()
+	if !exists || !session.Remember || session.Superseded || now.Sub(session.IssuedAt) < conf.GetAuth().RememberMeRotate {
+		return "", false, nil
 	}
 
-	return session.Username, true
+	newToken, err := GenerateToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	rotated := session
+	rotated.IssuedAt = now
+	Sessions.sessions[newToken] = rotated
+
+	session.Superseded = true
+	session.ExpiresAt = now.Add(rotationGrace)
+	Sessions.sessions[token] = session
+
+	return newToken, true, nil
+}
+
+// RefreshCookie rotates the request's remember-me token when it is due and sets the new cookie
+func RefreshCookie(w http.ResponseWriter, r *http.Request) {
+	token, exists := GetTokenFromCookie(r)
+	if !exists {
+		return
+	}
+	if newToken, rotated, err := RotateSession(token); err == nil && rotated {
+		SetCookie(w, newToken)
+	}
+}
+
+// ListSessions returns the user's sessions, or every session for an empty username
+// Tokens superseded by a rotation are left out, the login is listed once with its current token
+// currentToken: the requesting session, flagged as current
+func ListSessions(username string, currentToken string) []SessionInfo {
+	Sessions.mu.RLock()
+	defer Sessions.mu.RUnlock()
+
+	// A request may still use the superseded token, its login is current all the same
+	currentId := ""
+	if current, exists := Sessions.sessions[currentToken]; exists {
+		currentId = current.Id
+	}
+
+	list := make([]SessionInfo, 0)
+	now := time.Now()
+	for _, session := range Sessions.sessions {
+		if session.Superseded || now.After(session.ExpiresAt) || (username != "" && session.Username != username) {
+			continue
+		}
+		list = append(list, SessionInfo{
+			Id:        session.Id,
+			Username:  session.Username,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+			LastSeen:  session.LastSeen,
+			ClientIP:  session.ClientIP,
+			UserAgent: session.UserAgent,
+			Current:   session.Id == currentId,
+		})
+	}
+	return list
+}
+
+// RevokeSession removes a session by its public id, including tokens it replaced during their grace period
+// username: owner the session must belong to, empty to revoke any user's session
+// Returns false if no such session exists
+func RevokeSession(id string, username string) bool {
+	return deleteSessions(func(_ string, session SessionData) bool {
+		return session.Id == id && (username == "" || session.Username == username)
+	})
+}
+
+// DeleteOtherSessions removes every session of a user except the one with keepToken
+// Tokens the kept one replaced during their grace period are kept with it
+func DeleteOtherSessions(username string, keepToken string) {
+	Sessions.mu.RLock()
+	keepId := Sessions.sessions[keepToken].Id
+	Sessions.mu.RUnlock()
+
+	deleteSessions(func(token string, session SessionData) bool {
+		return session.Username == username && token != keepToken && (keepId == "" || session.Id != keepId)
+	})
 }
 
-// DeleteSession removes a session (logout)
+// DeleteSession removes a session (logout), including tokens it replaced during their grace period
 func DeleteSession(token string) {
+	Sessions.mu.RLock()
+	current, exists := Sessions.sessions[token]
+	Sessions.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	deleteSessions(func(_ string, session SessionData) bool {
+		return session.Id == current.Id
+	})
+}
+
+// DeleteUserSessions removes every session of a user
+func DeleteUserSessions(username string) {
+	deleteSessions(func(_ string, session SessionData) bool {
+		return session.Username == username
+	})
+}
+
+// deleteSessions removes the matching sessions and disconnects the Socket.IO clients that logged in with them,
+// a logged out browser must not keep its terminals and dashboards open
+// Returns false if no session matched
+func deleteSessions(match func(token string, session SessionData) bool) bool {
+	Sessions.mu.Lock()
+	removed := make(map[string]bool)
+	for token, session := range Sessions.sessions {
+		if match(token, session) {
+			delete(Sessions.sessions, token)
+			removed[session.Id] = true
+		}
+	}
+	Sessions.mu.Unlock()
+
+	if len(removed) > 0 {
+		netx.GetGlobalServer().DisconnectWhere(func(client *socket.Socket) bool {
+			principal, ok := SocketPrincipal(client)
+			return ok && principal.Session != "" && removed[principal.Session]
+		})
+	}
+	return len(removed) > 0
+}
+
+// ExportSessions saves the sessions to an unnamed temporary file so a restarted panel keeps everyone logged in
+func ExportSessions() (*os.File, error) {
+	f, err := os.CreateTemp("", "minimalpanel-sessions-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session file: %w", err)
+	}
+	// Tokens must not stay on disk, the open file is all that is needed
+	os.Remove(f.Name())
+
+	Sessions.mu.RLock()
+	err = json.NewEncoder(f).Encode(Sessions.sessions)
+	Sessions.mu.RUnlock()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write session file: %w", err)
+	}
+	return f, nil
+}
+
+// ImportSessions adds the sessions saved by ExportSessions, expired ones are dropped
+func ImportSessions(r io.Reader) error {
+	var sessions map[string]SessionData
+	if err := json.NewDecoder(r).Decode(&sessions); err != nil {
+		return fmt.Errorf("failed to read sessions: %w", err)
+	}
+
+	now := time.Now()
 	Sessions.mu.Lock()
 	defer Sessions.mu.Unlock()
-	delete(Sessions.sessions, token)
+	for token, session := range sessions {
+		if now.Before(session.ExpiresAt) {
+			Sessions.sessions[token] = session
+		}
+	}
+	return nil
 }
 
 // SetCookie sets an HTTP cookie with the session token
+// Remember-me sessions get a persistent cookie, others a browser session cookie
 func SetCookie(w http.ResponseWriter, token string) {
 	cookie := &http.Cookie{
 		Name:     CookieName,
 		Value:    token,
-		Path:     "/",
+		Path:     netx.Path("/"),
 		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
+		Secure:   netx.TLSActive(),
 		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(cookieLifespan),
 	}
+
+	Sessions.mu.RLock()
+	session, exists := Sessions.sessions[token]
+	Sessions.mu.RUnlock()
+	if exists && session.Remember {
+		cookie.Expires = session.MaxExpiresAt
+	}
+
 	http.SetCookie(w, cookie)
 }
 
@@ -119,8 +372,9 @@ func ClearCookie(w http.ResponseWriter) {
 	cookie := &http.Cookie{
 		Name:     CookieName,
 		Value:    "",
-		Path:     "/",
+		Path:     netx.Path("/"),
 		HttpOnly: true,
+		Secure:   netx.TLSActive(),
 		Expires:  time.Unix(0, 0), // Expired time
 	}
 	http.SetCookie(w, cookie)
@@ -141,19 +395,64 @@ func GetTokenFromHeader(r *http.Request) (string, bool) {
 	return authHeader, true
 }
 
-// IsAuthenticated checks if the request has a valid session (cookie or header)
-func IsAuthenticated(r *http.Request) (string, bool) {
+// GetSessionToken returns the login session token of a request (cookie or header)
+func GetSessionToken(r *http.Request) (string, bool) {
 	// Try cookie first
 	token, exists := GetTokenFromCookie(r)
 
 	// If no cookie, try Authorization header
 	if !exists {
 		token, exists = GetTokenFromHeader(r)
-		if !exists {
-			return "", false
+	}
+	return token, exists
+}
+
+// IsAuthenticated checks if the request comes through a trusted authenticating reverse proxy
+// or has a valid session (cookie or header)
+// The proxy's user wins over a session cookie, which may belong to whoever used the browser before
+func IsAuthenticated(r *http.Request) (string, bool) {
+	if username, ok := ForwardedUser(r); ok {
+		return username, true
+	}
+
+	if token, exists := GetSessionToken(r); exists {
+		if username, valid := ValidateSession(token); valid {
+			return username, true
 		}
 	}
+	return "", false
+}
+
+// Principal is who a request is authenticated as
+type Principal struct {
+	Username string
+	Token    *APIToken // nil for login sessions, which are not limited by scopes
+	Session  string    // Public id of the login session, empty for proxy users and API tokens
+}
 
-	username, valid := ValidateSession(token)
-	return username, valid
+// Allows reports whether the principal may use a scope
+func (p *Principal) Allows(scope string) bool {
+	return p.Token == nil || p.Token.Allows(scope)
+}
+
+// AllowsHost reports whether the principal may open terminals on a host
+func (p *Principal) AllowsHost(host string) bool {
+	return p.Token == nil || p.Token.AllowsHost(host)
+}
+
+// Authenticate resolves the login session or API token of a request
+func Authenticate(r *http.Request) (*Principal, bool) {
+	if username, valid := IsAuthenticated(r); valid {
+		return &Principal{Username: username}, true
+	}
+
+	token, exists := GetTokenFromHeader(r)
+	if !exists {
+		return nil, false
+	}
+	apiToken, valid := ValidateAPIToken(token, netx.ClientIP(r))
+	if !valid {
+		return nil, false
+	}
+	return &Principal{Username: apiToken.Username, Token: apiToken}, true
 }
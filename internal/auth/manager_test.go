@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"minimalpanel/internal/conf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogoutEndsRotatedLogin(t *testing.T) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+	conf.Conf.Auth.RememberMeRotate = 0
+
+	old, err := CreateSession("alice", true, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, rotated, err := RotateSession(old)
+	if err != nil || !rotated {
+		t.Fatalf("RotateSession: got %v %v, want a rotated token", rotated, err)
+	}
+
+	DeleteSession(current)
+	if _, ok := ValidateSession(current); ok {
+		t.Error("logged out token is still valid")
+	}
+	if _, ok := ValidateSession(old); ok {
+		t.Error("token replaced by the logged out one is still valid in its grace period")
+	}
+}
+
+func TestDeleteOtherSessionsKeepsRotatedLogin(t *testing.T) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+	conf.Conf.Auth.RememberMeRotate = 0
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	old, err := CreateSession("alice", true, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := RotateSession(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := CreateSession("alice", false, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteUserSessions("alice") })
+
+	DeleteOtherSessions("alice", current)
+	if _, ok := ValidateSession(other); ok {
+		t.Error("other session is still valid")
+	}
+	for _, token := range []string{current, old} {
+		if _, ok := ValidateSession(token); !ok {
+			t.Error("token of the kept login was revoked")
+		}
+	}
+}
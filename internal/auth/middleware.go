@@ -2,6 +2,7 @@ package auth
 
 import (
 	"github.com/zishang520/socket.io/servers/socket/v3"
+	"minimalpanel/internal/netx"
 	"net/http"
 	"strings"
 )
@@ -11,43 +12,157 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		_, authenticated := IsAuthenticated(r)
 		if !authenticated {
-			http.Redirect(w, r, "/pages/login.html", http.StatusSeeOther)
+			http.Redirect(w, r, netx.Path("/pages/login.html"), http.StatusSeeOther)
 			return
 		}
+		RefreshCookie(w, r)
+		next(w, r)
+	}
+}
+
+// RequireAuthAPI is a middleware that answers unauthenticated API requests with JSON instead of a redirect
+func RequireAuthAPI(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, authenticated := IsAuthenticated(r)
+		if !authenticated {
+			netx.WriteUnauthorized(w, "Not authenticated")
+			return
+		}
+		RefreshCookie(w, r)
+		next(w, r)
+	}
+}
+
+// RequireAdmin is a middleware that only lets administrators through to API routes
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, authenticated := Authenticate(r)
+		if !authenticated {
+			netx.WriteUnauthorized(w, "Not authenticated")
+			return
+		}
+		if !IsAdmin(principal.Username) || !principal.Allows(ScopeAdmin) {
+			netx.WriteForbidden(w, "Administrator privileges required")
+			return
+		}
+		RefreshCookie(w, r)
+		next(w, r)
+	}
+}
+
+// RequireScope is a middleware for API routes that also accept API tokens with the given scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, authenticated := Authenticate(r)
+		if !authenticated {
+			netx.WriteUnauthorized(w, "Not authenticated")
+			return
+		}
+		if !principal.Allows(scope) {
+			netx.WriteForbidden(w, "Token lacks the "+scope+" scope")
+			return
+		}
+		RefreshCookie(w, r)
 		next(w, r)
 	}
 }
 
 // RequireAuthSocketIO is a middleware that checks authentication for protected Socket.IO endpoints
+// The resolved Principal is stored on the socket, see SocketPrincipal
 func RequireAuthSocketIO(client *socket.Socket, next func(*socket.ExtendedError)) {
-	// Safely get cookies from headers
-	cookieHeader := client.Handshake().Headers["Cookie"]
-	if cookieHeader == nil {
-		next(socket.NewExtendedError("Unauthorized", "No cookies provided"))
-		return
+	ip := netx.ClientIP(client.Request().Request())
+	admit := func(principal *Principal) {
+		if !UserAddressAllowed(principal.Username, ip) {
+			next(socket.NewExtendedError("Forbidden", "Access denied from this address"))
+			return
+		}
+		client.SetData(principal)
+		next(nil)
 	}
 
-	cookieSlice, ok := cookieHeader.([]string)
-	if !ok || len(cookieSlice) == 0 {
-		next(socket.NewExtendedError("Unauthorized", "Invalid cookie format"))
+	// An authenticating reverse proxy names the user in a header, see IsAuthenticated
+	if username, ok := ForwardedUser(client.Request().Request()); ok {
+		admit(&Principal{Username: username})
 		return
 	}
 
-	cookies := cookieSlice[0]
-	cookie := func() string {
-		parts := strings.Split(cookies, ";")
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if strings.HasPrefix(p, CookieName+"=") {
-				return strings.TrimPrefix(p, CookieName+"=")
-			}
+	// Browsers authenticate with the session cookie
+	if cookie, ok := socketCookie(client); ok {
+		if session, valid := validateSession(cookie); valid {
+			admit(&Principal{Username: session.Username, Session: session.Id})
+			return
+		}
+	}
+
+	// Scripts send an API token in the Authorization header or the handshake auth payload
+	if token, ok := socketToken(client); ok {
+		if apiToken, valid := ValidateAPIToken(token, ip); valid {
+			admit(&Principal{Username: apiToken.Username, Token: apiToken})
+			return
 		}
-		return ""
-	}()
+	}
 
-	if _, ok := ValidateSession(cookie); ok {
+	next(socket.NewExtendedError("Unauthorized", "Invalid session"))
+}
+
+// RequireScopeSocketIO returns a middleware that admits API tokens to a namespace only if they grant the scope,
+// so a token without it never reaches the namespace's events. It must follow RequireAuthSocketIO
+func RequireScopeSocketIO(scope string) func(*socket.Socket, func(*socket.ExtendedError)) {
+	return func(client *socket.Socket, next func(*socket.ExtendedError)) {
+		if principal, ok := SocketPrincipal(client); ok && !principal.Allows(scope) {
+			next(socket.NewExtendedError("Forbidden", "Token lacks the "+scope+" scope"))
+			return
+		}
 		next(nil)
-	} else {
-		next(socket.NewExtendedError("Unauthorized", "Invalid session"))
 	}
 }
+
+// SocketPrincipal returns who an authenticated socket belongs to
+func SocketPrincipal(client *socket.Socket) (*Principal, bool) {
+	principal, ok := client.Data().(*Principal)
+	return principal, ok
+}
+
+// handshakeHeader returns the first value of a handshake header
+func handshakeHeader(client *socket.Socket, name string) (string, bool) {
+	header := client.Handshake().Headers[name]
+	if header == nil {
+		return "", false
+	}
+
+	values, ok := header.([]string)
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// socketCookie extracts the session token from the handshake cookies
+func socketCookie(client *socket.Socket) (string, bool) {
+	cookies, ok := handshakeHeader(client, "Cookie")
+	if !ok {
+		return "", false
+	}
+
+	parts := strings.Split(cookies, ";")
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, CookieName+"=") {
+			return strings.TrimPrefix(p, CookieName+"="), true
+		}
+	}
+	return "", false
+}
+
+// socketToken extracts an API token from the handshake
+func socketToken(client *socket.Socket) (string, bool) {
+	if token, ok := client.Handshake().Auth["token"].(string); ok && token != "" {
+		return token, true
+	}
+
+	header, ok := handshakeHeader(client, "Authorization")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(header, "Bearer "), true
+}
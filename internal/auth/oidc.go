@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTimeout is how long a user has to finish logging in at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcCookieName holds the state and nonce of a login in progress, so only the browser that started it can finish it
+const oidcCookieName = "mp-oidc"
+
+// oidcPending is a login that was sent to the provider and awaits its callback
+type oidcPending struct {
+	verifier  string // PKCE code verifier
+	nonce     string
+	remember  bool
+	createdAt time.Time
+}
+
+// oidcState caches the discovered provider and tracks logins in progress by their state parameter
+var oidcState = struct {
+	sync.Mutex
+	issuer   string
+	provider *oidc.Provider
+	pending  map[string]oidcPending
+}{pending: make(map[string]oidcPending)}
+
+// OIDCEnabled reports whether single sign-on is configured
+func OIDCEnabled() bool {
+	return conf.GetOIDC().Issuer != ""
+}
+
+// oidcProvider discovers the provider, the result is cached until the issuer changes
+func oidcProvider(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if oidcState.provider != nil && oidcState.issuer == issuer {
+		return oidcState.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	oidcState.issuer = issuer
+	oidcState.provider = provider
+	return provider, nil
+}
+
+// oidcClient returns the provider and OAuth2 client for the current config
+func oidcClient(ctx context.Context) (conf.OIDC, *oidc.Provider, *oauth2.Config, error) {
+	settings := conf.GetOIDC()
+	if settings.Issuer == "" {
+		return settings, nil, nil, fmt.Errorf("single sign-on is not configured")
+	}
+
+	provider, err := oidcProvider(ctx, settings.Issuer)
+	if err != nil {
+		return settings, nil, nil, err
+	}
+
+	client := &oauth2.Config{
+		ClientID:     settings.ClientID,
+		ClientSecret: settings.ClientSecret,
+		RedirectURL:  settings.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, settings.Scopes...),
+	}
+	return settings, provider, client, nil
+}
+
+// OIDCLoginURL starts an authorization code login with PKCE and returns the provider URL to send the browser to
+// The login is bound to the browser with a cookie, see OIDCLogin
+// remember: create a remember-me session once the login completes
+func OIDCLoginURL(w http.ResponseWriter, r *http.Request, remember bool) (string, error) {
+	_, _, client, err := oidcClient(r.Context())
+	if err != nil {
+		return "", err
+	}
+
+	state, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	oidcState.Lock()
+	now := time.Now()
+	for key, pending := range oidcState.pending {
+		if now.Sub(pending.createdAt) > oidcLoginTimeout {
+			delete(oidcState.pending, key)
+		}
+	}
+	oidcState.pending[state] = oidcPending{
+		verifier:  verifier,
+		nonce:     nonce,
+		remember:  remember,
+		createdAt: now,
+	}
+	oidcState.Unlock()
+
+	setOIDCCookie(w, state+"."+nonce, int(oidcLoginTimeout.Seconds()))
+	return client.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// setOIDCCookie sets or, with a negative maxAge, clears the cookie binding a login to the browser
+// It must be Lax, the provider sends the browser back with a cross-site redirect
+func setOIDCCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     netx.Path("/oidc/"),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   netx.TLSActive(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCLogin finishes a login from the provider's callback
+// The state must match the cookie set by OIDCLoginURL, so a login started elsewhere cannot be slipped to the browser
+// Returns the panel username and whether the user asked to be remembered
+func OIDCLogin(w http.ResponseWriter, r *http.Request) (string, bool, error) {
+	ctx := r.Context()
+	state := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("code")
+
+	var boundState, boundNonce string
+	if cookie, err := r.Cookie(oidcCookieName); err == nil {
+		boundState, boundNonce, _ = strings.Cut(cookie.Value, ".")
+	}
+	setOIDCCookie(w, "", -1)
+	if state == "" || subtle.ConstantTimeCompare([]byte(boundState), []byte(state)) != 1 {
+		return "", false, fmt.Errorf("login was not started in this browser, please try again")
+	}
+
+	oidcState.Lock()
+	pending, exists := oidcState.pending[state]
+	delete(oidcState.pending, state)
+	oidcState.Unlock()
+	if !exists || time.Since(pending.createdAt) > oidcLoginTimeout {
+		return "", false, fmt.Errorf("unknown or expired login, please try again")
+	}
+	if subtle.ConstantTimeCompare([]byte(boundNonce), []byte(pending.nonce)) != 1 {
+		return "", false, fmt.Errorf("login was not started in this browser, please try again")
+	}
+
+	settings, provider, client, err := oidcClient(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	token, err := client.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", false, fmt.Errorf("provider returned no ID token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: settings.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to verify ID token: %w", err)
+	}
+	if idToken.Nonce != pending.nonce {
+		return "", false, fmt.Errorf("ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", false, fmt.Errorf("failed to parse ID token claims: %w", err)
+	}
+
+	username, admin, err := mapOIDCClaims(settings, claims)
+	if err != nil {
+		return "", false, err
+	}
+	SetExternalAdmin(username, admin)
+	return username, pending.remember, nil
+}
+
+// mapOIDCClaims turns ID token claims into a panel username and role
+// The username carries UserPrefix, only Admins entries naming it with the prefix apply to it
+func mapOIDCClaims(settings conf.OIDC, claims map[string]interface{}) (string, bool, error) {
+	username, _ := claims[settings.UsernameClaim].(string)
+	if username == "" {
+		return "", false, fmt.Errorf("ID token has no %s claim", settings.UsernameClaim)
+	}
+	// An unverified address could belong to anyone
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && settings.UsernameClaim == "email" {
+		return "", false, fmt.Errorf("email address %s is not verified", username)
+	}
+
+	groups := claimStrings(claims[settings.GroupsClaim])
+	if len(settings.AllowedGroups) > 0 && !intersects(groups, settings.AllowedGroups) {
+		return "", false, fmt.Errorf("%s is not a member of an allowed group", username)
+	}
+	return settings.UserPrefix + username, intersects(groups, settings.AdminGroups), nil
+}
+
+// claimStrings reads a claim holding a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// intersects reports whether the lists share a name
+func intersects(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"minimalpanel/internal/conf"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID provider serving discovery, keys and the token endpoint
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]mockGrant // Issued authorization codes
+	nonce  string               // Replaces the nonce of the next ID token if set
+}
+
+// mockGrant is what the provider remembers about an authorization code
+type mockGrant struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, grants: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", issuer.handleToken)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// authorize plays the user logging in at the provider and returns the code it redirects back with
+func (self *mockIssuer) authorize(t *testing.T, target string) (state string, code string) {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("login does not use PKCE: %s", target)
+	}
+
+	code = "code-" + query.Get("state")
+	self.mu.Lock()
+	self.grants[code] = mockGrant{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	self.mu.Unlock()
+	return query.Get("state"), code
+}
+
+// handleToken exchanges a code for an ID token, checking the PKCE verifier
+func (self *mockIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	self.mu.Lock()
+	grant, exists := self.grants[r.Form.Get("code")]
+	delete(self.grants, r.Form.Get("code"))
+	nonce := grant.nonce
+	if self.nonce != "" {
+		nonce = self.nonce
+	}
+	self.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !exists || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	now := time.Now()
+	idToken := self.sign(map[string]interface{}{
+		"iss":            self.URL,
+		"aud":            "panel",
+		"sub":            "1234",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "admin",
+		"email_verified": true,
+		"groups":         []string{"staff", "ops"},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns claims as an RS256 JWT
+func (self *mockIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, self.key, crypto.SHA256, sum[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// useIssuer points the OIDC settings at the mock provider
+func useIssuer(t *testing.T, issuer *mockIssuer) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+
+	conf.Conf.Auth.OIDC = conf.OIDC{
+		Issuer:        issuer.URL,
+		ClientID:      "panel",
+		ClientSecret:  "secret",
+		RedirectURL:   "https://panel.example.com/oidc/callback",
+		UsernameClaim: "email",
+		UserPrefix:    "oidc:",
+		GroupsClaim:   "groups",
+		AdminGroups:   []string{"ops"},
+	}
+	conf.Conf.Auth.Admins = []string{"admin"}
+}
+
+// startLogin runs /oidc/login and returns the provider URL and the cookies set for the browser
+func startLogin(t *testing.T) (string, []*http.Cookie) {
+	recorder := httptest.NewRecorder()
+	target, err := OIDCLoginURL(recorder, httptest.NewRequest(http.MethodGet, "/oidc/login", nil), true)
+	if err != nil {
+		t.Fatalf("OIDCLoginURL: %v", err)
+	}
+	return target, recorder.Result().Cookies()
+}
+
+// callback runs /oidc/callback as the browser holding cookies
+func callback(state string, code string, cookies []*http.Cookie) (string, bool, error) {
+	query := url.Values{"state": {state}, "code": {code}}
+	r := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query.Encode(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return OIDCLogin(httptest.NewRecorder(), r)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useIssuer(t, issuer)
+
+	target, cookies := startLogin(t)
+	if !strings.HasPrefix(target, issuer.URL+"/authorize?") {
+		t.Fatalf("login goes to %s, not the discovered endpoint", target)
+	}
+	state, code := issuer.authorize(t, target)
+
+	username, remember, err := callback(state, code, cookies)
+	if err != nil {
+		t.Fatalf("OIDCLogin: %v", err)
+	}
+	if username != "oidc:admin" || !remember {
+		t.Errorf("got user %q remember %v, want oidc:admin and true", username, remember)
+	}
+	// Admin through AdminGroups, not because Admins lists a local user of the same name
+	if !IsAdmin(username) {
+		t.Errorf("member of an admin group is no admin")
+	}
+	SetExternalAdmin(username, false)
+	if IsAdmin(username) {
+		t.Errorf("provider user inherits the rights of the local admin")
+	}
+
+	// A state is good for one login only
+	if _, _, err := callback(state, code, cookies); err == nil {
+		t.Errorf("state was accepted twice")
+	}
+}
+
+func TestOIDCLoginRequiresCookie(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useIssuer(t, issuer)
+
+	// An attacker starts a login and sends the victim the callback URL
+	target, _ := startLogin(t)
+	state, code := issuer.authorize(t, target)
+	if _, _, err := callback(state, code, nil); err == nil {
+		t.Fatal("callback without the login cookie was accepted")
+	}
+
+	// A cookie from another login does not match either
+	_, otherCookies := startLogin(t)
+	target, _ = startLogin(t)
+	state, code = issuer.authorize(t, target)
+	if _, _, err := callback(state, code, otherCookies); err == nil {
+		t.Fatal("callback with the cookie of another login was accepted")
+	}
+}
+
+func TestOIDCLoginNonce(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useIssuer(t, issuer)
+
+	target, cookies := startLogin(t)
+	state, code := issuer.authorize(t, target)
+	issuer.nonce = "replayed"
+	if _, _, err := callback(state, code, cookies); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("ID token with another nonce: got %v, want a nonce error", err)
+	}
+}
+
+func TestOIDCLoginCodeExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useIssuer(t, issuer)
+
+	target, cookies := startLogin(t)
+	state, _ := issuer.authorize(t, target)
+	if _, _, err := callback(state, "forged", cookies); err == nil || !strings.Contains(err.Error(), "exchange") {
+		t.Fatalf("unknown code: got %v, want an exchange error", err)
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"log"
+	"minimalpanel/internal/conf"
+)
+
+// ConfigChanged brings the auth state in line with a new config, register it with conf.Subscribe
+// Users and backends are read on every request, only what is cached here needs updating
+func ConfigChanged(old conf.Config, new conf.Config) {
+	if old.Auth.TokenPath != new.Auth.TokenPath {
+		if err := LoadTokens(); err != nil {
+			log.Printf("Failed to load API tokens: %v", err)
+		}
+	}
+	if old.Auth.WebAuthn.Path != new.Auth.WebAuthn.Path {
+		if err := LoadPasskeys(); err != nil {
+			log.Printf("Failed to load passkeys: %v", err)
+		}
+	}
+
+	// A user removed from the file must not stay logged in or keep another way back in,
+	// however they were removed: the user command cannot reach the stores of a running panel
+	for name := range old.Auth.Users {
+		if _, exists := new.Auth.Users[name]; exists {
+			continue
+		}
+		DeleteUserSessions(name)
+		if err := RevokeUserTokens(name); err != nil {
+			log.Printf("Failed to revoke API tokens of %s: %v", name, err)
+		}
+		if err := DeleteUserPasskeys(name); err != nil {
+			log.Printf("Failed to delete passkeys of %s: %v", name, err)
+		}
+		log.Printf("User %s removed from the config, logged out", name)
+	}
+}
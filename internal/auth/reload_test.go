@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"minimalpanel/internal/conf"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemovedUserLosesTokensAndPasskeys(t *testing.T) {
+	usePasskeys(t)
+	conf.Conf.Auth.Users["bob"] = "$2a$10$unused"
+	conf.Conf.Auth.TokenPath = filepath.Join(t.TempDir(), "tokens.json")
+
+	key := newSoftAuthenticator(t)
+	key.register(t, "alice")
+	token, _, err := CreateAPIToken("alice", "ci", []string{ScopeMetricsRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := CreateAPIToken("bob", "ci", []string{ScopeMetricsRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := CreateSession("alice", false, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RevokeUserTokens("bob") })
+
+	// Removed like by hand or by the user command of another process, the stores only see the config change
+	old := conf.Conf
+	conf.Conf.Auth.Users = map[string]string{"bob": "$2a$10$unused"}
+	ConfigChanged(old, conf.Conf)
+
+	if _, ok := ValidateAPIToken(token, "192.0.2.1"); ok {
+		t.Error("API token of the removed user still works")
+	}
+	if _, err := key.login(t, ""); err == nil {
+		t.Error("passkey of the removed user still logs in")
+	}
+	if passkeys := ListPasskeys("alice"); len(passkeys) != 0 {
+		t.Errorf("removed user kept passkeys %+v", passkeys)
+	}
+	if _, ok := ValidateSession(session); ok {
+		t.Error("session of the removed user is still valid")
+	}
+	if _, ok := ValidateAPIToken(kept, "192.0.2.1"); !ok {
+		t.Error("API token of a remaining user was revoked")
+	}
+}
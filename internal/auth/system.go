@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/md5_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// systemBackend checks passwords of the host's own accounts against the shadow file
+// Only members of the allowed groups may log in, so service accounts stay out
+type systemBackend struct {
+	settings conf.System
+}
+
+// shadowEntry is the part of a shadow file line needed to check a password
+type shadowEntry struct {
+	hash    string
+	expires int64 // Days since the epoch, 0 means never
+}
+
+// Authenticate checks the user's group membership and password
+func (b systemBackend) Authenticate(username string, password string) (*Identity, error) {
+	if len(b.settings.AllowedGroups) == 0 {
+		return nil, fmt.Errorf("no allowed groups configured for system accounts")
+	}
+
+	groups, err := systemGroups(username)
+	if err != nil {
+		return nil, err
+	}
+	if !intersects(groups, b.settings.AllowedGroups) {
+		return nil, perr.UserNotFound
+	}
+
+	entry, err := readShadow(b.settings.ShadowPath, username)
+	if err != nil {
+		return nil, err
+	}
+	if entry.expires > 0 && time.Now().Unix()/86400 >= entry.expires {
+		return nil, fmt.Errorf("account %s has expired: %w", username, perr.WrongPassword)
+	}
+	if err := verifyCrypt(entry.hash, password); err != nil {
+		if errors.Is(err, perr.WrongPassword) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to check the password of %s: %w", username, err)
+	}
+
+	return &Identity{Username: b.settings.UserPrefix + username, Admin: intersects(groups, b.settings.AdminGroups)}, nil
+}
+
+// Lookup checks that the account still exists, is in an allowed group and is neither locked nor expired
+func (b systemBackend) Lookup(username string) (*Identity, error) {
+	name, found := strings.CutPrefix(username, b.settings.UserPrefix)
+	if !found || name == "" || len(b.settings.AllowedGroups) == 0 {
+		return nil, perr.UserNotFound
+	}
+
+	groups, err := systemGroups(name)
+	if err != nil {
+		return nil, err
+	}
+	if !intersects(groups, b.settings.AllowedGroups) {
+		return nil, perr.UserNotFound
+	}
+
+	entry, err := readShadow(b.settings.ShadowPath, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.hash == "" || strings.HasPrefix(entry.hash, "!") || strings.HasPrefix(entry.hash, "*") {
+		return nil, fmt.Errorf("account %s is locked: %w", name, perr.UserNotFound)
+	}
+	if entry.expires > 0 && time.Now().Unix()/86400 >= entry.expires {
+		return nil, fmt.Errorf("account %s has expired: %w", name, perr.UserNotFound)
+	}
+	return &Identity{Username: username, Admin: intersects(groups, b.settings.AdminGroups)}, nil
+}
+
+// systemGroups returns the names of the user's primary and supplementary groups
+func systemGroups(username string) ([]string, error) {
+	account, err := user.Lookup(username)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil, perr.UserNotFound
+		}
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	ids, err := account.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups of %s: %w", username, err)
+	}
+	groups := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if group, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, group.Name)
+		}
+	}
+	return groups, nil
+}
+
+// readShadow finds the user's line in the shadow file
+func readShadow(path string, username string) (*shadowEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shadow file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 2 || fields[0] != username {
+			continue
+		}
+
+		entry := &shadowEntry{hash: fields[1]}
+		if len(fields) > 7 && fields[7] != "" {
+			entry.expires, _ = strconv.ParseInt(fields[7], 10, 64)
+		}
+		return entry, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read shadow file: %w", err)
+	}
+	return nil, perr.UserNotFound
+}
+
+// verifyCrypt compares a password with a crypt(3) hash
+// Locked accounts and accounts without a password never match
+func verifyCrypt(hash string, password string) error {
+	switch {
+	case hash == "" || strings.HasPrefix(hash, "!") || strings.HasPrefix(hash, "*"):
+		return perr.WrongPassword
+	case strings.HasPrefix(hash, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return perr.WrongPassword
+		}
+		return nil
+	case strings.HasPrefix(hash, "$y$"):
+		ok, err := verifyYescrypt(hash, password)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return perr.WrongPassword
+		}
+		return nil
+	case !crypt.IsHashSupported(hash):
+		// Legacy DES, scrypt ($7$), gost-yescrypt and others have no Go implementation here
+		scheme := "DES"
+		if parts := strings.Split(hash, "$"); len(parts) > 2 {
+			scheme = "$" + parts[1] + "$"
+		}
+		return fmt.Errorf("unsupported password hash scheme %s, rehash the password with yescrypt or SHA-512 (passwd)", scheme)
+	}
+
+	if err := crypt.NewFromHash(hash).Verify(hash, []byte(password)); err != nil {
+		return perr.WrongPassword
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes made by libxcrypt's crypt(3)
+var yescryptVectors = []struct {
+	password string
+	hash     string
+}{
+	{"secret", "$y$j9T$abcdefghijklmnop$3dL1LkYnZM.OVXuVdnnaKVDlLYT92dRwOzDZ5XiVCe."},
+	{"pässwörd with spaces", "$y$j9T$abcdefghijklmnop$sYR6yvcCxVe8URHrxftZ4WO4TyywDBJ59uS1XK37/L4"},
+	{"secret", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$GmcwIgvdUC9qLWcKCi6gklUa1dM3ziD43YxYNURLKy0"},
+	{"secret", "$y$j7T$LdJMENpBABJJ3hIHjB1Bi.$FsyQWT1Lc./x0gYrp8IaXcPmE.y0MgyAU6ulMDnFJhA"},
+	{"secret", "$y$j9T..$LdJMENpBABJJ3hIHjB1Bi.$YM3gqdh4a4GO7sv.5pqIxboWq.GWt5JPDWYwwW5w1R4"},       // p = 2
+	{"secret", "$y$j9T/.$LdJMENpBABJJ3hIHjB1Bi.$bf6bJ4xJq4hlzwVM9/9RZnMlEjoQZCMWT6PzfxttG.6"},       // t = 1
+	{"secret", "$y$j9T/0$LdJMENpBABJJ3hIHjB1Bi.$FqnQorx92JXBb6ArG7LXtDmuWflJGQf71SVQZnSAaA5"},       // t = 3
+	{"secret", "$y$j9T0..$LdJMENpBABJJ3hIHjB1Bi.$8R86dcyDBP22vt3MoBg9Z3vp3Eb/L7SPjwqLy2CsSu9"},      // p = 2, t = 1
+	{"pässwörd with spaces", "$y$jC5$xyz0123456789ABC$Mwg2kZhkEGq33YgP7uyEs1ED4.KKIwhV2Xy2b6Zno17"}, // Prehashed
+}
+
+func TestVerifyCryptYescrypt(t *testing.T) {
+	for _, vector := range yescryptVectors {
+		if err := verifyCrypt(vector.hash, vector.password); err != nil {
+			t.Errorf("%s: %v", vector.hash, err)
+		}
+		if err := verifyCrypt(vector.hash, vector.password+"x"); !errors.Is(err, perr.WrongPassword) {
+			t.Errorf("%s with a wrong password: got %v", vector.hash, err)
+		}
+	}
+}
+
+func TestVerifyCryptUnsupported(t *testing.T) {
+	for _, hash := range []string{
+		"$7$CU..../....abcdefgh$0123456789012345678901234567890123456789012",
+		"$y$j75$QWErty$0123456789012345678901234567890123456789012",           // Salt with stray bits
+		"$y$/9T$abcdefghijklmnop$3dL1LkYnZM.OVXuVdnnaKVDlLYT92dRwOzDZ5XiVCe.", // Classic scrypt flavor
+		"abJnggxhB/yWI",
+	} {
+		err := verifyCrypt(hash, "secret")
+		if err == nil || errors.Is(err, perr.WrongPassword) {
+			t.Errorf("%s: got %v, want an error naming the problem", hash, err)
+		}
+	}
+
+	err := verifyCrypt("$7$CU..../....abcdefgh$0123456789012345678901234567890123456789012", "secret")
+	if err == nil || !strings.Contains(err.Error(), "$7$") {
+		t.Errorf("error does not name the scheme: %v", err)
+	}
+}
+
+func TestVerifyCryptLocked(t *testing.T) {
+	for _, hash := range []string{"", "!", "*", "!" + yescryptVectors[0].hash} {
+		if err := verifyCrypt(hash, "secret"); !errors.Is(err, perr.WrongPassword) {
+			t.Errorf("%q: got %v, want a wrong password", hash, err)
+		}
+	}
+}
+
+func TestSystemUserCannotBecomeLocalAdmin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("root-pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(shadow, []byte("root:"+string(hash)+":19000:0:99999:7:::\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+	conf.Conf.Auth.Backends = []string{"system", "local"}
+	conf.Conf.Auth.System = conf.Defaults().Auth.System
+	conf.Conf.Auth.System.ShadowPath = shadow
+	conf.Conf.Auth.System.AllowedGroups = []string{"root"}
+	conf.Conf.Auth.Users = map[string]string{"root": "$2a$10$unused"}
+	conf.Conf.Auth.Admins = []string{"root"}
+
+	username, ok := VerifyPassword("root", "root-pw")
+	if !ok {
+		t.Fatal("host account root was rejected")
+	}
+	if username != "system:root" {
+		t.Fatalf("host account logged in as %q, want system:root", username)
+	}
+	if IsAdmin(username) {
+		t.Error("host account inherits the rights of the local admin")
+	}
+}
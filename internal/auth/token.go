@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/netx"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPrefix marks API tokens so they are not mistaken for login session tokens
+const TokenPrefix = "mpt_"
+
+// Token scopes
+const (
+	ScopeMetricsRead = "metrics:read" // Read system metrics
+	ScopeSSHExec     = "ssh:exec"     // Open terminals on any host, "ssh:exec:<group>" limits it to a host group
+	ScopeAdmin       = "admin"        // Administrative endpoints, only for admin users
+)
+
+// lastUsedPersistInterval limits how often last-used tracking is written to disk
+const lastUsedPersistInterval = time.Minute
+
+// APIToken is a named long-lived token, only the hash of its secret is kept
+type APIToken struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Username   string    `json:"username"`
+	Scopes     []string  `json:"scopes"`
+	Hash       string    `json:"hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"` // Zero means no expiry
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+}
+
+// TokenStore holds API tokens keyed by their hash and persists them to disk
+type TokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*APIToken
+}
+
+// Global token store
+var Tokens = &TokenStore{
+	tokens: make(map[string]*APIToken),
+}
+
+// Allows reports whether the token grants a scope
+func (t *APIToken) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHost reports whether the token may open terminals on a host
+func (t *APIToken) AllowsHost(host string) bool {
+	groups := conf.GetLibrary().HostGroups
+	for _, s := range t.Scopes {
+		if s == ScopeSSHExec {
+			return true
+		}
+		group, found := strings.CutPrefix(s, ScopeSSHExec+":")
+		if !found {
+			continue
+		}
+		for _, member := range groups[group] {
+			if member == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token is past its expiry
+func (t *APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// ValidScope reports whether a scope string is known
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeMetricsRead, ScopeSSHExec, ScopeAdmin:
+		return true
+	}
+	group, found := strings.CutPrefix(scope, ScopeSSHExec+":")
+	return found && group != ""
+}
+
+// hashToken returns the stored form of a token secret
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadTokens reads the token file into memory, a missing file means no tokens
+func LoadTokens() error {
+	data, err := os.ReadFile(conf.GetTokenPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var list []*APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse token file: %w", err)
+	}
+
+	Tokens.mu.Lock()
+	defer Tokens.mu.Unlock()
+	Tokens.tokens = make(map[string]*APIToken)
+	for _, t := range list {
+		Tokens.tokens[t.Hash] = t
+	}
+	return nil
+}
+
+// save writes all tokens to the token file, the caller must hold the lock
+func (s *TokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	return writeFileAtomic(conf.GetTokenPath(), data)
+}
+
+// writeFileAtomic replaces a file through a temp file so a crash never leaves it truncated
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CreateAPIToken creates a token for the user and returns its secret, which is never shown again
+// lifespan: zero for a token that never expires
+func CreateAPIToken(username string, name string, scopes []string, lifespan time.Duration) (string, *APIToken, error) {
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return "", nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+		if scope == ScopeAdmin && !IsAdmin(username) {
+			return "", nil, fmt.Errorf("only administrators may create admin tokens")
+		}
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("at least one scope is required")
+	}
+
+	secret, err := GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := TokenPrefix + secret
+	apiToken := &APIToken{
+		Id:        id[:16],
+		Name:      name,
+		Username:  username,
+		Scopes:    scopes,
+		Hash:      hashToken(token),
+		CreatedAt: time.Now(),
+	}
+	if lifespan > 0 {
+		apiToken.ExpiresAt = apiToken.CreatedAt.Add(lifespan)
+	}
+
+	Tokens.mu.Lock()
+	defer Tokens.mu.Unlock()
+	Tokens.tokens[apiToken.Hash] = apiToken
+	if err := Tokens.save(); err != nil {
+		delete(Tokens.tokens, apiToken.Hash)
+		return "", nil, err
+	}
+
+	copied := *apiToken
+	return token, &copied, nil
+}
+
+// ValidateAPIToken checks a token and records its use
+func ValidateAPIToken(token string, ip string) (*APIToken, bool) {
+	if !strings.HasPrefix(token, TokenPrefix) {
+		return nil, false
+	}
+
+	Tokens.mu.Lock()
+	defer Tokens.mu.Unlock()
+
+	apiToken, exists := Tokens.tokens[hashToken(token)]
+	if !exists || apiToken.Expired() {
+		return nil, false
+	}
+
+	now := time.Now()
+	persist := now.Sub(apiToken.LastUsedAt) > lastUsedPersistInterval
+	apiToken.LastUsedAt = now
+	apiToken.LastUsedIP = ip
+	if persist {
+		// Tracking is best effort, a failed write must not reject the request
+		Tokens.save()
+	}
+
+	copied := *apiToken
+	return &copied, true
+}
+
+// ListAPITokens returns the user's tokens, or every token for an empty username
+func ListAPITokens(username string) []APIToken {
+	Tokens.mu.RLock()
+	defer Tokens.mu.RUnlock()
+
+	list := make([]APIToken, 0)
+	for _, t := range Tokens.tokens {
+		if username == "" || t.Username == username {
+			copied := *t
+			copied.Hash = ""
+			list = append(list, copied)
+		}
+	}
+	return list
+}
+
+// RevokeAPIToken deletes a token by id
+// username: owner the token must belong to, empty to revoke any user's token
+func RevokeAPIToken(id string, username string) error {
+	Tokens.mu.Lock()
+	defer Tokens.mu.Unlock()
+
+	for hash, t := range Tokens.tokens {
+		if t.Id == id && (username == "" || t.Username == username) {
+			delete(Tokens.tokens, hash)
+			disconnectTokens(func(t *APIToken) bool { return t.Id == id })
+			return Tokens.save()
+		}
+	}
+	return fmt.Errorf("token not found")
+}
+
+// RevokeUserTokens deletes every token of a user
+func RevokeUserTokens(username string) error {
+	Tokens.mu.Lock()
+	defer Tokens.mu.Unlock()
+
+	revoked := false
+	for hash, t := range Tokens.tokens {
+		if t.Username == username {
+			delete(Tokens.tokens, hash)
+			revoked = true
+		}
+	}
+	if !revoked {
+		return nil
+	}
+	disconnectTokens(func(t *APIToken) bool { return t.Username == username })
+	return Tokens.save()
+}
+
+// disconnectTokens drops the Socket.IO clients authenticated with a matching token,
+// a revoked token must not keep its terminals and dashboards open
+func disconnectTokens(match func(t *APIToken) bool) {
+	netx.GetGlobalServer().DisconnectWhere(func(client *socket.Socket) bool {
+		principal, ok := SocketPrincipal(client)
+		return ok && principal.Token != nil && match(principal.Token)
+	})
+}
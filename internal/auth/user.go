@@ -3,40 +3,208 @@ package auth
 import (
 	"fmt"
 	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"sort"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-// NewUser creates a new user with hashed password and saves it to the config file
-func NewUser(name string, password string) error {
+// UserInfo describes a panel user without its password hash
+type UserInfo struct {
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"`
+}
+
+// NewUser creates a new user with hashed password and saves it to the config file in one write
+// param: admin: whether the user gets admin rights right away
+// param: by: who adds the user, for the config history
+func NewUser(name string, password string, admin bool, by string) error {
+	if name == "" {
+		return fmt.Errorf("username is required")
+	}
+	if password == "" {
+		return perr.PasswordRequired
+	}
+	reason := "Add user " + name
+	if admin {
+		reason += " with admin rights"
+	}
+	return savePassword(name, password, conf.Change{Author: by, Reason: reason}, func(newConf *conf.Config) error {
+		if _, exists := newConf.Auth.Users[name]; exists {
+			return perr.UserExists
+		}
+		if admin {
+			newConf.Auth.Admins = append(removeName(newConf.Auth.Admins, name), name)
+		}
+		return nil
+	})
+}
+
+// SetPassword replaces an existing user's password and saves it to the config file
+// param: by: who sets the password, for the config history
+func SetPassword(name string, password string, by string) error {
+	if password == "" {
+		return perr.PasswordRequired
+	}
+	return savePassword(name, password, conf.Change{Author: by, Reason: "Set password of " + name}, func(newConf *conf.Config) error {
+		if _, exists := newConf.Auth.Users[name]; !exists {
+			return perr.UserNotFound
+		}
+		return nil
+	})
+}
+
+// ChangePassword lets a user replace their own password after proving they know the current one
+func ChangePassword(name string, current string, password string) error {
+	if _, err := (localBackend{}).Authenticate(name, current); err != nil {
+		return perr.WrongPassword
+	}
+	return SetPassword(name, password, name)
+}
+
+// savePassword hashes the password and stores it for the user
+// param: check: runs on the config being changed first, an error aborts the write
+func savePassword(name string, password string, change conf.Change, check func(newConf *conf.Config) error) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	newConf := conf.Read()
-
-	if newConf.Auth.Users == nil {
-		newConf.Auth.Users = make(map[string]string)
-	}
-	newConf.Auth.Users[name] = string(hash)
+	return conf.Modify(change, func(newConf *conf.Config) error {
+		if err := check(newConf); err != nil {
+			return err
+		}
+		if newConf.Auth.Users == nil {
+			newConf.Auth.Users = make(map[string]string)
+		}
+		newConf.Auth.Users[name] = string(hash)
+		return nil
+	})
+}
 
-	err = conf.Write(newConf)
+// DeleteUser removes a user, their admin rights, login sessions, API tokens and passkeys
+// Terminals end through the config change, see web.ConfigChanged
+// param: by: who deletes the user, for the config history
+func DeleteUser(name string, by string) error {
+	err := conf.Modify(conf.Change{Author: by, Reason: "Delete user " + name}, func(newConf *conf.Config) error {
+		if _, exists := newConf.Auth.Users[name]; !exists {
+			return perr.UserNotFound
+		}
+		delete(newConf.Auth.Users, name)
+		newConf.Auth.Admins = removeName(newConf.Auth.Admins, name)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to write config file: %w", err)
+		return err
 	}
 
+	DeleteUserSessions(name)
+	if err := RevokeUserTokens(name); err != nil {
+		return fmt.Errorf("failed to revoke API tokens: %w", err)
+	}
+	if err := DeleteUserPasskeys(name); err != nil {
+		return fmt.Errorf("failed to delete passkeys: %w", err)
+	}
 	return nil
 }
 
-// VerifyPassword verifies a user's password against the stored hash
-func VerifyPassword(name string, password string) bool {
+// SetAdmin grants or revokes a user's admin rights and saves it to the config file
+// param: by: who changes the rights, for the config history
+func SetAdmin(name string, admin bool, by string) error {
+	reason := "Revoke admin rights of " + name
+	if admin {
+		reason = "Grant admin rights to " + name
+	}
+
+	return conf.Modify(conf.Change{Author: by, Reason: reason}, func(newConf *conf.Config) error {
+		if _, exists := newConf.Auth.Users[name]; !exists {
+			return perr.UserNotFound
+		}
+		newConf.Auth.Admins = removeName(newConf.Auth.Admins, name)
+		if admin {
+			newConf.Auth.Admins = append(newConf.Auth.Admins, name)
+		}
+		return nil
+	})
+}
+
+// ListUsers returns all users sorted by name
+func ListUsers() []UserInfo {
+	users := conf.GetUsers()
+	list := make([]UserInfo, 0, len(users))
+	for name := range users {
+		list = append(list, UserInfo{Username: name, Admin: IsAdmin(name)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
+
+// removeName returns names without name
+func removeName(names []string, name string) []string {
+	kept := names[:0]
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// localBackend checks passwords against the bcrypt hashes in Users
+type localBackend struct{}
+
+// Authenticate verifies a user's password against the stored hash
+func (localBackend) Authenticate(name string, password string) (*Identity, error) {
 	users := conf.GetUsers()
 	hashedPassword, exists := users[name]
 	if !exists {
-		return false
+		return nil, perr.UserNotFound
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		return nil, perr.WrongPassword
+	}
+	return &Identity{Username: name}, nil
+}
+
+// Lookup finds a user in Users
+func (localBackend) Lookup(name string) (*Identity, error) {
+	if _, exists := conf.GetUsers()[name]; !exists {
+		return nil, perr.UserNotFound
+	}
+	return &Identity{Username: name}, nil
+}
+
+// externalAdmins holds users an identity provider made administrators at their last login
+var externalAdmins = struct {
+	sync.RWMutex
+	users map[string]bool
+}{users: make(map[string]bool)}
+
+// SetExternalAdmin records the role an identity provider granted a user at login
+func SetExternalAdmin(name string, admin bool) {
+	externalAdmins.Lock()
+	defer externalAdmins.Unlock()
+	if admin {
+		externalAdmins.users[name] = true
+	} else {
+		delete(externalAdmins.users, name)
+	}
+}
+
+// IsAdmin reports whether the user is allowed to use administrative endpoints
+// Users listed in Admins always are, others when their identity provider said so
+func IsAdmin(name string) bool {
+	for _, admin := range conf.GetAdmins() {
+		if admin == name {
+			return true
+		}
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	return err == nil
+	externalAdmins.RLock()
+	defer externalAdmins.RUnlock()
+	return externalAdmins.users[name]
 }
@@ -0,0 +1,16 @@
+package auth
+
+import (
+	"errors"
+	perr "minimalpanel/internal/error"
+	"testing"
+)
+
+func TestEmptyPasswordRejected(t *testing.T) {
+	if err := SetPassword("alice", "", "test"); !errors.Is(err, perr.PasswordRequired) {
+		t.Errorf("SetPassword: got %v, want perr.PasswordRequired", err)
+	}
+	if err := NewUser("alice", "", false, "test"); !errors.Is(err, perr.PasswordRequired) {
+		t.Errorf("NewUser: got %v, want perr.PasswordRequired", err)
+	}
+}
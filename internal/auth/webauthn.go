@@ -0,0 +1,450 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"minimalpanel/internal/conf"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ceremonyTimeout is how long a browser has to answer a registration or login challenge
+const ceremonyTimeout = 5 * time.Minute
+
+// Passkey is a registered authenticator, a passkey or a security key
+type Passkey struct {
+	Id         string              `json:"id"` // Base64url credential id
+	Name       string              `json:"name"`
+	CreatedAt  time.Time           `json:"created_at"`
+	LastUsedAt time.Time           `json:"last_used_at"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+// PasskeyInfo describes a passkey for listing
+type PasskeyInfo struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// passkeyUser is a panel user as WebAuthn sees it
+type passkeyUser struct {
+	Handle   []byte     `json:"handle"` // Random user handle, the username is never sent to authenticators as id
+	Passkeys []*Passkey `json:"passkeys"`
+	name     string
+}
+
+func (u *passkeyUser) WebAuthnID() []byte          { return u.Handle }
+func (u *passkeyUser) WebAuthnName() string        { return u.name }
+func (u *passkeyUser) WebAuthnDisplayName() string { return u.name }
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Passkeys))
+	for i, p := range u.Passkeys {
+		credentials[i] = p.Credential
+	}
+	return credentials
+}
+
+// ceremony is a registration or login waiting for the browser's answer
+type ceremony struct {
+	session  webauthn.SessionData
+	register bool
+	username string // Empty for passwordless logins, where the authenticator names the user
+	name     string // Name of the passkey being registered
+	remember bool
+}
+
+// PasskeyStore holds registered authenticators by username and persists them to disk
+type PasskeyStore struct {
+	mu         sync.Mutex
+	users      map[string]*passkeyUser
+	ceremonies map[string]ceremony
+}
+
+// Global passkey store
+var Passkeys = &PasskeyStore{
+	users:      make(map[string]*passkeyUser),
+	ceremonies: make(map[string]ceremony),
+}
+
+// LoadPasskeys reads the passkey file into memory, a missing file means no passkeys
+func LoadPasskeys() error {
+	data, err := os.ReadFile(conf.GetWebAuthn().Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read passkey file: %w", err)
+	}
+
+	users := make(map[string]*passkeyUser)
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("failed to parse passkey file: %w", err)
+	}
+	for name, user := range users {
+		user.name = name
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+	Passkeys.users = users
+	return nil
+}
+
+// save writes all passkeys to the passkey file, the caller must hold the lock
+func (s *PasskeyStore) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode passkeys: %w", err)
+	}
+	return writeFileAtomic(conf.GetWebAuthn().Path, data)
+}
+
+// begin stores a ceremony and returns its id, the caller must hold the lock
+func (s *PasskeyStore) begin(c ceremony) (string, error) {
+	now := time.Now()
+	for id, pending := range s.ceremonies {
+		if now.After(pending.session.Expires) {
+			delete(s.ceremonies, id)
+		}
+	}
+
+	id, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	s.ceremonies[id] = c
+	return id, nil
+}
+
+// finish removes a ceremony so its challenge can only be answered once, the caller must hold the lock
+func (s *PasskeyStore) finish(id string) (ceremony, bool) {
+	c, exists := s.ceremonies[id]
+	delete(s.ceremonies, id)
+	if !exists || time.Now().After(c.session.Expires) {
+		return ceremony{}, false
+	}
+	return c, true
+}
+
+// relyingParty configures WebAuthn for the panel, unset ids and origins are taken from the request
+func relyingParty(r *http.Request) (*webauthn.WebAuthn, error) {
+	settings := conf.GetWebAuthn()
+	if settings.RPID == "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		settings.RPID = host
+	}
+	if len(settings.RPOrigins) == 0 {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		settings.RPOrigins = []string{scheme + "://" + r.Host}
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          settings.RPID,
+		RPDisplayName: settings.RPDisplayName,
+		RPOrigins:     settings.RPOrigins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+// BeginPasskeyRegistration starts registering a new authenticator for the user
+// Returns the ceremony id and the options for navigator.credentials.create
+func BeginPasskeyRegistration(r *http.Request, username string, name string) (string, *protocol.CredentialCreation, error) {
+	if name == "" {
+		return "", nil, fmt.Errorf("passkey name is required")
+	}
+	// Passkey logins look the account up again, which single sign-on and proxy users cannot be
+	if _, err := LookupUser(username); err != nil {
+		return "", nil, err
+	}
+	rp, err := relyingParty(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	user, exists := Passkeys.users[username]
+	if !exists {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return "", nil, err
+		}
+		user = &passkeyUser{Handle: handle, name: username}
+	}
+
+	creation, session, err := rp.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+		// Discoverable credentials allow passwordless login, security keys without storage still work as a second factor
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start registration: %w", err)
+	}
+
+	id, err := Passkeys.begin(ceremony{session: *session, register: true, username: username, name: name})
+	if err != nil {
+		return "", nil, err
+	}
+	return id, creation, nil
+}
+
+// FinishPasskeyRegistration verifies the browser's answer and stores the new authenticator
+// r: the request carrying the attestation response as its body
+func FinishPasskeyRegistration(r *http.Request, id string, username string) (*PasskeyInfo, error) {
+	rp, err := relyingParty(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	c, ok := Passkeys.finish(id)
+	if !ok || !c.register || c.username != username {
+		return nil, fmt.Errorf("unknown or expired registration, please try again")
+	}
+
+	user, exists := Passkeys.users[username]
+	if !exists {
+		user = &passkeyUser{Handle: c.session.UserID, name: username}
+	}
+
+	credential, err := rp.FinishRegistration(user, c.session, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify authenticator: %w", err)
+	}
+
+	now := time.Now()
+	passkey := &Passkey{
+		Id:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:       c.name,
+		CreatedAt:  now,
+		Credential: *credential,
+	}
+	user.Passkeys = append(user.Passkeys, passkey)
+	Passkeys.users[username] = user
+	if err := Passkeys.save(); err != nil {
+		user.Passkeys = user.Passkeys[:len(user.Passkeys)-1]
+		if !exists {
+			delete(Passkeys.users, username)
+		}
+		return nil, err
+	}
+
+	info := passkey.info()
+	return &info, nil
+}
+
+// BeginPasskeyLogin starts a login with an authenticator
+// username: the user who already gave their password, empty for a passwordless login
+// remember: create a remember-me session once the login completes
+// Returns the ceremony id and the options for navigator.credentials.get
+func BeginPasskeyLogin(r *http.Request, username string, remember bool) (string, *protocol.CredentialAssertion, error) {
+	rp, err := relyingParty(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if username == "" {
+		// Without a password the authenticator must verify the user itself
+		assertion, session, err = rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	} else {
+		user, exists := Passkeys.users[username]
+		if !exists || len(user.Passkeys) == 0 {
+			return "", nil, fmt.Errorf("no passkeys registered")
+		}
+		assertion, session, err = rp.BeginLogin(user)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start login: %w", err)
+	}
+
+	id, err := Passkeys.begin(ceremony{session: *session, username: username, remember: remember})
+	if err != nil {
+		return "", nil, err
+	}
+	return id, assertion, nil
+}
+
+// FinishPasskeyLogin verifies the browser's answer to a login challenge
+// The account is looked up again, a passkey must not outlive the user's removal or their allowed groups
+// r: the request carrying the assertion response as its body
+// Returns the username and whether the user asked to be remembered
+func FinishPasskeyLogin(r *http.Request, id string) (string, bool, error) {
+	username, remember, err := verifyPasskeyLogin(r, id)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := LookupUser(username); err != nil {
+		return "", false, fmt.Errorf("account %s may no longer log in", username)
+	}
+	return username, remember, nil
+}
+
+// verifyPasskeyLogin checks the assertion against the stored authenticators and updates their counters
+func verifyPasskeyLogin(r *http.Request, id string) (string, bool, error) {
+	rp, err := relyingParty(r)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	c, ok := Passkeys.finish(id)
+	if !ok || c.register {
+		return "", false, fmt.Errorf("unknown or expired login, please try again")
+	}
+
+	var user *passkeyUser
+	var credential *webauthn.Credential
+	if c.username != "" {
+		user = Passkeys.users[c.username]
+		if user == nil {
+			return "", false, fmt.Errorf("no passkeys registered")
+		}
+		credential, err = rp.FinishLogin(user, c.session, r)
+	} else {
+		var found webauthn.User
+		found, credential, err = rp.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			for _, u := range Passkeys.users {
+				if bytes.Equal(u.Handle, userHandle) {
+					return u, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown user handle")
+		}, c.session, r)
+		if err == nil {
+			user = found.(*passkeyUser)
+		}
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to verify authenticator: %w", err)
+	}
+	if credential.Authenticator.CloneWarning {
+		return "", false, fmt.Errorf("authenticator signature counter went backwards, it may have been cloned")
+	}
+
+	for _, p := range user.Passkeys {
+		if bytes.Equal(p.Credential.ID, credential.ID) {
+			p.Credential.Authenticator = credential.Authenticator
+			p.Credential.Flags = credential.Flags
+			p.LastUsedAt = time.Now()
+		}
+	}
+	// The signature counter is best effort, a failed write must not reject the login
+	Passkeys.save()
+
+	return user.name, c.remember, nil
+}
+
+// PasskeyRequired reports whether a password login of the user must be followed by an authenticator
+func PasskeyRequired(username string) bool {
+	if !conf.GetWebAuthn().SecondFactor {
+		return false
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+	user, exists := Passkeys.users[username]
+	return exists && len(user.Passkeys) > 0
+}
+
+// info returns the listing view of a passkey
+func (p *Passkey) info() PasskeyInfo {
+	return PasskeyInfo{Id: p.Id, Name: p.Name, CreatedAt: p.CreatedAt, LastUsedAt: p.LastUsedAt}
+}
+
+// ListPasskeys returns the user's authenticators, oldest first
+func ListPasskeys(username string) []PasskeyInfo {
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	list := make([]PasskeyInfo, 0)
+	if user, exists := Passkeys.users[username]; exists {
+		for _, p := range user.Passkeys {
+			list = append(list, p.info())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// RenamePasskey changes the name of one of the user's authenticators
+func RenamePasskey(username string, id string, name string) error {
+	if name == "" {
+		return fmt.Errorf("passkey name is required")
+	}
+
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	if user, exists := Passkeys.users[username]; exists {
+		for _, p := range user.Passkeys {
+			if p.Id == id {
+				p.Name = name
+				return Passkeys.save()
+			}
+		}
+	}
+	return fmt.Errorf("passkey not found")
+}
+
+// DeletePasskey removes one of the user's authenticators
+func DeletePasskey(username string, id string) error {
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	if user, exists := Passkeys.users[username]; exists {
+		for i, p := range user.Passkeys {
+			if p.Id == id {
+				user.Passkeys = append(user.Passkeys[:i], user.Passkeys[i+1:]...)
+				if len(user.Passkeys) == 0 {
+					delete(Passkeys.users, username)
+				}
+				return Passkeys.save()
+			}
+		}
+	}
+	return fmt.Errorf("passkey not found")
+}
+
+// DeleteUserPasskeys removes every authenticator of a user
+func DeleteUserPasskeys(username string) error {
+	Passkeys.mu.Lock()
+	defer Passkeys.mu.Unlock()
+
+	if _, exists := Passkeys.users[username]; !exists {
+		return nil
+	}
+	delete(Passkeys.users, username)
+	return Passkeys.save()
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// panelOrigin is where the test requests come from, the relying party is taken from it
+const panelOrigin = "http://panel.example"
+
+// softAuthenticator is a passkey in memory, answering ceremonies the way a browser passes them on
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id}
+}
+
+// usePasskeys keeps passkeys in a temporary file and makes alice a local user
+func usePasskeys(t *testing.T) {
+	saved := conf.Conf
+	t.Cleanup(func() { conf.Conf = saved })
+	conf.Conf.Auth.Backends = []string{"local"}
+	conf.Conf.Auth.Users = map[string]string{"alice": "$2a$10$unused"}
+	conf.Conf.Auth.WebAuthn = conf.Defaults().Auth.WebAuthn
+	conf.Conf.Auth.WebAuthn.Path = filepath.Join(t.TempDir(), "webauthn.json")
+
+	Passkeys.mu.Lock()
+	savedUsers := Passkeys.users
+	Passkeys.users = make(map[string]*passkeyUser)
+	Passkeys.mu.Unlock()
+	t.Cleanup(func() {
+		Passkeys.mu.Lock()
+		Passkeys.users = savedUsers
+		Passkeys.mu.Unlock()
+	})
+}
+
+// ceremonyRequest is a request from the panel's origin carrying a browser's answer
+func ceremonyRequest(t *testing.T, body interface{}) *http.Request {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(http.MethodPost, panelOrigin+"/webauthn", bytes.NewReader(data))
+}
+
+// clientData returns the JSON a browser signs over for a ceremony
+func clientData(kind string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    panelOrigin,
+	})
+	return data
+}
+
+// authenticatorData encodes the relying party hash, the user present and verified flags and the counter
+func (self *softAuthenticator) authenticatorData(rpID string, attested []byte) []byte {
+	rpHash := sha256.Sum256([]byte(rpID))
+	flags := byte(0x01 | 0x04) // User present and verified
+	if attested != nil {
+		flags |= 0x40
+	}
+	self.counter++
+	data := append(rpHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, self.counter)
+	return append(data, attested...)
+}
+
+// register answers a registration challenge with a self-attested ES256 credential
+func (self *softAuthenticator) register(t *testing.T, username string) {
+	id, creation, err := BeginPasskeyRegistration(httptest.NewRequest(http.MethodPost, panelOrigin+"/webauthn", nil), username, "Test key")
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         1, // P-256
+		XCoord:        self.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        self.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // No AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(self.id)))
+	attested = append(append(attested, self.id...), publicKey...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Format    string                 `cbor:"fmt"`
+		Statement map[string]interface{} `cbor:"attStmt"`
+		AuthData  []byte                 `cbor:"authData"`
+	}{"none", map[string]interface{}{}, self.authenticatorData(creation.Response.RelyingParty.ID, attested)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	r := ceremonyRequest(t, map[string]interface{}{
+		"id":    encode(self.id),
+		"rawId": encode(self.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData("webauthn.create", creation.Response.Challenge)),
+			"attestationObject": encode(attestation),
+		},
+	})
+	if _, err := FinishPasskeyRegistration(r, id, username); err != nil {
+		t.Fatalf("FinishPasskeyRegistration: %v", err)
+	}
+}
+
+// login answers a login challenge, username is empty for a passwordless login
+func (self *softAuthenticator) login(t *testing.T, username string) (string, error) {
+	id, assertion, err := BeginPasskeyLogin(httptest.NewRequest(http.MethodPost, panelOrigin+"/webauthn", nil), username, false)
+	if err != nil {
+		return "", err
+	}
+
+	authData := self.authenticatorData(assertion.Response.RelyingPartyID, nil)
+	client := clientData("webauthn.get", assertion.Response.Challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, self.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A discoverable credential names its user by the handle given at registration
+	Passkeys.mu.Lock()
+	var handle []byte
+	for _, user := range Passkeys.users {
+		for _, passkey := range user.Passkeys {
+			if bytes.Equal(passkey.Credential.ID, self.id) {
+				handle = user.Handle
+			}
+		}
+	}
+	Passkeys.mu.Unlock()
+
+	encode := base64.RawURLEncoding.EncodeToString
+	r := ceremonyRequest(t, map[string]interface{}{
+		"id":    encode(self.id),
+		"rawId": encode(self.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(client),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(handle),
+		},
+	})
+	name, _, err := FinishPasskeyLogin(r, id)
+	return name, err
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	usePasskeys(t)
+	key := newSoftAuthenticator(t)
+	key.register(t, "alice")
+
+	if passkeys := ListPasskeys("alice"); len(passkeys) != 1 || passkeys[0].Name != "Test key" {
+		t.Fatalf("got passkeys %+v, want the registered one", passkeys)
+	}
+
+	username, err := key.login(t, "")
+	if err != nil || username != "alice" {
+		t.Fatalf("passwordless login: got %q %v, want alice", username, err)
+	}
+	username, err = key.login(t, "alice")
+	if err != nil || username != "alice" {
+		t.Fatalf("second factor login: got %q %v, want alice", username, err)
+	}
+
+	other := newSoftAuthenticator(t)
+	if _, err := other.login(t, ""); err == nil {
+		t.Error("an unregistered authenticator logged in")
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	usePasskeys(t)
+	conf.Conf.Auth.Users["bob"] = "$2a$10$unused"
+	newSoftAuthenticator(t).register(t, "alice")
+
+	if !PasskeyRequired("alice") {
+		t.Error("password login of a user with a passkey does not require it")
+	}
+	if PasskeyRequired("bob") {
+		t.Error("password login of a user without passkeys requires one")
+	}
+	if _, _, err := BeginPasskeyLogin(httptest.NewRequest(http.MethodPost, panelOrigin+"/webauthn", nil), "bob", false); err == nil {
+		t.Error("second factor login started for a user without passkeys")
+	}
+
+	conf.Conf.Auth.WebAuthn.SecondFactor = false
+	if PasskeyRequired("alice") {
+		t.Error("passkey required with SecondFactor disabled")
+	}
+}
+
+func TestPasskeyLoginRejectsRemovedUser(t *testing.T) {
+	usePasskeys(t)
+	key := newSoftAuthenticator(t)
+	key.register(t, "alice")
+
+	conf.Conf.Auth.Users = map[string]string{}
+	if username, err := key.login(t, ""); err == nil {
+		t.Errorf("removed user logged in as %q", username)
+	}
+}
+
+func TestPasskeyRegistrationNeedsPasswordBackend(t *testing.T) {
+	usePasskeys(t)
+
+	r := httptest.NewRequest(http.MethodPost, panelOrigin+"/webauthn", nil)
+	if _, _, err := BeginPasskeyRegistration(r, "oidc:alice", "Test key"); !errors.Is(err, perr.UserNotFound) {
+		t.Errorf("single sign-on user: got %v, want perr.UserNotFound", err)
+	}
+}
@@ -0,0 +1,545 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// yescrypt ($y$) is the default password hash of current Debian, Ubuntu and Fedora releases
+// This is a port of the yescrypt 1.1 reference implementation, limited to what crypt(3) hashes use:
+// the RW flavor with the standard pwxform settings, no ROM and no hash upgrades
+
+// yescrypt flags
+const (
+	yescryptRW      = 0x002
+	yescryptRounds6 = 0x004
+	yescryptGather4 = 0x010
+	yescryptSimple2 = 0x020
+	yescryptSbox12K = 0x080
+	yescryptPrehash = 0x10000000
+	yescryptFlavor  = yescryptRW | yescryptRounds6 | yescryptGather4 | yescryptSimple2 | yescryptSbox12K
+)
+
+// pwxform settings of the standard flavor
+const (
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	pwxWords  = pwxGather * pwxSimple * 2 // 32-bit words per pwxform block
+	sWidth    = 8
+	sBytes    = 3 * (1 << sWidth) * pwxSimple * 8
+	sWords    = sBytes / 4
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// itoa64 is the alphabet of crypt(3) hashes
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// yescryptParams are the cost settings encoded in a hash
+type yescryptParams struct {
+	flags uint32
+	N     uint64
+	r     uint32
+	p     uint32
+	t     uint32
+}
+
+// verifyYescrypt compares a password with a $y$ hash
+// Returns an error for hashes that are malformed or use features this port lacks
+func verifyYescrypt(hash string, password string) (bool, error) {
+	params, salt, expected, err := parseYescrypt(hash)
+	if err != nil {
+		return false, err
+	}
+
+	computed := yescryptKDF([]byte(password), salt, params)
+	return subtle.ConstantTimeCompare([]byte(encode64(computed)), []byte(expected)) == 1, nil
+}
+
+// parseYescrypt splits a $y$ hash into its parameters, the decoded salt and the encoded hash
+func parseYescrypt(hash string) (yescryptParams, []byte, string, error) {
+	var params yescryptParams
+	fail := func(reason string) (yescryptParams, []byte, string, error) {
+		return params, nil, "", fmt.Errorf("invalid yescrypt hash: %s", reason)
+	}
+
+	setting, ok := strings.CutPrefix(hash, "$y$")
+	if !ok {
+		return fail("missing $y$ prefix")
+	}
+	fields := strings.Split(setting, "$")
+	if len(fields) != 3 {
+		return fail("expected parameters, salt and hash")
+	}
+	encoded, saltText, expected := fields[0], fields[1], fields[2]
+
+	flavor, encoded, ok := decode64Uint32(encoded, 0)
+	if !ok || flavor < yescryptRW {
+		return fail("unsupported flavor")
+	}
+	params.flags = yescryptRW + (flavor-yescryptRW)<<2
+	if params.flags != yescryptFlavor {
+		return fail("unsupported flavor")
+	}
+	logN, encoded, ok := decode64Uint32(encoded, 1)
+	if !ok || logN > 63 {
+		return fail("bad N")
+	}
+	params.N = 1 << logN
+	if params.r, encoded, ok = decode64Uint32(encoded, 1); !ok {
+		return fail("bad r")
+	}
+	params.p = 1
+
+	// Optional parameters, a bit each in the first character
+	if encoded != "" {
+		var have uint32
+		if have, encoded, ok = decode64Uint32(encoded, 1); !ok {
+			return fail("bad parameters")
+		}
+		if have&1 != 0 {
+			if params.p, encoded, ok = decode64Uint32(encoded, 2); !ok {
+				return fail("bad p")
+			}
+		}
+		if have&2 != 0 {
+			if params.t, encoded, ok = decode64Uint32(encoded, 1); !ok {
+				return fail("bad t")
+			}
+		}
+		if have&^3 != 0 {
+			return fail("hash upgrades and ROMs are not supported")
+		}
+	}
+	if encoded != "" {
+		return fail("trailing parameters")
+	}
+	if params.r == 0 || params.p == 0 || params.N < 2 || uint64(params.r)*uint64(params.p) >= 1<<30 ||
+		params.N > 1<<32 || params.N/uint64(params.p) < 2 {
+		return fail("parameters out of range")
+	}
+
+	salt, ok := decode64(saltText)
+	if !ok || len(expected) != 43 {
+		return fail("bad salt or hash encoding")
+	}
+	return params, salt, expected, nil
+}
+
+// decode64Uint32 reads a variable length number, the first character tells how many follow
+func decode64Uint32(src string, min uint32) (uint32, string, bool) {
+	if src == "" {
+		return 0, src, false
+	}
+	c := uint32(strings.IndexByte(itoa64, src[0]))
+	if c > 63 {
+		return 0, src, false
+	}
+	src = src[1:]
+
+	value := min
+	start, end, chars, shift := uint32(0), uint32(47), 1, uint32(0)
+	for c > end {
+		value += (end + 1 - start) << shift
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		shift += 6
+	}
+	value += (c - start) << shift
+
+	for ; chars > 1; chars-- {
+		if src == "" {
+			return 0, src, false
+		}
+		c = uint32(strings.IndexByte(itoa64, src[0]))
+		if c > 63 {
+			return 0, src, false
+		}
+		src = src[1:]
+		shift -= 6
+		value += c << shift
+	}
+	return value, src, true
+}
+
+// decode64 decodes the little-endian base64 of yescrypt salts, unused bits must be zero
+func decode64(src string) ([]byte, bool) {
+	var dst []byte
+	for len(src) > 0 {
+		value, n := uint32(0), 0
+		for ; n < 4 && n < len(src); n++ {
+			c := strings.IndexByte(itoa64, src[n])
+			if c < 0 {
+				return nil, false
+			}
+			value |= uint32(c) << (6 * n)
+		}
+		src = src[n:]
+
+		bits := 6 * n
+		if bits < 12 {
+			return nil, false // Must hold at least one byte
+		}
+		for ; bits >= 8; bits -= 8 {
+			dst = append(dst, byte(value))
+			value >>= 8
+		}
+		if value != 0 {
+			return nil, false
+		}
+	}
+	return dst, true
+}
+
+// encode64 encodes a hash in the little-endian base64 of yescrypt
+func encode64(src []byte) string {
+	var dst strings.Builder
+	for i := 0; i < len(src); {
+		value, bits := uint32(0), 0
+		for ; bits < 24 && i < len(src); bits += 8 {
+			value |= uint32(src[i]) << bits
+			i++
+		}
+		for ; bits > 0; bits -= 6 {
+			dst.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	return dst.String()
+}
+
+// yescryptKDF derives the 32 byte hash of a password
+func yescryptKDF(password []byte, salt []byte, params yescryptParams) []byte {
+	// Large settings first hash the password with a 64 times smaller N, so the full run cannot be skipped
+	if params.p >= 1 && params.N/uint64(params.p) >= 0x100 && params.N/uint64(params.p)*uint64(params.r) >= 0x20000 {
+		prehash := params
+		prehash.flags |= yescryptPrehash
+		prehash.N >>= 6
+		prehash.t = 0
+		password = yescryptBody(password, salt, prehash)
+	}
+	return yescryptBody(password, salt, params)
+}
+
+// yescryptBody is one run of the yescrypt KDF
+func yescryptBody(password []byte, salt []byte, params yescryptParams) []byte {
+	r, N, p := params.r, params.N, params.p
+
+	key := []byte("yescrypt-prehash")
+	if params.flags&yescryptPrehash == 0 {
+		key = key[:8]
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(password)
+	passwd := mac.Sum(nil)
+
+	// 1: (B_0 ... B_{p-1}) <-- PBKDF2(P, S, 1, p * MFLen)
+	raw := pbkdf2.Key(passwd, salt, 1, int(128*r*p), sha256.New)
+	B := make([]uint32, 32*r*p)
+	for i := range B {
+		B[i] = binary.LittleEndian.Uint32(raw[4*i:])
+	}
+	copy(passwd, raw[:32])
+
+	V := make([]uint32, uint64(32*r)*N)
+	XY := make([]uint32, 64*r)
+	S := make([]uint32, sWords*p)
+	contexts := make([]pwxformCtx, p)
+	for i := range contexts {
+		contexts[i].S = S[i*sWords : (i+1)*sWords]
+	}
+	smix(B, r, N, p, params.t, params.flags, V, XY, contexts, passwd)
+
+	raw = make([]byte, 4*len(B))
+	for i, word := range B {
+		binary.LittleEndian.PutUint32(raw[4*i:], word)
+	}
+	dk := pbkdf2.Key(passwd, raw, 1, 32, sha256.New)
+	if params.flags&yescryptPrehash != 0 {
+		return dk
+	}
+
+	// The final steps match SCRAM: StoredKey = H(HMAC(dk, "Client Key"))
+	mac = hmac.New(sha256.New, dk)
+	mac.Write([]byte("Client Key"))
+	stored := sha256.Sum256(mac.Sum(nil))
+	return stored[:]
+}
+
+// pwxformCtx is the S-box state of one pwxform lane
+type pwxformCtx struct {
+	S          []uint32
+	S0, S1, S2 []uint32
+	w          uint32
+}
+
+// smix runs the memory-hard part over all p blocks
+func smix(B []uint32, r uint32, N uint64, p uint32, t uint32, flags uint32, V []uint32, XY []uint32, contexts []pwxformCtx, passwd []byte) {
+	s := uint64(32 * r)
+
+	Nchunk := N / uint64(p)
+	NloopAll := Nchunk
+	if t <= 1 {
+		if t != 0 {
+			NloopAll *= 2
+		}
+		NloopAll = (NloopAll + 2) / 3
+	} else {
+		NloopAll *= uint64(t) - 1
+	}
+	NloopRW := NloopAll / uint64(p)
+
+	Nchunk &^= 1
+	NloopAll = (NloopAll + 1) &^ 1
+	NloopRW = (NloopRW + 1) &^ 1
+
+	Vchunk := uint64(0)
+	for i := uint32(0); i < p; i, Vchunk = i+1, Vchunk+Nchunk {
+		Np := Nchunk
+		if i == p-1 {
+			Np = N - Vchunk
+		}
+		Bp := B[uint64(i)*s : uint64(i+1)*s]
+		Vp := V[Vchunk*s:]
+		ctx := &contexts[i]
+
+		// The S-boxes are filled from the block with plain scrypt
+		smix1(Bp, 1, sBytes/128, 0, ctx.S, XY, nil)
+		ctx.S2 = ctx.S
+		ctx.S1 = ctx.S[(1<<sWidth)*pwxSimple*2:]
+		ctx.S0 = ctx.S[(2<<sWidth)*pwxSimple*2:]
+		ctx.w = 0
+		if i == 0 {
+			key := make([]byte, 64)
+			for k, word := range Bp[s-16:] {
+				binary.LittleEndian.PutUint32(key[4*k:], word)
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write(passwd)
+			copy(passwd, mac.Sum(nil))
+		}
+
+		smix1(Bp, r, Np, flags, Vp, XY, ctx)
+		smix2(Bp, r, p2floor(Np), NloopRW, flags, Vp, XY, ctx)
+	}
+
+	for i := uint32(0); i < p; i++ {
+		Bp := B[uint64(i)*s : uint64(i+1)*s]
+		smix2(Bp, r, N, NloopAll-NloopRW, flags&^yescryptRW, V, XY, &contexts[i])
+	}
+}
+
+// smix1 fills V with N successive states of the block
+// Blocks are kept in the SIMD shuffled word order of the reference implementation while they are mixed
+func smix1(B []uint32, r uint32, N uint64, flags uint32, V []uint32, XY []uint32, ctx *pwxformCtx) {
+	s := uint64(32 * r)
+	X, Y := XY[:s], XY[s:2*s]
+
+	shuffle(X, B)
+	for i := uint64(0); i < N; i++ {
+		copy(V[i*s:(i+1)*s], X)
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(X, r), i)
+			xorBlock(X, V[j*s:(j+1)*s])
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+	unshuffle(B, X)
+}
+
+// smix2 mixes the block with Nloop pseudo-random states from V, writing them back in RW mode
+func smix2(B []uint32, r uint32, N uint64, Nloop uint64, flags uint32, V []uint32, XY []uint32, ctx *pwxformCtx) {
+	if Nloop == 0 {
+		return
+	}
+	s := uint64(32 * r)
+	X, Y := XY[:s], XY[s:2*s]
+
+	shuffle(X, B)
+	for i := uint64(0); i < Nloop; i++ {
+		j := integerify(X, r) & (N - 1)
+		xorBlock(X, V[j*s:(j+1)*s])
+		if flags&yescryptRW != 0 {
+			copy(V[j*s:(j+1)*s], X)
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+	unshuffle(B, X)
+}
+
+// shuffle copies B into X in SIMD word order
+func shuffle(X []uint32, B []uint32) {
+	for k := 0; k < len(X); k += 16 {
+		for i := 0; i < 16; i++ {
+			X[k+i] = B[k+i*5%16]
+		}
+	}
+}
+
+// unshuffle copies X back into B in natural word order
+func unshuffle(B []uint32, X []uint32) {
+	for k := 0; k < len(X); k += 16 {
+		for i := 0; i < 16; i++ {
+			B[k+i*5%16] = X[k+i]
+		}
+	}
+}
+
+// integerify reads the first 64 bits of the last 64 byte block, words 0 and 1 sit at 0 and 13 when shuffled
+func integerify(X []uint32, r uint32) uint64 {
+	last := X[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+// p2floor returns the largest power of two not above x
+func p2floor(x uint64) uint64 {
+	return 1 << (63 - bits.LeadingZeros64(x))
+}
+
+// wrap maps x into the i blocks written so far, favouring the most recent ones
+func wrap(x uint64, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+// xorBlock sets dst to dst xor src
+func xorBlock(dst []uint32, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// blockmixSalsa8 is the BlockMix of scrypt with Salsa20/8
+func blockmixSalsa8(B []uint32, Y []uint32, r uint32) {
+	var X [16]uint32
+	copy(X[:], B[(2*r-1)*16:])
+	for i := uint32(0); i < 2*r; i++ {
+		xorBlock(X[:], B[i*16:(i+1)*16])
+		salsa20(X[:], 8)
+		copy(Y[i*16:], X[:])
+	}
+	for i := uint32(0); i < r; i++ {
+		copy(B[i*16:(i+1)*16], Y[i*2*16:])
+		copy(B[(i+r)*16:(i+r+1)*16], Y[(i*2+1)*16:])
+	}
+}
+
+// blockmixPwxform is the BlockMix of yescrypt, pwxform over each 64 byte block and Salsa20/2 at the end
+func blockmixPwxform(B []uint32, ctx *pwxformCtx, r uint32) {
+	var X [pwxWords]uint32
+	r1 := 128 * r / (pwxWords * 4)
+
+	copy(X[:], B[(r1-1)*pwxWords:])
+	for i := uint32(0); i < r1; i++ {
+		if r1 > 1 {
+			xorBlock(X[:], B[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(X[:], ctx)
+		copy(B[i*pwxWords:], X[:])
+	}
+
+	i := (r1 - 1) * pwxWords * 4 / 64
+	salsa20(B[i*16:(i+1)*16], 2)
+	for i++; i < 2*r; i++ {
+		xorBlock(B[i*16:(i+1)*16], B[(i-1)*16:i*16])
+		salsa20(B[i*16:(i+1)*16], 2)
+	}
+}
+
+// pwxform runs the multiply and S-box lookups on one 64 byte block and rotates the S-boxes
+func pwxform(B []uint32, ctx *pwxformCtx) {
+	S0, S1, S2 := ctx.S0, ctx.S1, ctx.S2
+	w := ctx.w
+
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			lane := B[j*pwxSimple*2:]
+			p0 := S0[(lane[0]&sMask)/8*2:]
+			p1 := S1[(lane[1]&sMask)/8*2:]
+
+			for k := 0; k < pwxSimple; k++ {
+				s0 := uint64(p0[2*k+1])<<32 | uint64(p0[2*k])
+				s1 := uint64(p1[2*k+1])<<32 | uint64(p1[2*k])
+
+				x := uint64(lane[2*k+1]) * uint64(lane[2*k])
+				x += s0
+				x ^= s1
+				lane[2*k], lane[2*k+1] = uint32(x), uint32(x>>32)
+
+				if i != 0 && i != pwxRounds-1 {
+					S2[2*w], S2[2*w+1] = uint32(x), uint32(x>>32)
+					w++
+				}
+			}
+		}
+	}
+
+	ctx.S0, ctx.S1, ctx.S2 = S2, S0, S1
+	ctx.w = w & ((1<<sWidth)*pwxSimple - 1)
+}
+
+// salsa20 applies the Salsa20 core with the given rounds to a block in SIMD shuffled order
+func salsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = B[i]
+	}
+
+	for i := 0; i < rounds; i += 2 {
+		// Columns
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		// Rows
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+
+	for i := 0; i < 16; i++ {
+		B[i] += x[i*5%16]
+	}
+}
@@ -1,75 +1,179 @@
 package conf
 
 import (
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"io/fs"
+	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var (
-	Path string       // Config path
-	mu   sync.RWMutex // Protects access to Conf
-	Conf = Config{    // Default values
+	Path        string                         // Config path
+	mu          sync.RWMutex                   // Protects access to Conf
+	writeMu     sync.Mutex                     // Serializes writes of the config file, see Modify
+	Conf        = Defaults()                   // Current config
+	subscribers []func(old Config, new Config) // Called after every change, see Subscribe
+)
+
+// Defaults returns the built-in config values, every call returns fresh maps and slices
+func Defaults() Config {
+	return Config{
 		SSHConfigPath: "~/.ssh",
-		Auth:          Auth{},
+		Auth: Auth{
+			TokenPath:          "tokens.json",
+			SessionIdleTimeout: 2 * time.Hour,
+			SessionMaxAge:      7 * 24 * time.Hour,
+			RememberMeMaxAge:   30 * 24 * time.Hour,
+			RememberMeRotate:   24 * time.Hour,
+			Backends:           []string{"local"},
+			LDAP: LDAP{
+				Timeout:        10 * time.Second,
+				UserFilter:     "(uid=%s)",
+				UserPrefix:     "ldap:",
+				GroupFilter:    "(member=%s)",
+				GroupAttribute: "cn",
+				PoolSize:       4,
+			},
+			System: System{
+				ShadowPath: "/etc/shadow",
+				UserPrefix: "system:",
+			},
+			OIDC: OIDC{
+				Scopes:        []string{"profile", "email"},
+				UsernameClaim: "email",
+				UserPrefix:    "oidc:",
+				GroupsClaim:   "groups",
+			},
+			WebAuthn: WebAuthn{
+				Path:          "webauthn.json",
+				RPDisplayName: "MinimalPanel",
+				SecondFactor:  true,
+			},
+			ForwardAuth: ForwardAuth{
+				UserPrefix: "proxy:",
+			},
+		},
 		Web: Web{
-			RootPath: "web",
+			Listeners:       []Listener{{Network: "tcp", Address: ":8080"}},
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Terminal: Terminal{
+			TimeoutWarning:    time.Minute,
+			KeepaliveInterval: 30 * time.Second,
+			KeepaliveCountMax: 3,
+			ForwardEnv:        []string{"LANG", "LC_*"},
+		},
+		TLS: TLS{
+			CertPath:   "tls/cert.pem",
+			KeyPath:    "tls/key.pem",
+			HSTSMaxAge: 180 * 24 * time.Hour,
+			ACME: ACME{
+				CachePath: "acme",
+			},
+		},
+		History: History{
+			Path:  "config-history",
+			Limit: 100,
 		},
 	}
-)
+}
 
 // LoadConfig Set Path and load config into memory
+// A missing file leaves the defaults, it is only created once something is written
 // Run this at start
 func LoadConfig(path string) error {
 	Path = path
 	err := Update()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	log.Printf("Config file %s not found, using the defaults", path)
+	loaded, err := Parse(path, nil)
 	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.OpenFile(path, os.O_CREATE, 0644)
-			defer f.Close()
-			if err == nil {
-				return nil
-			}
-		}
-		return fmt.Errorf("failed to load config")
+		return err
 	}
+	mu.Lock()
+	Conf = loaded
+	mu.Unlock()
 	return nil
 }
 
-// Update reads the config file and loads it into the global Conf variable
+// Update reads and validates the config file, then swaps it in for the current config
+// An invalid file leaves the current config active, the error lists the problems by line
 func Update() (err error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if _, err = os.Stat(Path); os.IsNotExist(err) {
-		return fmt.Errorf("config file does not exist: %s", Path)
+	data, err := os.ReadFile(Path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
 	}
-	_, err = toml.DecodeFile(Path, &Conf)
+	loaded, err := Parse(Path, data)
 	if err != nil {
-		return fmt.Errorf("failed to update global config %w", err)
+		return err
 	}
+
+	mu.Lock()
+	old := Conf
+	Conf = loaded
+	mu.Unlock()
+
+	notify(old, loaded)
 	return nil
 }
 
-// Write saves the provided config to the TOML file at the global Path
-func Write(conf Config) (err error) {
-	mu.Lock()
-	defer mu.Unlock()
+// decodeError matches the errors of values with the wrong type, which carry their line and key only in the text
+var decodeError = regexp.MustCompile(`^toml: (?:line (\d+) )?\(last key "(.*)"\): (.*)$`)
 
-	f, err := os.Create(Path)
+// Parse decodes a config file over the defaults, applies the environment overrides and validates it
+// Unknown keys are rejected like invalid values, a misspelt setting would otherwise silently keep its default
+// param: name: file name used in error messages
+func Parse(name string, data []byte) (Config, error) {
+	loaded := Defaults()
+	meta, err := toml.Decode(string(data), &loaded)
 	if err != nil {
-		return fmt.Errorf("failed to create config file %w", err)
-	}
-	defer f.Close()
-	err = toml.NewEncoder(f).Encode(conf)
-	if err != nil {
-		return fmt.Errorf("failed to write config file %w", err)
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return Config{}, &Errors{Path: name, List: []Error{{
+				Line:    parseErr.Position.Line,
+				Key:     parseErr.LastKey,
+				Message: parseErr.Message,
+			}}}
+		}
+		if match := decodeError.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			return Config{}, &Errors{Path: name, List: []Error{{Line: line, Key: match[2], Message: match[3]}}}
+		}
+		return Config{}, &Errors{Path: name, List: []Error{{Message: err.Error()}}}
 	}
 
-	// Update global config after successful write
-	Conf = conf
-	return nil
+	problems := &Errors{Path: name}
+	unknown := make(map[string]bool)
+	for _, key := range meta.Undecoded() {
+		unknown[key.String()] = true
+		// Keys of an unknown table are not worth mentioning on their own
+		if len(key) > 1 && unknown[key[:len(key)-1].String()] {
+			continue
+		}
+		problems.add(key.String(), "unknown key")
+	}
+	overridden := applyEnv(&loaded, problems)
+	if err := Validate(loaded); err != nil {
+		var invalid *Errors
+		if !errors.As(err, &invalid) {
+			return Config{}, err
+		}
+		problems.List = append(problems.List, invalid.List...)
+	}
+	if len(problems.List) > 0 {
+		problems.locate(data, overridden)
+		return Config{}, problems
+	}
+	return loaded, nil
 }
 
 // Read returns a copy of the current configuration
@@ -81,14 +185,35 @@ func Read() Config {
 	conf := Config{
 		SSHConfigPath: Conf.SSHConfigPath,
 		Auth: Auth{
-			Users: make(map[string]string),
+			Users:              make(map[string]string),
+			TokenPath:          Conf.Auth.TokenPath,
+			SessionIdleTimeout: Conf.Auth.SessionIdleTimeout,
+			SessionMaxAge:      Conf.Auth.SessionMaxAge,
+			RememberMeMaxAge:   Conf.Auth.RememberMeMaxAge,
+			RememberMeRotate:   Conf.Auth.RememberMeRotate,
+			Backends:           append([]string(nil), Conf.Auth.Backends...),
+			LDAP:               copyLDAP(Conf.Auth.LDAP),
+			System:             copySystem(Conf.Auth.System),
+			OIDC:               copyOIDC(Conf.Auth.OIDC),
+			WebAuthn:           copyWebAuthn(Conf.Auth.WebAuthn),
+			ForwardAuth:        copyForwardAuth(Conf.Auth.ForwardAuth),
 		},
+		Web:      Conf.Web,
+		Terminal: Conf.Terminal,
+		Library:  copyLibrary(Conf.Library),
+		Access:   copyAccess(Conf.Access),
+		TLS:      copyTLS(Conf.TLS),
+		History:  Conf.History,
 	}
 
 	// Copy the users map
 	for k, v := range Conf.Auth.Users {
 		conf.Auth.Users[k] = v
 	}
+	conf.Auth.Admins = append([]string(nil), Conf.Auth.Admins...)
+	conf.Web.Listeners = append([]Listener(nil), Conf.Web.Listeners...)
+	conf.Web.AllowedOrigins = append([]string(nil), Conf.Web.AllowedOrigins...)
+	conf.Web.TrustedProxies = append([]string(nil), Conf.Web.TrustedProxies...)
 
 	return conf
 }
@@ -112,9 +237,197 @@ func GetUsers() map[string]string {
 	return users
 }
 
+// GetAdmins returns a copy of the admin usernames in a thread-safe manner
+func GetAdmins() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), Conf.Auth.Admins...)
+}
+
+// GetAuth returns the Auth config without users and admins in a thread-safe manner
+func GetAuth() Auth {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	auth := Conf.Auth
+	auth.Users = nil
+	auth.Admins = nil
+	auth.Backends = append([]string(nil), Conf.Auth.Backends...)
+	auth.LDAP = copyLDAP(Conf.Auth.LDAP)
+	auth.System = copySystem(Conf.Auth.System)
+	auth.OIDC = copyOIDC(Conf.Auth.OIDC)
+	auth.WebAuthn = copyWebAuthn(Conf.Auth.WebAuthn)
+	auth.ForwardAuth = copyForwardAuth(Conf.Auth.ForwardAuth)
+	return auth
+}
+
+// GetTokenPath returns the API token file path in a thread-safe manner
+func GetTokenPath() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Conf.Auth.TokenPath
+}
+
+// GetLDAP returns a copy of the directory config in a thread-safe manner
+func GetLDAP() LDAP {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyLDAP(Conf.Auth.LDAP)
+}
+
+// copyLDAP deep copies the directory config
+func copyLDAP(ldap LDAP) LDAP {
+	ldap.AllowedGroups = append([]string(nil), ldap.AllowedGroups...)
+	ldap.AdminGroups = append([]string(nil), ldap.AdminGroups...)
+	return ldap
+}
+
+// GetSystem returns a copy of the host account config in a thread-safe manner
+func GetSystem() System {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copySystem(Conf.Auth.System)
+}
+
+// copySystem deep copies the host account config
+func copySystem(system System) System {
+	system.AllowedGroups = append([]string(nil), system.AllowedGroups...)
+	system.AdminGroups = append([]string(nil), system.AdminGroups...)
+	return system
+}
+
+// GetOIDC returns a copy of the single sign-on config in a thread-safe manner
+func GetOIDC() OIDC {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyOIDC(Conf.Auth.OIDC)
+}
+
+// copyOIDC deep copies the single sign-on config
+func copyOIDC(oidc OIDC) OIDC {
+	oidc.Scopes = append([]string(nil), oidc.Scopes...)
+	oidc.AllowedGroups = append([]string(nil), oidc.AllowedGroups...)
+	oidc.AdminGroups = append([]string(nil), oidc.AdminGroups...)
+	return oidc
+}
+
+// GetWebAuthn returns a copy of the passkey config in a thread-safe manner
+func GetWebAuthn() WebAuthn {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyWebAuthn(Conf.Auth.WebAuthn)
+}
+
+// copyWebAuthn deep copies the passkey config
+func copyWebAuthn(webAuthn WebAuthn) WebAuthn {
+	webAuthn.RPOrigins = append([]string(nil), webAuthn.RPOrigins...)
+	return webAuthn
+}
+
+// GetForwardAuth returns a copy of the reverse proxy authentication config in a thread-safe manner
+func GetForwardAuth() ForwardAuth {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyForwardAuth(Conf.Auth.ForwardAuth)
+}
+
+// copyForwardAuth deep copies the reverse proxy authentication config
+func copyForwardAuth(forwardAuth ForwardAuth) ForwardAuth {
+	forwardAuth.AdminGroups = append([]string(nil), forwardAuth.AdminGroups...)
+	userMap := make(map[string]string, len(forwardAuth.UserMap))
+	for forwarded, username := range forwardAuth.UserMap {
+		userMap[forwarded] = username
+	}
+	forwardAuth.UserMap = userMap
+	return forwardAuth
+}
+
 // GetWeb returns the Web config in a thread-safe manner
 func GetWeb() Web {
 	mu.RLock()
 	defer mu.RUnlock()
-	return Conf.Web
+
+	web := Conf.Web
+	web.Listeners = append([]Listener(nil), Conf.Web.Listeners...)
+	web.AllowedOrigins = append([]string(nil), Conf.Web.AllowedOrigins...)
+	web.TrustedProxies = append([]string(nil), Conf.Web.TrustedProxies...)
+	return web
+}
+
+// GetTerminal returns the Terminal config in a thread-safe manner
+func GetTerminal() Terminal {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Conf.Terminal
+}
+
+// GetLibrary returns a copy of the snippet library in a thread-safe manner
+func GetLibrary() Library {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyLibrary(Conf.Library)
+}
+
+// copyLibrary deep copies the snippet library, never returning nil maps
+func copyLibrary(lib Library) Library {
+	copied := Library{
+		Snippets:     make(map[string]string),
+		UserSnippets: make(map[string]map[string]string),
+		HostStartup:  make(map[string][]string),
+		HostGroups:   make(map[string][]string),
+	}
+	for k, v := range lib.Snippets {
+		copied.Snippets[k] = v
+	}
+	for user, snippets := range lib.UserSnippets {
+		copied.UserSnippets[user] = make(map[string]string)
+		for k, v := range snippets {
+			copied.UserSnippets[user][k] = v
+		}
+	}
+	for host, commands := range lib.HostStartup {
+		copied.HostStartup[host] = append([]string(nil), commands...)
+	}
+	for group, hosts := range lib.HostGroups {
+		copied.HostGroups[group] = append([]string(nil), hosts...)
+	}
+	return copied
+}
+
+// GetAccess returns a copy of the address policy in a thread-safe manner
+func GetAccess() Access {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyAccess(Conf.Access)
+}
+
+// copyAccess deep copies the address policy
+func copyAccess(access Access) Access {
+	copied := Access{
+		AllowCIDRs:     append([]string(nil), access.AllowCIDRs...),
+		DenyCIDRs:      append([]string(nil), access.DenyCIDRs...),
+		UserAllowCIDRs: make(map[string][]string),
+		UserDenyCIDRs:  make(map[string][]string),
+	}
+	for user, cidrs := range access.UserAllowCIDRs {
+		copied.UserAllowCIDRs[user] = append([]string(nil), cidrs...)
+	}
+	for user, cidrs := range access.UserDenyCIDRs {
+		copied.UserDenyCIDRs[user] = append([]string(nil), cidrs...)
+	}
+	return copied
+}
+
+// GetTLS returns a copy of the HTTPS config in a thread-safe manner
+func GetTLS() TLS {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyTLS(Conf.TLS)
+}
+
+// copyTLS deep copies the HTTPS config
+func copyTLS(tls TLS) TLS {
+	tls.Hosts = append([]string(nil), tls.Hosts...)
+	tls.ACME.Domains = append([]string(nil), tls.ACME.Domains...)
+	return tls
 }
@@ -0,0 +1,233 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfig loads content as the config file from a temporary directory, with the history kept next to it
+// Empty content leaves the file missing
+func useConfig(t *testing.T, content string) string {
+	savedConf, savedPath := Conf, Path
+	t.Cleanup(func() { Conf, Path = savedConf, savedPath })
+
+	dir := t.TempDir()
+	// Set from the environment, so reloads keep it
+	t.Setenv("MINIMALPANEL_HISTORY_PATH", filepath.Join(dir, "history"))
+	path := filepath.Join(dir, "config.toml")
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return path
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []string // Lines of the error
+	}{
+		{
+			name: "syntax error",
+			file: "SSHConfigPath = \"~/.ssh\"\nAdmins = [\"alice\"\n",
+			want: []string{"config.toml:2: Admins: expected a comma"},
+		},
+		{
+			name: "wrong type",
+			file: "\nMaxUserSessions = \"many\"\n",
+			want: []string{"config.toml:2: MaxUserSessions: incompatible types"},
+		},
+		{
+			name: "invalid value",
+			file: "# Sessions\n\nSessionIdleTimeout = \"0s\"\n",
+			want: []string{"config.toml:3: SessionIdleTimeout: must be greater than zero"},
+		},
+		{
+			name: "invalid array table value",
+			file: "[[Listeners]]\nAddress = \":8080\"\n\n[[Listeners]]\nNetwork = \"tcp\"\nAddress = \"8081\"\n",
+			want: []string{`config.toml:6: Listeners[1].Address: "8081" is not a host:port address`},
+		},
+		{
+			name: "missing key reported at its table",
+			file: "Backends = [\"ldap\"]\n\n[LDAP]\nURL = \"ldap://directory.example\"\n",
+			want: []string{"config.toml:3: LDAP.UserBaseDN: required when the ldap backend is enabled"},
+		},
+		{
+			name: "every problem",
+			file: "MaxUserSessions = -1\nReconnectAttempts = -2\n",
+			want: []string{
+				"config.toml:1: MaxUserSessions: must not be negative",
+				"config.toml:2: ReconnectAttempts: must not be negative",
+			},
+		},
+		{
+			name: "unknown key",
+			file: "SSHConfigPath = \"~/.ssh\"\nSessionIdelTimeout = \"1h\"\n",
+			want: []string{"config.toml:2: SessionIdelTimeout: unknown key"},
+		},
+		{
+			name: "unknown key in a table",
+			file: "[TLS]\nEnabled = false\nEnable = true\n",
+			want: []string{"config.toml:3: TLS.Enable: unknown key"},
+		},
+		{
+			name: "unknown table",
+			file: "[Metrics]\nEnabled = true\nPath = \"/metrics\"\n",
+			want: []string{"config.toml:1: Metrics: unknown key"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse("config.toml", []byte(test.file))
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(test.want) {
+				t.Fatalf("got %q, want %d problems", err, len(test.want))
+			}
+			for i, want := range test.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("got %q, want it to start with %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDefaultFile(t *testing.T) {
+	loaded, err := Parse("config.toml", DefaultFile())
+	if err != nil {
+		t.Fatalf("default file does not parse: %v", err)
+	}
+	defaults := settingsOf(Defaults())
+	for i, s := range settingsOf(loaded) {
+		if !sameValue(s.value, defaults[i].value) {
+			t.Errorf("%s: got %v, want the default %v", s.key(), s.value, defaults[i].value)
+		}
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	useConfig(t, "")
+
+	want := Defaults()
+	want.History.Path = Conf.History.Path
+	if !reflect.DeepEqual(Conf, want) {
+		t.Errorf("got %+v, want the defaults", Conf)
+	}
+	if _, err := os.Stat(Path); !os.IsNotExist(err) {
+		t.Error("loading created the config file")
+	}
+}
+
+func TestUpdateKeepsConfigOnError(t *testing.T) {
+	path := useConfig(t, "MaxUserSessions = 2\n")
+
+	if err := os.WriteFile(path, []byte("MaxUserSessions = -1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(); err == nil {
+		t.Fatal("invalid file was accepted")
+	}
+	if Conf.Terminal.MaxUserSessions != 2 {
+		t.Errorf("got MaxUserSessions %d, want the old 2", Conf.Terminal.MaxUserSessions)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "bind-password")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		check func(c Config) bool
+		err   string // Start of the error, empty if the config is valid
+	}{
+		{
+			name:  "duration",
+			env:   map[string]string{"MINIMALPANEL_SESSION_IDLE_TIMEOUT": "30m"},
+			check: func(c Config) bool { return c.Auth.SessionIdleTimeout == 30*time.Minute },
+		},
+		{
+			name:  "wins over the file",
+			file:  "[TLS]\nHSTSMaxAge = \"1h\"\n",
+			env:   map[string]string{"MINIMALPANEL_TLS_HSTS_MAX_AGE": "0s"},
+			check: func(c Config) bool { return c.TLS.HSTSMaxAge == 0 },
+		},
+		{
+			name:  "comma separated list",
+			env:   map[string]string{"MINIMALPANEL_ADMINS": "alice, bob,"},
+			check: func(c Config) bool { return reflect.DeepEqual(c.Auth.Admins, []string{"alice", "bob"}) },
+		},
+		{
+			name: "inline table",
+			env:  map[string]string{"MINIMALPANEL_SNIPPETS": `{ uptime = "uptime -p" }`},
+			check: func(c Config) bool {
+				return reflect.DeepEqual(c.Library.Snippets, map[string]string{"uptime": "uptime -p"})
+			},
+		},
+		{
+			name:  "secret from a file",
+			env:   map[string]string{"MINIMALPANEL_LDAP_BIND_PASSWORD_FILE": secretFile},
+			check: func(c Config) bool { return c.Auth.LDAP.BindPassword == "s3cret" },
+		},
+		{
+			name: "value and file",
+			env: map[string]string{
+				"MINIMALPANEL_LDAP_BIND_PASSWORD":      "other",
+				"MINIMALPANEL_LDAP_BIND_PASSWORD_FILE": secretFile,
+			},
+			err: "config.toml: LDAP.BindPassword: MINIMALPANEL_LDAP_BIND_PASSWORD and MINIMALPANEL_LDAP_BIND_PASSWORD_FILE are both set",
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"MINIMALPANEL_LDAP_BIND_PASSWORD_FILE": secretFile + ".missing"},
+			err:  "config.toml: LDAP.BindPassword: MINIMALPANEL_LDAP_BIND_PASSWORD_FILE: ",
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"MINIMALPANEL_SESSION_IDLE_TIMEOUT": "forever"},
+			err:  `config.toml: SessionIdleTimeout: MINIMALPANEL_SESSION_IDLE_TIMEOUT: invalid duration "forever"`,
+		},
+		{
+			name: "invalid result",
+			file: "# Terminal\nMaxUserSessions = 2\n",
+			env:  map[string]string{"MINIMALPANEL_MAX_USER_SESSIONS": "-1"},
+			err:  "config.toml: MaxUserSessions: must not be negative (set by MINIMALPANEL_MAX_USER_SESSIONS)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			loaded, err := Parse("config.toml", []byte(test.file))
+			switch {
+			case test.err != "":
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+			case err != nil:
+				t.Errorf("got error %v", err)
+			case !test.check(loaded):
+				t.Errorf("override not applied, got %+v", loaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// bareKey matches keys TOML allows without quotes
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// entry is a table header or a key assignment in a TOML file
+type entry struct {
+	path    []string // Table of a header or full key of an assignment, array tables are indexed like Listeners[0]
+	table   []string // Table an assignment belongs to, nil at the top level
+	header  bool
+	start   int    // First line
+	end     int    // Line after the last one
+	comment string // Comment after the value on its last line
+}
+
+// scan finds the headers and assignments of a TOML file
+// The file is expected to be valid, so only quotes and brackets are tracked
+func scan(lines []string) []entry {
+	var entries []entry
+	var table []string
+	arrays := make(map[string]int)
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			array := strings.HasPrefix(line, "[[")
+			name := strings.TrimLeft(line, "[")
+			if end := indexUnquoted(name, ']'); end >= 0 {
+				name = name[:end]
+			}
+			table = splitKey(name)
+			if array && len(table) > 0 {
+				joined := strings.Join(table, ".")
+				table[len(table)-1] += fmt.Sprintf("[%d]", arrays[joined])
+				arrays[joined]++
+			}
+			entries = append(entries, entry{path: table, table: table, header: true, start: i, end: i + 1})
+			continue
+		}
+
+		equals := indexUnquoted(line, '=')
+		if equals < 0 {
+			continue
+		}
+		start := i
+		// Arrays, inline tables and multi-line strings may continue on the following lines
+		var value valueScanner
+		comment := value.feed(line[equals+1:])
+		for !value.done() && i+1 < len(lines) {
+			i++
+			comment = value.feed(lines[i])
+		}
+		path := append(append([]string(nil), table...), splitKey(line[:equals])...)
+		entries = append(entries, entry{path: path, table: table, start: start, end: i + 1, comment: comment})
+	}
+	return entries
+}
+
+// valueScanner follows a value over the lines it spans
+type valueScanner struct {
+	depth int    // Open brackets and braces
+	quote string // Delimiter of the open string
+}
+
+// feed scans one line of the value and returns the comment at its end
+func (self *valueScanner) feed(line string) string {
+	for i := 0; i < len(line); i++ {
+		if self.quote != "" {
+			if line[i] == '\\' && self.quote[0] == '"' {
+				i++
+			} else if strings.HasPrefix(line[i:], self.quote) {
+				i += len(self.quote) - 1
+				self.quote = ""
+			}
+			continue
+		}
+
+		switch line[i] {
+		case '"', '\'':
+			self.quote = line[i : i+1]
+			if strings.HasPrefix(line[i:], strings.Repeat(self.quote, 3)) {
+				self.quote = strings.Repeat(self.quote, 3)
+			}
+			i += len(self.quote) - 1
+		case '[', '{':
+			self.depth++
+		case ']', '}':
+			self.depth--
+		case '#':
+			return strings.TrimSpace(line[i:])
+		}
+	}
+	// Only multi-line strings continue on the next line
+	if len(self.quote) == 1 {
+		self.quote = ""
+	}
+	return ""
+}
+
+// done reports whether the value is complete
+func (self *valueScanner) done() bool {
+	return self.depth <= 0 && self.quote == ""
+}
+
+// indexUnquoted returns the index of the first c outside of quotes, or -1
+func indexUnquoted(s string, c byte) int {
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitKey splits a dotted TOML key into its unquoted parts
+func splitKey(key string) []string {
+	var parts []string
+	for {
+		dot := indexUnquoted(key, '.')
+		part := key
+		if dot >= 0 {
+			part = key[:dot]
+		}
+		part = strings.TrimSpace(part)
+		if unquoted, err := strconv.Unquote(part); err == nil && strings.HasPrefix(part, `"`) {
+			part = unquoted
+		} else {
+			part = strings.Trim(part, `'`)
+		}
+		parts = append(parts, part)
+		if dot < 0 {
+			return parts
+		}
+		key = key[dot+1:]
+	}
+}
+
+// joinKey writes key parts as a dotted TOML key, quoting where needed
+func joinKey(path []string) string {
+	parts := make([]string, len(path))
+	for i, part := range path {
+		if bareKey.MatchString(part) {
+			parts[i] = part
+		} else {
+			parts[i] = strconv.Quote(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// samePath reports whether two keys are equal
+func samePath(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// withinPath reports whether key is prefix or below it, ignoring array table indexes of key
+func withinPath(key []string, prefix []string) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		part := key[i]
+		if index := strings.LastIndex(part, "["); index > 0 && strings.HasSuffix(part, "]") && part[:index] == prefix[i] {
+			part = part[:index]
+		}
+		if part != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setKey replaces the value of a key where it is set, or adds it to the end of its table
+// param: value: TOML encoded value
+func setKey(lines []string, path []string, value string) []string {
+	entries := scan(lines)
+	for _, e := range entries {
+		if e.header || !samePath(e.path, path) {
+			continue
+		}
+		line := lines[e.start]
+		replaced := strings.TrimRight(line[:indexUnquoted(line, '=')], " \t") + " = " + value
+		if e.comment != "" {
+			replaced += " " + e.comment
+		}
+		return splice(lines, e.start, e.end, replaced)
+	}
+
+	table, name := path[:len(path)-1], path[len(path)-1]
+	at, indent, found := -1, "", false
+	for _, e := range entries {
+		if !samePath(e.table, table) {
+			continue
+		}
+		found = true
+		at = e.end
+		if !e.header {
+			indent = lines[e.start][:len(lines[e.start])-len(strings.TrimLeft(lines[e.start], " \t"))]
+		}
+	}
+	assignment := indent + joinKey([]string{name}) + " = " + value
+
+	switch {
+	case found:
+		return splice(lines, at, at, assignment)
+	case len(table) == 0:
+		// Top level keys have to come before the first table, and the comments above it
+		at = len(lines)
+		for _, e := range entries {
+			if e.header {
+				at = e.start
+				for at > 0 && strings.HasPrefix(strings.TrimSpace(lines[at-1]), "#") {
+					at--
+				}
+				break
+			}
+		}
+		if at < len(lines) && strings.TrimSpace(lines[at]) != "" {
+			return splice(lines, at, at, assignment, "")
+		}
+		return splice(lines, at, at, assignment)
+	default:
+		return appendLines(lines, "["+joinKey(table)+"]", assignment)
+	}
+}
+
+// deleteKey removes the assignment of a key
+func deleteKey(lines []string, path []string) []string {
+	for _, e := range scan(lines) {
+		if !e.header && samePath(e.path, path) {
+			return splice(lines, e.start, e.end)
+		}
+	}
+	return lines
+}
+
+// deleteTable removes a table with its subtables and every assignment to it
+func deleteTable(lines []string, path []string) []string {
+	entries := scan(lines)
+	// From the end, so the earlier line numbers stay valid
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !withinPath(e.path, path) {
+			continue
+		}
+		if !e.header {
+			if !withinPath(e.table, path) {
+				lines = splice(lines, e.start, e.end)
+			}
+			continue
+		}
+
+		end := len(lines)
+		for _, next := range entries[i+1:] {
+			if next.header {
+				end = next.start
+				break
+			}
+		}
+		// Comments right above the next table belong to it
+		for end > e.end && !isBody(lines[end-1]) {
+			end--
+		}
+		lines = splice(lines, e.start, end)
+	}
+	return lines
+}
+
+// isBody reports whether a line holds more than a comment
+func isBody(line string) bool {
+	line = strings.TrimSpace(line)
+	return line != "" && line[0] != '#'
+}
+
+// appendLines adds lines at the end of the file, after an empty line
+func appendLines(lines []string, added ...string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 {
+		lines = append(lines, "")
+	}
+	return append(lines, added...)
+}
+
+// splice replaces lines[start:end] with the given lines
+func splice(lines []string, start int, end int, replacement ...string) []string {
+	result := make([]string, 0, len(lines)-(end-start)+len(replacement))
+	result = append(result, lines[:start]...)
+	result = append(result, replacement...)
+	return append(result, lines[end:]...)
+}
@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyEnv overrides settings from MINIMALPANEL_* variables, or from the files named by MINIMALPANEL_*_FILE
+// Returns the overridden keys with the variable that set them, including those with invalid values
+func applyEnv(c *Config, problems *Errors) map[string]string {
+	overridden := make(map[string]string)
+	walk(reflect.ValueOf(c).Elem(), nil, func(s setting) {
+		if s.section {
+			return
+		}
+		name := envName(s.path)
+		raw, found := os.LookupEnv(name)
+		if path, ok := os.LookupEnv(name + "_FILE"); ok {
+			overridden[s.key()] = name + "_FILE"
+			if found {
+				problems.add(s.key(), "%s and %s_FILE are both set", name, name)
+				return
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				problems.add(s.key(), "%s_FILE: %v", name, err)
+				return
+			}
+			// Secret files usually end with a newline that is not part of the secret
+			raw, found, name = strings.TrimRight(string(data), "\r\n"), true, name+"_FILE"
+		}
+		if !found {
+			return
+		}
+
+		overridden[s.key()] = name
+		if err := parseEnv(s.value, raw); err != nil {
+			problems.add(s.key(), "%s: %v", name, err)
+		}
+	})
+	return overridden
+}
+
+// parseEnv sets a setting from the text of an environment variable
+// Lists of strings are comma separated, tables and other lists are written as inline TOML
+func parseEnv(value reflect.Value, raw string) error {
+	switch {
+	case value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use a value such as 30s or 2h", raw)
+		}
+		value.SetInt(int64(d))
+	case value.Kind() == reflect.String:
+		value.SetString(raw)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, use true or false", raw)
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetInt(int64(n))
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "["):
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		// Decoded as the value of a one-field document, so any TOML value works
+		document := reflect.New(reflect.StructOf([]reflect.StructField{{
+			Name: "Value",
+			Type: value.Type(),
+			Tag:  `toml:"value"`,
+		}}))
+		if _, err := toml.Decode("value = "+raw, document.Interface()); err != nil {
+			return fmt.Errorf("invalid TOML value: %w", err)
+		}
+		value.Set(document.Elem().Field(0))
+	}
+	return nil
+}
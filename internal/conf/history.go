@@ -0,0 +1,362 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	perr "minimalpanel/internal/error"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change describes a write of the config file for its history
+type Change struct {
+	Author string `json:"author"` // Panel user or "name (command line)", empty for edits outside the panel
+	Reason string `json:"reason"`
+}
+
+// Version is a recorded state of the config file
+type Version struct {
+	Number int       `json:"version"`
+	Time   time.Time `json:"time"`
+	Change
+}
+
+// diffContext is the number of unchanged lines shown around changes
+const diffContext = 3
+
+// Versions lists the recorded versions of the config file, newest first
+func Versions() ([]Version, error) {
+	mu.RLock()
+	settings := Conf.History
+	mu.RUnlock()
+	return listVersions(settings.Path)
+}
+
+// ReadVersion returns the config file as it was at a version
+func ReadVersion(number int) ([]byte, error) {
+	mu.RLock()
+	settings := Conf.History
+	mu.RUnlock()
+
+	if settings.Path == "" {
+		return nil, perr.VersionNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(settings.Path, strconv.Itoa(number)+".toml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, perr.VersionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config version: %w", err)
+	}
+	return data, nil
+}
+
+// Diff returns a unified diff between two versions of the config file, with secrets redacted
+func Diff(from int, to int) (string, error) {
+	before, err := ReadVersion(from)
+	if err != nil {
+		return "", err
+	}
+	after, err := ReadVersion(to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(redact(splitLines(before)), redact(splitLines(after)),
+		"version "+strconv.Itoa(from), "version "+strconv.Itoa(to)), nil
+}
+
+// redactKey fingerprints redacted values, it is random per process so fingerprints cannot be guessed offline
+var redactKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// secret reports whether the setting at path holds a password hash or secret
+func secret(path []string) bool {
+	switch {
+	case len(path) > 0 && path[0] == "Users":
+		return true
+	case len(path) == 2 && path[0] == "OIDC" && path[1] == "ClientSecret":
+		return true
+	case len(path) == 2 && path[0] == "LDAP" && path[1] == "BindPassword":
+		return true
+	}
+	return false
+}
+
+// redact replaces the values of secrets with a fingerprint, so a diff still shows that they changed
+// Further lines of a multi-line value are emptied to keep the line numbers
+func redact(lines []string) []string {
+	redacted := make([]string, len(lines))
+	copy(redacted, lines)
+	for _, e := range scan(lines) {
+		if e.header || !secret(e.path) {
+			continue
+		}
+		equals := indexUnquoted(lines[e.start], '=')
+		if equals < 0 {
+			continue
+		}
+		// The comment stays readable and out of the fingerprint
+		value := strings.TrimSpace(strings.Join(lines[e.start:e.end], "\n")[equals+1:])
+		value = strings.TrimSpace(strings.TrimSuffix(value, e.comment))
+		mac := hmac.New(sha256.New, redactKey)
+		mac.Write([]byte(value))
+		redacted[e.start] = lines[e.start][:equals+1] + ` "<redacted ` + hex.EncodeToString(mac.Sum(nil)[:4]) + `>"`
+		if e.comment != "" {
+			redacted[e.start] += " " + e.comment
+		}
+		for i := e.start + 1; i < e.end; i++ {
+			redacted[i] = ""
+		}
+	}
+	return redacted
+}
+
+// Rollback restores a version of the config file
+// It is validated like a file edited by hand, applied and recorded as a new version
+func Rollback(number int, change Change) error {
+	data, err := ReadVersion(number)
+	if err != nil {
+		return err
+	}
+	loaded, err := Parse(Path, data)
+	if err != nil {
+		return err
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	mu.Lock()
+	current, err := os.ReadFile(Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		mu.Unlock()
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := replaceFile(Path, data); err != nil {
+		mu.Unlock()
+		return err
+	}
+	record(Conf.History, current, data, change)
+
+	// Applied from what was written, nothing can fail once the file is replaced
+	old := Conf
+	Conf = loaded
+	mu.Unlock()
+
+	notify(old, loaded)
+	return nil
+}
+
+// record saves a write of the config file as a new version, the caller must hold the lock
+// A file changed outside the panel since the last version is recorded first, so every diff
+// shows only what one change did
+// Failures are logged, the write itself already succeeded
+func record(settings History, before []byte, after []byte, change Change) {
+	if settings.Path == "" {
+		return
+	}
+	if err := os.MkdirAll(settings.Path, 0700); err != nil {
+		log.Printf("Failed to record config version: %v", err)
+		return
+	}
+
+	versions, err := listVersions(settings.Path)
+	if err != nil {
+		log.Printf("Failed to record config version: %v", err)
+		return
+	}
+	next, recorded := 1, false
+	if len(versions) > 0 {
+		next = versions[0].Number + 1
+		latest, err := os.ReadFile(filepath.Join(settings.Path, strconv.Itoa(versions[0].Number)+".toml"))
+		recorded = err == nil && bytes.Equal(latest, before)
+	}
+	if !recorded && before != nil {
+		reason := "Changed outside the panel"
+		if next == 1 {
+			reason = "Before the first recorded change"
+		}
+		if err := saveVersion(settings.Path, Version{Number: next, Time: time.Now(), Change: Change{Reason: reason}}, before); err != nil {
+			log.Printf("Failed to record config version: %v", err)
+			return
+		}
+		next++
+	}
+
+	if err := saveVersion(settings.Path, Version{Number: next, Time: time.Now(), Change: change}, after); err != nil {
+		log.Printf("Failed to record config version: %v", err)
+		return
+	}
+	pruneVersions(settings)
+}
+
+// saveVersion writes the content and description of a version
+func saveVersion(dir string, version Version, content []byte) error {
+	name := filepath.Join(dir, strconv.Itoa(version.Number))
+	if err := os.WriteFile(name+".toml", content, 0600); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The description is written last, a version without one is not listed
+	return os.WriteFile(name+".json", data, 0600)
+}
+
+// listVersions reads the version descriptions in dir, newest first
+func listVersions(dir string) ([]Version, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config versions: %w", err)
+	}
+
+	versions := make([]Version, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config version: %w", err)
+		}
+		var version Version
+		if err := json.Unmarshal(data, &version); err != nil {
+			log.Printf("Ignoring invalid config version %s: %v", name, err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Number > versions[j].Number
+	})
+	return versions, nil
+}
+
+// pruneVersions removes the oldest versions beyond the limit
+func pruneVersions(settings History) {
+	if settings.Limit <= 0 {
+		return
+	}
+	versions, err := listVersions(settings.Path)
+	if err != nil || len(versions) <= settings.Limit {
+		return
+	}
+	for _, version := range versions[settings.Limit:] {
+		name := filepath.Join(settings.Path, strconv.Itoa(version.Number))
+		os.Remove(name + ".json")
+		os.Remove(name + ".toml")
+	}
+}
+
+// splitLines splits a file into lines without their line breaks
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// edit is one line of a diff, op is ' ' for kept, '-' for removed and '+' for added lines
+type edit struct {
+	op   byte
+	line string
+	a, b int // Position in the old and the new file
+}
+
+// unifiedDiff compares two files line by line in the unified format, "" if they are equal
+func unifiedDiff(a []string, b []string, nameA string, nameB string) string {
+	// Longest common subsequence, config files are small enough for the quadratic table
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change and every change close enough to share its hunk
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for k := first + 1; k < len(edits) && k-last <= 2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				last = k
+			}
+		}
+		from, to := max(first-diffContext, 0), min(last+diffContext+1, len(edits))
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		lengthA, lengthB := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				lengthA++
+			}
+			if e.op != '-' {
+				lengthB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[from].a, lengthA), hunkRange(edits[from].b, lengthB))
+		for _, e := range edits[from:to] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// hunkRange writes the start and length of a hunk, an empty range names the line before it
+func hunkRange(start int, length int) string {
+	if length == 0 {
+		return strconv.Itoa(start) + ",0"
+	}
+	return strconv.Itoa(start+1) + "," + strconv.Itoa(length)
+}
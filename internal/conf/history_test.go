@@ -0,0 +1,366 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	perr "minimalpanel/internal/error"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fingerprint matches the value redact puts in place of a secret
+var fingerprint = regexp.MustCompile(`<redacted [0-9a-f]{8}>`)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string // With fingerprints written as <redacted>
+	}{
+		{
+			name: "password hash with comment",
+			file: "[Users]\nalice = \"$2a$10$hash\" # First admin\n",
+			want: "[Users]\nalice = \"<redacted>\" # First admin\n",
+		},
+		{
+			name: "inline users table",
+			file: "Users = { alice = \"$2a$10$hash\" }\nAdmins = [\"alice\"]\n",
+			want: "Users = \"<redacted>\"\nAdmins = [\"alice\"]\n",
+		},
+		{
+			name: "client secret",
+			file: "[OIDC]\nClientID = \"panel\"\nClientSecret = \"s3cret\"\n",
+			want: "[OIDC]\nClientID = \"panel\"\nClientSecret = \"<redacted>\"\n",
+		},
+		{
+			name: "dotted key",
+			file: "OIDC.ClientSecret = \"s3cret\"\n",
+			want: "OIDC.ClientSecret = \"<redacted>\"\n",
+		},
+		{
+			name: "hash sign in the value",
+			file: "[LDAP]\nBindDN = \"cn=panel\"\nBindPassword = 'p#ss' # Service account\n",
+			want: "[LDAP]\nBindDN = \"cn=panel\"\nBindPassword = \"<redacted>\" # Service account\n",
+		},
+		{
+			name: "multi-line value keeps the line numbers",
+			file: "[LDAP]\nBindPassword = \"\"\"\nfirst\nsecond\"\"\" # Rotated yearly\nPoolSize = 2\n",
+			want: "[LDAP]\nBindPassword = \"<redacted>\" # Rotated yearly\n\n\nPoolSize = 2\n",
+		},
+		{
+			name: "same names elsewhere",
+			file: "[Snippets]\nUsers = \"who\"\nClientSecret = \"echo\"\n",
+			want: "[Snippets]\nUsers = \"who\"\nClientSecret = \"echo\"\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redacted := strings.Join(redact(splitLines([]byte(test.file))), "\n") + "\n"
+			if got := fingerprint.ReplaceAllString(redacted, "<redacted>"); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactFingerprints(t *testing.T) {
+	lines := redact([]string{
+		"[Users]",
+		`alice = "hash-a"`,
+		`bob = "hash-b"`,
+		`carol = "hash-a" # Same password as alice`,
+	})
+	alice, bob, carol := fingerprint.FindString(lines[1]), fingerprint.FindString(lines[2]), fingerprint.FindString(lines[3])
+	if alice == "" || alice != carol {
+		t.Errorf("equal values got fingerprints %q and %q, want the same", alice, carol)
+	}
+	if alice == bob {
+		t.Error("different values got the same fingerprint")
+	}
+}
+
+func TestDiffRedactsSecrets(t *testing.T) {
+	useConfig(t, "[Users]\nalice = \"hash-a\"\n")
+
+	err := Modify(Change{Author: "alice", Reason: "Reset password"}, func(c *Config) error {
+		c.Auth.Users["alice"] = "hash-b"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := Diff(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(diff, "hash-") {
+		t.Errorf("diff shows the password hash:\n%s", diff)
+	}
+	if !strings.Contains(diff, "-alice = \"<redacted") || !strings.Contains(diff, "+alice = \"<redacted") {
+		t.Errorf("diff does not show the changed secret:\n%s", diff)
+	}
+}
+
+// reasons lists the reasons of the recorded versions, oldest first
+func reasons(t *testing.T) []string {
+	versions, err := Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]string, len(versions))
+	for i, version := range versions {
+		list[len(versions)-1-i] = fmt.Sprintf("%d %s", version.Number, version.Reason)
+	}
+	return list
+}
+
+func TestRecordChangedOutside(t *testing.T) {
+	path := useConfig(t, "MaxUserSessions = 1\n")
+	setSessions := func(n int) {
+		t.Helper()
+		err := Modify(Change{Author: "alice", Reason: fmt.Sprintf("Allow %d sessions", n)}, func(c *Config) error {
+			c.Terminal.MaxUserSessions = n
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setSessions(2)
+	setSessions(3)
+	if err := os.WriteFile(path, []byte("# Edited by hand\nMaxUserSessions = 4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(); err != nil {
+		t.Fatal(err)
+	}
+	setSessions(5)
+
+	want := []string{
+		"1 Before the first recorded change",
+		"2 Allow 2 sessions",
+		"3 Allow 3 sessions",
+		"4 Changed outside the panel",
+		"5 Allow 5 sessions",
+	}
+	if got := reasons(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %q, want %q", got, want)
+	}
+	if data, _ := ReadVersion(4); string(data) != "# Edited by hand\nMaxUserSessions = 4\n" {
+		t.Errorf("got version 4 %q, want the file as edited by hand", data)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		limit int
+		want  []int
+	}{
+		{name: "no limit", count: 4, limit: 0, want: []int{4, 3, 2, 1}},
+		{name: "below the limit", count: 2, limit: 3, want: []int{2, 1}},
+		{name: "at the limit", count: 3, limit: 3, want: []int{3, 2, 1}},
+		{name: "oldest removed", count: 5, limit: 2, want: []int{5, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for n := 1; n <= test.count; n++ {
+				if err := saveVersion(dir, Version{Number: n}, []byte("content\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pruneVersions(History{Path: dir, Limit: test.limit})
+
+			versions, err := listVersions(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int, len(versions))
+			for i, version := range versions {
+				got[i] = version.Number
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got versions %v, want %v", got, test.want)
+			}
+			// Contents go with their descriptions
+			contents, _ := filepath.Glob(filepath.Join(dir, "*.toml"))
+			if len(contents) != len(test.want) {
+				t.Errorf("got %d version contents, want %d", len(contents), len(test.want))
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	path := useConfig(t, "# Sessions\nMaxUserSessions = 1\n")
+	err := Modify(Change{Author: "alice", Reason: "More sessions"}, func(c *Config) error {
+		c.Terminal.MaxUserSessions = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notified []string
+	saved := subscribers
+	t.Cleanup(func() { subscribers = saved })
+	Subscribe(func(old Config, new Config) {
+		notified = append(notified, fmt.Sprintf("%d -> %d", old.Terminal.MaxUserSessions, new.Terminal.MaxUserSessions))
+	})
+
+	if err := Rollback(1, Change{Author: "bob", Reason: "Undo"}); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "# Sessions\nMaxUserSessions = 1\n" {
+		t.Errorf("got file %q, want version 1", data)
+	}
+	if Conf.Terminal.MaxUserSessions != 1 {
+		t.Errorf("got MaxUserSessions %d, want 1 from version 1", Conf.Terminal.MaxUserSessions)
+	}
+	if len(notified) != 1 || notified[0] != "2 -> 1" {
+		t.Errorf("got notifications %q, want one for the rollback", notified)
+	}
+	versions, err := Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Number != 3 || versions[0].Author != "bob" || versions[0].Reason != "Undo" {
+		t.Errorf("got versions %+v, want the rollback recorded as version 3", versions)
+	}
+
+	if err := Rollback(7, Change{}); !errors.Is(err, perr.VersionNotFound) {
+		t.Errorf("got %v, want perr.VersionNotFound", err)
+	}
+}
+
+func TestRollbackRejectsInvalidVersion(t *testing.T) {
+	path := useConfig(t, "MaxUserSessions = 1\n")
+	if err := os.MkdirAll(Conf.History.Path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveVersion(Conf.History.Path, Version{Number: 1}, []byte("MaxUserSessions = -1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rollback(1, Change{}); err == nil {
+		t.Fatal("invalid version was rolled back to")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "MaxUserSessions = 1\n" {
+		t.Errorf("got file %q, want it untouched", data)
+	}
+	if versions, _ := Versions(); len(versions) != 1 {
+		t.Errorf("got %d versions, want the failed rollback unrecorded", len(versions))
+	}
+}
+
+// numbered returns the lines "line 1" to "line n" with the given lines replaced
+func numbered(n int, replaced map[int]string) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i+1)
+		if line, ok := replaced[i+1]; ok {
+			lines[i] = line
+		}
+	}
+	return lines
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []string
+		hunks []string // Hunk headers
+		body  string   // Lines of the only hunk, if there is one
+	}{
+		{
+			name: "equal",
+			a:    numbered(3, nil),
+			b:    numbered(3, nil),
+		},
+		{
+			name:  "from an empty file",
+			a:     nil,
+			b:     []string{"x"},
+			hunks: []string{"@@ -0,0 +1,1 @@"},
+			body:  "+x\n",
+		},
+		{
+			name:  "to an empty file",
+			a:     []string{"x", "y"},
+			b:     nil,
+			hunks: []string{"@@ -1,2 +0,0 @@"},
+			body:  "-x\n-y\n",
+		},
+		{
+			name:  "added at the start",
+			a:     []string{"x", "y"},
+			b:     []string{"n", "x", "y"},
+			hunks: []string{"@@ -1,2 +1,3 @@"},
+			body:  "+n\n x\n y\n",
+		},
+		{
+			name:  "context around a change",
+			a:     numbered(10, nil),
+			b:     numbered(10, map[int]string{5: "five"}),
+			hunks: []string{"@@ -2,7 +2,7 @@"},
+			body:  " line 2\n line 3\n line 4\n-line 5\n+five\n line 6\n line 7\n line 8\n",
+		},
+		{
+			name:  "removed at the end",
+			a:     numbered(6, nil),
+			b:     numbered(5, nil),
+			hunks: []string{"@@ -3,4 +3,3 @@"},
+			body:  " line 3\n line 4\n line 5\n-line 6\n",
+		},
+		{
+			name:  "close changes share a hunk",
+			a:     numbered(20, nil),
+			b:     numbered(20, map[int]string{3: "three", 8: "eight"}),
+			hunks: []string{"@@ -1,11 +1,11 @@"},
+		},
+		{
+			name:  "distant changes",
+			a:     numbered(20, nil),
+			b:     numbered(20, map[int]string{2: "two", 19: "nineteen"}),
+			hunks: []string{"@@ -1,5 +1,5 @@", "@@ -16,5 +16,5 @@"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := unifiedDiff(test.a, test.b, "version 1", "version 2")
+			if len(test.hunks) == 0 {
+				if diff != "" {
+					t.Errorf("got diff\n%s\nwant none", diff)
+				}
+				return
+			}
+			if !strings.HasPrefix(diff, "--- version 1\n+++ version 2\n") {
+				t.Fatalf("got diff without file names:\n%s", diff)
+			}
+			var hunks []string
+			for _, line := range strings.Split(diff, "\n") {
+				if strings.HasPrefix(line, "@@") {
+					hunks = append(hunks, line)
+				}
+			}
+			if !reflect.DeepEqual(hunks, test.hunks) {
+				t.Errorf("got hunks %q, want %q", hunks, test.hunks)
+			}
+			if test.body != "" {
+				if _, body, _ := strings.Cut(diff, test.hunks[0]+"\n"); body != test.body {
+					t.Errorf("got hunk\n%s\nwant\n%s", body, test.body)
+				}
+			}
+		})
+	}
+}
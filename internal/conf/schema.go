@@ -0,0 +1,317 @@
+package conf
+
+import (
+	"bytes"
+	_ "embed"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix starts the environment variables overriding settings
+const envPrefix = "MINIMALPANEL_"
+
+// typesSource is types.go, the comments on its fields are the documentation of the settings
+//
+//go:embed types.go
+var typesSource string
+
+// durationType is the type of duration settings, written as strings like "1h30m"
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Field describes one setting of the config file
+type Field struct {
+	Key         string // Dotted TOML key, e.g. "TLS.ACME.Domains"
+	Env         string // Environment variable overriding it, empty for sections
+	Type        string // "string", "bool", "int", "duration", "[]string", "section" and so on
+	Default     any    // nil for sections
+	Description string
+}
+
+// setting is a field of Config found by walk
+type setting struct {
+	path    []string
+	field   reflect.StructField
+	owner   reflect.Type // Struct declaring the field
+	value   reflect.Value
+	section bool // A struct written as its own table, its settings follow
+}
+
+// table reports whether the setting is written as a table of its own, like Users or Listeners
+func (self setting) table() bool {
+	kind := self.field.Type.Kind()
+	return self.section || kind == reflect.Map ||
+		(kind == reflect.Slice && self.field.Type.Elem().Kind() == reflect.Struct)
+}
+
+// key returns the dotted TOML key of the setting
+func (self setting) key() string {
+	return strings.Join(self.path, ".")
+}
+
+// fields returns the settings of the struct v in declaration order
+// Embedded structs share the table of their parent like TOML decodes them
+func fields(v reflect.Value, path []string) []setting {
+	var settings []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			settings = append(settings, fields(v.Field(i), path)...)
+			continue
+		}
+		settings = append(settings, setting{
+			path:    append(append([]string(nil), path...), field.Name),
+			field:   field,
+			owner:   t,
+			value:   v.Field(i),
+			section: field.Type.Kind() == reflect.Struct,
+		})
+	}
+	return settings
+}
+
+// walk calls f for every setting of the struct v, sections before their settings
+func walk(v reflect.Value, path []string, f func(setting)) {
+	for _, s := range fields(v, path) {
+		f(s)
+		if s.section {
+			walk(s.value, s.path, f)
+		}
+	}
+}
+
+// Schema lists every setting with its default, in the order of the config types
+func Schema() []Field {
+	defaults := Defaults()
+	var schema []Field
+	walk(reflect.ValueOf(defaults), nil, func(s setting) {
+		field := Field{Key: s.key(), Type: typeName(s.field.Type), Description: describe(s)}
+		if s.section {
+			field.Type = "section"
+		} else {
+			field.Env = envName(s.path)
+			field.Default = s.value.Interface()
+		}
+		schema = append(schema, field)
+	})
+	return schema
+}
+
+// typeName names a Go type as a config value type
+func typeName(t reflect.Type) string {
+	if t == durationType {
+		return "duration"
+	}
+	return strings.ReplaceAll(t.String(), "conf.", "")
+}
+
+// descriptions holds the field comments of types.go by "Type.Field"
+var descriptions struct {
+	once   sync.Once
+	fields map[string]string
+}
+
+// describe returns the comment of the setting's field in types.go
+func describe(s setting) string {
+	descriptions.once.Do(func() {
+		descriptions.fields = make(map[string]string)
+		file, err := parser.ParseFile(token.NewFileSet(), "types.go", typesSource, parser.ParseComments)
+		if err != nil {
+			return
+		}
+		ast.Inspect(file, func(node ast.Node) bool {
+			spec, ok := node.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			if structType, ok := spec.Type.(*ast.StructType); ok {
+				for _, field := range structType.Fields.List {
+					comment := field.Comment
+					if comment == nil {
+						comment = field.Doc
+					}
+					for _, name := range field.Names {
+						descriptions.fields[spec.Name.Name+"."+name.Name] = strings.Join(strings.Fields(comment.Text()), " ")
+					}
+				}
+			}
+			return false
+		})
+	})
+	return descriptions.fields[s.owner.Name()+"."+s.field.Name]
+}
+
+// envName returns the environment variable of a setting, e.g. MINIMALPANEL_TLS_ACME_HTTP_ADDRESS
+func envName(path []string) string {
+	words := make([]string, 0, len(path))
+	for _, part := range path {
+		words = append(words, splitWords(part)...)
+	}
+	return envPrefix + strings.ToUpper(strings.Join(words, "_"))
+}
+
+// splitWords splits a Go name into words, keeping abbreviations like CIDRs and HTTP together
+func splitWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		previous := runes[i-1]
+		// The plural s of an abbreviation does not start a word
+		nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1]) &&
+			!(runes[i+1] == 's' && (i+2 == len(runes) || unicode.IsUpper(runes[i+2])))
+		if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// encodeValue writes a value as TOML for the right side of an assignment
+func encodeValue(v reflect.Value) string {
+	switch {
+	case v.Type() == durationType:
+		return `"` + formatDuration(time.Duration(v.Int())) + `"`
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0:
+		if v.Kind() == reflect.Map {
+			return "{}"
+		}
+		return "[]"
+	}
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(map[string]any{"v": v.Interface()}); err != nil {
+		return `""`
+	}
+	return strings.TrimSpace(strings.TrimPrefix(buffer.String(), "v = "))
+}
+
+// formatDuration writes a duration without trailing zero units, e.g. 2h instead of 2h0m0s
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// encodeTable writes a table setting with its headers
+func encodeTable(path []string, v reflect.Value) []string {
+	var lines []string
+	switch {
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			lines = append(lines, "[["+joinKey(path)+"]]")
+			walk(v.Index(i), nil, func(s setting) {
+				lines = append(lines, joinKey(s.path)+" = "+encodeValue(s.value))
+			})
+		}
+	case v.Type().Elem().Kind() == reflect.Map:
+		for _, key := range sortedKeys(v) {
+			lines = append(lines, encodeTable(append(append([]string(nil), path...), key), v.MapIndex(reflect.ValueOf(key)))...)
+		}
+	default:
+		lines = append(lines, "["+joinKey(path)+"]")
+		for _, key := range sortedKeys(v) {
+			lines = append(lines, joinKey([]string{key})+" = "+encodeValue(v.MapIndex(reflect.ValueOf(key))))
+		}
+	}
+	return lines
+}
+
+// sortedKeys returns the keys of a map with string keys in order
+func sortedKeys(v reflect.Value) []string {
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DefaultFile returns a config file setting everything to its default, documented from the schema
+func DefaultFile() []byte {
+	lines := []string{
+		"# MinimalPanel configuration with every setting at its default",
+		"# Each setting can be overridden by the environment variable named after it, or read from",
+		"# the file named by that variable with _FILE appended, e.g. " + envPrefix + "LDAP_BIND_PASSWORD_FILE",
+	}
+	lines = append(lines, documentStruct(reflect.ValueOf(Defaults()), nil, true)...)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// documentStruct writes the settings of a struct, plain ones first as TOML requires, then its tables
+// param: overridable: name the environment variables, elements of Listeners are only overridden as a whole
+func documentStruct(v reflect.Value, path []string, overridable bool) []string {
+	var plain, tables []setting
+	for _, s := range fields(v, path) {
+		if s.table() {
+			tables = append(tables, s)
+		} else {
+			plain = append(plain, s)
+		}
+	}
+
+	var lines []string
+	document := func(s setting) {
+		env := ""
+		if overridable && !s.section {
+			env = envName(s.path)
+		}
+		lines = append(lines, "")
+		if text := comment(describe(s), env); text != "" {
+			lines = append(lines, text)
+		}
+	}
+
+	for _, s := range plain {
+		document(s)
+		lines = append(lines, joinKey(s.path[len(path):])+" = "+encodeValue(s.value))
+	}
+	for _, s := range tables {
+		document(s)
+		switch {
+		case s.section:
+			lines = append(lines, "["+joinKey(s.path)+"]")
+			lines = append(lines, documentStruct(s.value, s.path, overridable)...)
+		case s.value.Kind() == reflect.Slice:
+			for i := 0; i < s.value.Len(); i++ {
+				lines = append(lines, "[["+joinKey(s.path)+"]]")
+				lines = append(lines, documentStruct(s.value.Index(i), nil, false)...)
+			}
+		case s.value.Len() == 0:
+			lines = append(lines, "["+joinKey(s.path)+"]")
+		default:
+			lines = append(lines, encodeTable(s.path, s.value)...)
+		}
+	}
+	return lines
+}
+
+// comment writes a description and the variable overriding the setting as a TOML comment
+func comment(description string, env string) string {
+	switch {
+	case env == "" && description == "":
+		return ""
+	case env == "":
+		return "# " + description
+	case description == "":
+		return "# " + env
+	}
+	return "# " + description + " (" + env + ")"
+}
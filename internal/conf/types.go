@@ -1,15 +1,164 @@
 package conf
 
+import "time"
+
 type Config struct {
-	SSHConfigPath string
+	SSHConfigPath string // Directory holding the SSH client configuration
 	Auth
 	Web
+	Terminal
+	Library
+	Access
+	TLS     TLS     // HTTPS served by the panel itself
+	History History // Earlier versions of this file, kept whenever the panel writes it
 }
 
+// Auth configures how users log in
+// Names from LDAP, host accounts, single sign-on and reverse proxies get their source's UserPrefix, so they
+// cannot take over local users of the same name or their admin rights. Secrets such as LDAP.BindPassword and
+// OIDC.ClientSecret are best read from a file through their _FILE variable
 type Auth struct {
-	Users map[string]string
+	Users     map[string]string // bcrypt password hashes by username, managed with the user command
+	Admins    []string          // Usernames allowed to use administrative endpoints
+	TokenPath string            // JSON file holding API token hashes
+
+	SessionIdleTimeout time.Duration // Login sessions end after this long without activity, remember-me logins only by RememberMeMaxAge
+	SessionMaxAge      time.Duration // Login sessions end this long after login regardless of activity
+	RememberMeMaxAge   time.Duration // Lifetime of remember-me logins
+	RememberMeRotate   time.Duration // How often remember-me tokens are replaced
+
+	Backends []string // Password backends tried in order: "local" for Users, "ldap", "system"
+	LDAP     LDAP     // Directory used by the "ldap" backend
+	System   System   // Host accounts used by the "system" backend
+	OIDC     OIDC     // Single sign-on through an OpenID Connect provider
+	WebAuthn WebAuthn // Passkeys and security keys
+
+	ForwardAuth ForwardAuth // Users vouched for by an authenticating reverse proxy
+}
+
+type ForwardAuth struct {
+	Header       string            // Header naming the user, e.g. X-Forwarded-User, empty disables
+	UserPrefix   string            // Prepended to forwarded names
+	UserMap      map[string]string // Forwarded names to use as these panel users instead, without the prefix, e.g. to map onto a local user
+	GroupsHeader string            // Comma separated groups of the user, e.g. X-Forwarded-Groups
+	AdminGroups  []string          // Members become administrators
+}
+
+type LDAP struct {
+	URL                string        // ldap://host:389 or ldaps://host:636
+	StartTLS           bool          // Upgrade ldap:// connections with StartTLS
+	CACertPath         string        // PEM bundle to verify the server with instead of the system roots
+	InsecureSkipVerify bool          // Accept any server certificate, for testing only
+	Timeout            time.Duration // Limit for connecting and for each request
+
+	BindDN       string // Service account that searches for users, empty binds anonymously
+	BindPassword string // Password of BindDN
+	UserBaseDN   string // Where to search for users
+	UserFilter   string // %s is the escaped username, e.g. (uid=%s) or (sAMAccountName=%s)
+	UserPrefix   string // Prepended to directory usernames
+
+	GroupBaseDN    string   // Where to look for the user's groups, empty skips group lookup
+	GroupFilter    string   // %s is the escaped user DN, e.g. (member=%s)
+	GroupAttribute string   // Attribute holding the group name matched below
+	AllowedGroups  []string // Only members may log in, empty allows everyone
+	AdminGroups    []string // Members become administrators
+
+	PoolSize int // Idle connections kept open
+}
+
+type System struct {
+	ShadowPath    string   // Shadow password file, the panel must be able to read it
+	UserPrefix    string   // Prepended to account names
+	AllowedGroups []string // Required, only members may log in, e.g. sudo or wheel
+	AdminGroups   []string // Members become administrators
+}
+
+type OIDC struct {
+	Issuer        string   // Provider URL, empty disables single sign-on
+	ClientID      string   // Client registered with the provider
+	ClientSecret  string   // Secret issued with ClientID
+	RedirectURL   string   // Public URL of /oidc/callback, registered with the provider
+	Scopes        []string // Requested in addition to openid
+	UsernameClaim string   // ID token claim used as the panel username
+	UserPrefix    string   // Prepended to the claim
+	GroupsClaim   string   // ID token claim listing the user's groups
+	AllowedGroups []string // Only members may log in, empty allows everyone
+	AdminGroups   []string // Members become administrators
+}
+
+type WebAuthn struct {
+	Path          string   // JSON file holding registered authenticators
+	RPID          string   // Domain credentials are bound to, empty uses the host of the request
+	RPDisplayName string   // Name browsers show when asking for the authenticator
+	RPOrigins     []string // Origins allowed to use the credentials, empty uses the origin of the request
+	SecondFactor  bool     // Password logins of users with an authenticator also require it
 }
 
 type Web struct {
-	RootPath string
+	Listeners       []Listener    // Addresses the panel serves on
+	ShutdownTimeout time.Duration // How long requests may take to finish on shutdown or restart, and how long open terminals last after a restart
+	BasePath        string        // URL prefix the panel lives under, e.g. "/panel" behind a shared reverse proxy
+	RootPath        string        // Serve the frontend from this directory instead of the embedded one, for development
+	AllowedOrigins  []string      // Origins besides the panel's own that may open Socket.IO connections, "*" allows any
+	TrustedProxies  []string      // Addresses or CIDRs of reverse proxies whose forwarded headers are believed, "unix" for peers on Unix sockets
+}
+
+type Terminal struct {
+	IdleTimeout     time.Duration // Close sessions without input for this long, 0 disables
+	MaxDuration     time.Duration // Absolute session lifetime, 0 disables
+	TimeoutWarning  time.Duration // How long before a timeout the browser is warned
+	MaxUserSessions int           // Concurrent sessions per panel user, 0 means unlimited
+
+	KeepaliveInterval time.Duration // Time between keepalive requests, 0 disables
+	KeepaliveCountMax int           // Unanswered keepalives before the connection is dropped, 0 means 3
+	ReconnectAttempts int           // Automatic reconnects after a lost connection, 0 disables
+
+	FileTransfer bool // Detect rz/sz and trz/tsz and hand the transfer to the browser
+
+	ForwardEnv []string // Panel environment variables a host's SendEnv may forward, e.g. "LC_*", MINIMALPANEL_* never are
+}
+
+type Library struct {
+	Snippets     map[string]string            // Global command snippets by name
+	UserSnippets map[string]map[string]string // Per-user command snippets by username, then name
+	HostStartup  map[string][]string          // Commands run after the shell starts, by SSH config Host alias
+	HostGroups   map[string][]string          // Named sets of hosts, used by API token scopes
+}
+
+type Access struct {
+	AllowCIDRs     []string            // Only these addresses or CIDRs may reach the panel, empty allows all, "unix" matches Unix socket peers
+	DenyCIDRs      []string            // These may never reach the panel, even if allowed above
+	UserAllowCIDRs map[string][]string // Per-user addresses, further limiting the global lists
+	UserDenyCIDRs  map[string][]string // Per-user addresses the user may not log in from
+}
+
+type Listener struct {
+	Network string // "tcp", "unix" or "systemd"
+	Address string // host:port, socket path, or name of an inherited systemd socket, empty takes all of them
+	Mode    string // Permissions of a Unix socket, e.g. "0660"
+	Group   string // Group owning a Unix socket
+	Plain   bool   // Serve plain HTTP here even when TLS is enabled, e.g. for a local reverse proxy
+}
+
+type TLS struct {
+	Enabled    bool          // Serve HTTPS on every listener not marked Plain
+	CertPath   string        // PEM certificate chain, a self-signed one is generated here on first run
+	KeyPath    string        // PEM private key of the certificate
+	Hosts      []string      // Names and addresses the self-signed certificate is valid for, empty uses localhost and the hostname
+	HSTSMaxAge time.Duration // How long browsers should insist on HTTPS, 0 disables HSTS
+	ACME       ACME          // Certificates from Let's Encrypt or another ACME CA
+}
+
+type ACME struct {
+	Domains      []string // Obtain certificates for these names from the CA instead of using CertPath and KeyPath
+	Email        string   // Contact address for expiry notices
+	DirectoryURL string   // ACME directory of the CA, empty uses Let's Encrypt
+	CACertPath   string   // Extra CA trusted when talking to the directory, e.g. of a local test CA
+	CachePath    string   // Directory holding the account key and issued certificates
+	HTTPAddress  string   // Also answer HTTP-01 challenges on this address, e.g. ":80", empty relies on TLS-ALPN-01
+}
+
+type History struct {
+	Path  string // Directory holding the versions, empty keeps no history
+	Limit int    // Versions kept, the oldest are removed first, 0 keeps all
 }
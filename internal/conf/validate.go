@@ -0,0 +1,281 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is one problem found in a config file
+type Error struct {
+	Line    int    // 0 when the key is not in the file, e.g. a default is invalid
+	Key     string // TOML key, e.g. "TLS.ACME.Domains" or "Listeners[1].Mode"
+	Message string
+}
+
+// Errors lists every problem found in a config file
+type Errors struct {
+	Path string
+	List []Error
+}
+
+// Error formats the problems one per line as path:line: key: message
+func (self *Errors) Error() string {
+	lines := make([]string, 0, len(self.List))
+	for _, problem := range self.List {
+		location := self.Path
+		if problem.Line > 0 {
+			location += ":" + strconv.Itoa(problem.Line)
+		}
+		if problem.Key != "" {
+			location += ": " + problem.Key
+		}
+		lines = append(lines, location+": "+problem.Message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add records a problem with a key
+func (self *Errors) add(key string, format string, args ...any) {
+	self.List = append(self.List, Error{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// locate fills in the line of every problem from the file it was found in
+// param: overridden: keys set by environment variables, problems with them are not in the file
+func (self *Errors) locate(data []byte, overridden map[string]string) {
+	for i := range self.List {
+		problem := &self.List[i]
+		if env := overriddenBy(problem.Key, overridden); env != "" {
+			if !strings.Contains(problem.Message, env) {
+				problem.Message += " (set by " + env + ")"
+			}
+			continue
+		}
+		if problem.Line == 0 {
+			problem.Line = keyLine(data, problem.Key)
+		}
+	}
+}
+
+// overriddenBy returns the variable that set the key or a table holding it, "" if none did
+func overriddenBy(key string, overridden map[string]string) string {
+	path := strings.Split(key, ".")
+	for n := len(path); n > 0; n-- {
+		prefix := strings.Join(path[:n], ".")
+		// Listeners[1].Mode is overridden with all of Listeners
+		if index := strings.LastIndex(prefix, "["); index > 0 && strings.HasSuffix(prefix, "]") {
+			prefix = prefix[:index]
+		}
+		if env, ok := overridden[prefix]; ok {
+			return env
+		}
+	}
+	return ""
+}
+
+// Validate checks a config for values the panel cannot work with
+// Returns *Errors listing every problem, nil if there are none
+func Validate(c Config) error {
+	problems := &Errors{}
+
+	// Auth
+	for _, name := range c.Auth.Backends {
+		if name != "local" && name != "ldap" && name != "system" {
+			problems.add("Backends", "unknown backend %q, use local, ldap or system", name)
+		}
+	}
+	if contains(c.Auth.Backends, "ldap") {
+		if c.Auth.LDAP.URL == "" {
+			problems.add("LDAP.URL", "required when the ldap backend is enabled")
+		} else if u, err := url.Parse(c.Auth.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			problems.add("LDAP.URL", "must be an ldap:// or ldaps:// URL")
+		}
+		if c.Auth.LDAP.UserBaseDN == "" {
+			problems.add("LDAP.UserBaseDN", "required when the ldap backend is enabled")
+		}
+		if c.Auth.LDAP.PoolSize < 0 {
+			problems.add("LDAP.PoolSize", "must not be negative")
+		}
+	}
+	if contains(c.Auth.Backends, "system") && len(c.Auth.System.AllowedGroups) == 0 {
+		problems.add("System.AllowedGroups", "required when the system backend is enabled")
+	}
+	if c.Auth.OIDC.Issuer != "" {
+		if c.Auth.OIDC.ClientID == "" {
+			problems.add("OIDC.ClientID", "required when an issuer is set")
+		}
+		if !absoluteURL(c.Auth.OIDC.RedirectURL) {
+			problems.add("OIDC.RedirectURL", "must be the absolute URL of /oidc/callback")
+		}
+	}
+	for forwarded, username := range c.Auth.ForwardAuth.UserMap {
+		if strings.TrimSpace(username) == "" {
+			problems.add("ForwardAuth.UserMap."+forwarded, "must name a panel user")
+		}
+	}
+	positive(problems, "SessionIdleTimeout", c.Auth.SessionIdleTimeout)
+	positive(problems, "SessionMaxAge", c.Auth.SessionMaxAge)
+	positive(problems, "RememberMeMaxAge", c.Auth.RememberMeMaxAge)
+	notNegative(problems, "RememberMeRotate", c.Auth.RememberMeRotate)
+	for _, origin := range c.Auth.WebAuthn.RPOrigins {
+		if !absoluteURL(origin) {
+			problems.add("WebAuthn.RPOrigins", "%q is not an origin such as https://panel.example.com", origin)
+		}
+	}
+
+	// Web
+	if len(c.Web.Listeners) == 0 {
+		problems.add("Listeners", "at least one listener is required")
+	}
+	for i, listener := range c.Web.Listeners {
+		key := fmt.Sprintf("Listeners[%d]", i)
+		switch listener.Network {
+		case "", "tcp", "tcp4", "tcp6":
+			if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+				problems.add(key+".Address", "%q is not a host:port address", listener.Address)
+			}
+		case "unix":
+			if listener.Address == "" {
+				problems.add(key+".Address", "socket path required")
+			}
+		case "systemd":
+		default:
+			problems.add(key+".Network", "unknown network %q, use tcp, unix or systemd", listener.Network)
+		}
+		if listener.Mode != "" {
+			if _, err := strconv.ParseUint(listener.Mode, 8, 32); err != nil {
+				problems.add(key+".Mode", "%q is not an octal mode such as \"0660\"", listener.Mode)
+			}
+		}
+	}
+	notNegative(problems, "ShutdownTimeout", c.Web.ShutdownTimeout)
+	if strings.ContainsAny(c.Web.BasePath, "?#") {
+		problems.add("BasePath", "must be a plain path such as /panel")
+	}
+	for _, origin := range c.Web.AllowedOrigins {
+		if origin != "*" && !absoluteURL(origin) {
+			problems.add("AllowedOrigins", "%q is not an origin such as https://panel.example.com or *", origin)
+		}
+	}
+	addresses(problems, "TrustedProxies", c.Web.TrustedProxies)
+
+	// Terminal
+	notNegative(problems, "IdleTimeout", c.Terminal.IdleTimeout)
+	notNegative(problems, "MaxDuration", c.Terminal.MaxDuration)
+	notNegative(problems, "TimeoutWarning", c.Terminal.TimeoutWarning)
+	notNegative(problems, "KeepaliveInterval", c.Terminal.KeepaliveInterval)
+	if c.Terminal.MaxUserSessions < 0 {
+		problems.add("MaxUserSessions", "must not be negative")
+	}
+	if c.Terminal.KeepaliveCountMax < 0 {
+		problems.add("KeepaliveCountMax", "must not be negative")
+	}
+	if c.Terminal.ReconnectAttempts < 0 {
+		problems.add("ReconnectAttempts", "must not be negative")
+	}
+	for _, pattern := range c.Terminal.ForwardEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			problems.add("ForwardEnv", "%q is not a valid pattern", pattern)
+		}
+	}
+
+	// Access
+	addresses(problems, "AllowCIDRs", c.Access.AllowCIDRs)
+	addresses(problems, "DenyCIDRs", c.Access.DenyCIDRs)
+	for user, list := range c.Access.UserAllowCIDRs {
+		addresses(problems, "UserAllowCIDRs."+user, list)
+	}
+	for user, list := range c.Access.UserDenyCIDRs {
+		addresses(problems, "UserDenyCIDRs."+user, list)
+	}
+
+	// TLS
+	if c.TLS.Enabled && len(c.TLS.ACME.Domains) == 0 && (c.TLS.CertPath == "" || c.TLS.KeyPath == "") {
+		problems.add("TLS.CertPath", "certificate and key paths are required unless ACME is used")
+	}
+	notNegative(problems, "TLS.HSTSMaxAge", c.TLS.HSTSMaxAge)
+	for _, domain := range c.TLS.ACME.Domains {
+		if !strings.Contains(domain, ".") || strings.ContainsAny(domain, "/: ") {
+			problems.add("TLS.ACME.Domains", "%q is not a fully qualified domain name", domain)
+		}
+	}
+	if c.TLS.ACME.DirectoryURL != "" && !absoluteURL(c.TLS.ACME.DirectoryURL) {
+		problems.add("TLS.ACME.DirectoryURL", "must be an absolute URL")
+	}
+	if c.TLS.ACME.HTTPAddress != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.ACME.HTTPAddress); err != nil {
+			problems.add("TLS.ACME.HTTPAddress", "%q is not a host:port address", c.TLS.ACME.HTTPAddress)
+		}
+	}
+
+	// History
+	if c.History.Limit < 0 {
+		problems.add("History.Limit", "must not be negative")
+	}
+
+	if len(problems.List) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// absoluteURL reports whether value is a URL with scheme and host
+func absoluteURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// positive records a problem if the duration is not above zero
+func positive(problems *Errors, key string, d time.Duration) {
+	if d <= 0 {
+		problems.add(key, "must be greater than zero")
+	}
+}
+
+// notNegative records a problem if the duration is below zero
+func notNegative(problems *Errors, key string, d time.Duration) {
+	if d < 0 {
+		problems.add(key, "must not be negative")
+	}
+}
+
+// addresses records a problem for every entry that is neither an address, a CIDR nor the Unix socket marker
+func addresses(problems *Errors, key string, list []string) {
+	for _, entry := range list {
+		if entry == "unix" || net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			problems.add(key, "%q is neither an address, a CIDR nor \"unix\"", entry)
+		}
+	}
+}
+
+// keyLine finds the line a key is set on, or the line of the closest enclosing table
+// Returns 0 if neither is in the file
+// param: key: dotted TOML key, array tables are indexed like Listeners[1].Mode
+func keyLine(data []byte, key string) int {
+	path := strings.Split(key, ".")
+	best, bestLength := 0, -1
+	for _, e := range scan(strings.Split(string(data), "\n")) {
+		// The longest matching prefix wins, an exact match is the longest
+		if len(e.path) > bestLength && len(e.path) <= len(path) && samePath(e.path, path[:len(e.path)]) {
+			best, bestLength = e.start+1, len(e.path)
+		}
+	}
+	return best
+}
@@ -0,0 +1,86 @@
+package conf
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay lets an editor finish writing before the file is read
+const watchDelay = 200 * time.Millisecond
+
+// Subscribe registers f to be called after every change of the config, from reloads and writes alike
+// f runs synchronously and must not modify either config
+func Subscribe(f func(old Config, new Config)) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscribers = append(subscribers, f)
+}
+
+// notify calls the subscribers if the config actually changed
+func notify(old Config, new Config) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+
+	mu.RLock()
+	current := append([]func(Config, Config){}, subscribers...)
+	mu.RUnlock()
+	for _, f := range current {
+		f(old, new)
+	}
+}
+
+// Watch reloads the config whenever its file changes, invalid versions are logged and skipped
+func Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch config file: %w", err)
+	}
+	// Editors often save by replacing the file, which only the directory sees
+	if err := watcher.Add(filepath.Dir(Path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch config file: %w", err)
+	}
+
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(Path) && !event.Has(fsnotify.Chmod) {
+					reload = time.After(watchDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			case <-reload:
+				reload = nil
+				Reload()
+			}
+		}
+	}()
+	return nil
+}
+
+// Reload runs Update and logs the outcome, for the watcher and SIGHUP
+func Reload() {
+	before := Read()
+	if err := Update(); err != nil {
+		log.Printf("Config rejected, keeping the previous one:\n%v", err)
+		return
+	}
+	// The panel's own writes come back through the watcher unchanged
+	if !reflect.DeepEqual(before, Read()) {
+		log.Printf("Config reloaded from %s", Path)
+	}
+}
@@ -0,0 +1,220 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Write validates the config and saves it to the file at Path, recording the change in the history
+// Only settings that differ from the current config are changed in the file, so comments and formatting
+// survive. The file is replaced atomically and never left half written
+// Use Modify to change a config read from Read, a write in between would be lost otherwise
+func Write(conf Config, change Change) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	return write(conf, change)
+}
+
+// Modify applies edit to a copy of the current config and writes the result like Write
+// Reading, editing and writing happen under one lock, so concurrent changes are not lost
+// An error from edit leaves the config untouched and is returned as is
+func Modify(change Change, edit func(conf *Config) error) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	conf := Read()
+	if err := edit(&conf); err != nil {
+		return err
+	}
+	return write(conf, change)
+}
+
+// write is Write for callers holding writeMu
+func write(conf Config, change Change) error {
+	if err := Validate(conf); err != nil {
+		var problems *Errors
+		if errors.As(err, &problems) {
+			problems.Path = Path
+		}
+		return err
+	}
+
+	mu.Lock()
+	current, err := os.ReadFile(Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		mu.Unlock()
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	data, err := patch(current, Conf, conf)
+	if err == nil {
+		err = replaceFile(Path, data)
+	}
+	if err != nil {
+		mu.Unlock()
+		return err
+	}
+	record(Conf.History, current, data, change)
+
+	// Update global config after successful write
+	old := Conf
+	Conf = conf
+	mu.Unlock()
+
+	notify(old, conf)
+	return nil
+}
+
+// patch changes the settings of a config file that differ between old and new
+// Fails if the result would not read back as new
+func patch(data []byte, old Config, new Config) ([]byte, error) {
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	before, after := settingsOf(old), settingsOf(new)
+	for i, s := range after {
+		if sameValue(before[i].value, s.value) {
+			continue
+		}
+		patched := patchSetting(lines, s.path, before[i].value, s.value)
+		if !decodesTo(patched, s) {
+			// Tables written inline or as dotted keys cannot be changed entry by entry
+			patched = replaceSetting(lines, s.path, s.value)
+			if !decodesTo(patched, s) {
+				return nil, fmt.Errorf("failed to update %s in the config file", s.key())
+			}
+		}
+		lines = patched
+	}
+
+	result := []byte(strings.Join(lines, "\n") + "\n")
+	if _, err := Parse(Path, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// settingsOf lists the settings of a config that are written to the file, sections are left out
+func settingsOf(c Config) []setting {
+	var settings []setting
+	walk(reflect.ValueOf(c), nil, func(s setting) {
+		if !s.section {
+			settings = append(settings, s)
+		}
+	})
+	return settings
+}
+
+// sameValue reports whether two values of a setting are equal, a missing table equals an empty one
+func sameValue(a reflect.Value, b reflect.Value) bool {
+	if (a.Kind() == reflect.Map || a.Kind() == reflect.Slice) && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// patchSetting changes one setting in place, tables of plain values entry by entry
+func patchSetting(lines []string, path []string, old reflect.Value, new reflect.Value) []string {
+	kind := new.Kind()
+	switch {
+	case kind == reflect.Map && new.Type().Elem().Kind() != reflect.Map:
+		for _, key := range sortedKeys(old) {
+			if !new.MapIndex(reflect.ValueOf(key)).IsValid() {
+				lines = deleteKey(lines, appendPath(path, key))
+			}
+		}
+		for _, key := range sortedKeys(new) {
+			value, previous := new.MapIndex(reflect.ValueOf(key)), old.MapIndex(reflect.ValueOf(key))
+			if previous.IsValid() && sameValue(previous, value) {
+				continue
+			}
+			lines = setKey(lines, appendPath(path, key), encodeValue(value))
+		}
+		return lines
+	case kind == reflect.Map || kind == reflect.Slice && new.Type().Elem().Kind() == reflect.Struct:
+		return replaceSetting(lines, path, new)
+	default:
+		return setKey(lines, path, encodeValue(new))
+	}
+}
+
+// replaceSetting removes every trace of a setting and writes it anew
+func replaceSetting(lines []string, path []string, value reflect.Value) []string {
+	lines = deleteTable(lines, path)
+	kind := value.Kind()
+	if kind != reflect.Map && !(kind == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct) {
+		return setKey(lines, path, encodeValue(value))
+	}
+	if value.Len() == 0 {
+		return lines
+	}
+	return appendLines(lines, encodeTable(path, value)...)
+}
+
+// decodesTo reports whether the file decodes and holds the value of the setting
+func decodesTo(lines []string, want setting) bool {
+	decoded := Defaults()
+	if _, err := toml.Decode(strings.Join(lines, "\n"), &decoded); err != nil {
+		return false
+	}
+	for _, s := range settingsOf(decoded) {
+		if samePath(s.path, want.path) {
+			return sameValue(s.value, want.value)
+		}
+	}
+	return false
+}
+
+// appendPath returns path with key added, leaving path untouched
+func appendPath(path []string, key string) []string {
+	return append(append([]string(nil), path...), key)
+}
+
+// replaceFile writes data to a temporary file next to path and renames it over path
+// The permissions of the existing file are kept, a new one is only readable by its owner
+func replaceFile(path string, data []byte) (err error) {
+	// Replace the target of a symlink rather than the link
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	mode := fs.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err = f.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
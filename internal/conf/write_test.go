@@ -0,0 +1,217 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// patchedFile is edited by hand, its comments and layout must survive every change
+const patchedFile = `# Panel settings
+SSHConfigPath = "/etc/ssh" # Where the hosts are
+
+Admins = [
+  "alice", # First admin
+]
+
+# Login
+[Users]
+alice = "hash-a" # Set up by hand
+
+[TLS]
+  # Certificates
+  CertPath = "cert.pem"
+`
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(c *Config)
+		want string
+	}{
+		{
+			name: "value keeps its comment",
+			edit: func(c *Config) { c.SSHConfigPath = "/srv/ssh" },
+			want: strings.Replace(patchedFile, `"/etc/ssh"`, `"/srv/ssh"`, 1),
+		},
+		{
+			name: "multi-line value",
+			edit: func(c *Config) { c.Auth.Admins = append(c.Auth.Admins, "bob") },
+			want: strings.Replace(patchedFile, "Admins = [\n  \"alice\", # First admin\n]", `Admins = ["alice", "bob"]`, 1),
+		},
+		{
+			name: "table entry added",
+			edit: func(c *Config) { c.Auth.Users["bob"] = "hash-b" },
+			want: strings.Replace(patchedFile, "# Set up by hand\n", "# Set up by hand\nbob = \"hash-b\"\n", 1),
+		},
+		{
+			name: "table entry removed",
+			edit: func(c *Config) { delete(c.Auth.Users, "alice") },
+			want: strings.Replace(patchedFile, "alice = \"hash-a\" # Set up by hand\n", "", 1),
+		},
+		{
+			name: "key added to its table with its indent",
+			edit: func(c *Config) { c.TLS.KeyPath = "key.pem" },
+			want: patchedFile + "  KeyPath = \"key.pem\"\n",
+		},
+		{
+			name: "top level key added before the first table",
+			edit: func(c *Config) { c.Terminal.MaxUserSessions = 3 },
+			want: strings.Replace(patchedFile, "]\n\n# Login", "]\nMaxUserSessions = 3\n\n# Login", 1),
+		},
+		{
+			name: "missing table appended",
+			edit: func(c *Config) { c.History.Limit = 5 },
+			want: patchedFile + "\n[History]\nLimit = 5\n",
+		},
+		{
+			name: "new table setting appended",
+			edit: func(c *Config) { c.Library.Snippets = map[string]string{"up": "uptime"} },
+			want: patchedFile + "\n[Snippets]\nup = \"uptime\"\n",
+		},
+		{
+			name: "unchanged",
+			edit: func(c *Config) {},
+			want: patchedFile,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old, err := Parse("config.toml", []byte(patchedFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			edited, err := Parse("config.toml", []byte(patchedFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.edit(&edited)
+
+			got, err := patch([]byte(patchedFile), old, edited)
+			if err != nil {
+				t.Fatalf("patch: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestModify(t *testing.T) {
+	path := useConfig(t, patchedFile)
+
+	var notified []string
+	saved := subscribers
+	t.Cleanup(func() { subscribers = saved })
+	subscribers = []func(old Config, new Config){func(old Config, new Config) {
+		notified = append(notified, old.TLS.CertPath+" -> "+new.TLS.CertPath)
+	}}
+
+	err := Modify(Change{Author: "alice", Reason: "Renew certificate"}, func(c *Config) error {
+		c.TLS.CertPath = "chain.pem"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Modify: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(patchedFile, "cert.pem", "chain.pem", 1); string(data) != want {
+		t.Errorf("got file\n%s\nwant\n%s", data, want)
+	}
+	if Conf.TLS.CertPath != "chain.pem" {
+		t.Errorf("got CertPath %q, want the written chain.pem", Conf.TLS.CertPath)
+	}
+	if len(notified) != 1 || notified[0] != "cert.pem -> chain.pem" {
+		t.Errorf("got notifications %q, want one for the change", notified)
+	}
+
+	// Neither a failed edit nor an invalid config touch the file
+	failed := errors.New("edit failed")
+	if err := Modify(Change{}, func(c *Config) error { return failed }); err != failed {
+		t.Errorf("got %v, want the error of the edit", err)
+	}
+	err = Modify(Change{}, func(c *Config) error {
+		c.Terminal.MaxUserSessions = -1
+		return nil
+	})
+	var problems *Errors
+	if !errors.As(err, &problems) || problems.Path != path {
+		t.Errorf("got %v, want the problems of %s", err, path)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Error("rejected change was written")
+	}
+	if len(notified) != 1 {
+		t.Errorf("got notifications %q for rejected changes", notified)
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A new file is only readable by its owner
+	created := filepath.Join(dir, "created.toml")
+	if err := replaceFile(created, []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got %v %v, want a file with mode 0600", info, err)
+	}
+
+	// An existing file keeps its permissions
+	existing := filepath.Join(dir, "existing.toml")
+	if err := os.WriteFile(existing, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(existing, []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(existing)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("got %v %v, want the mode 0640 kept", info, err)
+	}
+
+	// A symlink stays in place, its target is replaced
+	link := filepath.Join(dir, "link.toml")
+	if err := os.Symlink(existing, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(link, []byte("through the link\n")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Error("symlink was replaced by a file")
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "through the link\n" {
+		t.Errorf("got target %q, want it replaced", data)
+	}
+
+	// A failed rename leaves the target alone and no temporary file behind
+	target := filepath.Join(dir, "directory.toml")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(target, []byte("new\n")); err == nil {
+		t.Error("replaced a directory")
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Error("failed replace changed the target")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
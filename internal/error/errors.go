@@ -3,5 +3,12 @@ package error
 import "errors"
 
 var (
-	FileNotFound = errors.New("file not found")
+	FileNotFound     = errors.New("file not found")
+	UserNotFound     = errors.New("user not found")
+	UserExists       = errors.New("user already exists")
+	WrongPassword    = errors.New("wrong password")
+	PasswordRequired = errors.New("password is required")
+	AccessDenied     = errors.New("access denied from this address")
+
+	VersionNotFound = errors.New("config version not found")
 )
@@ -0,0 +1,213 @@
+package netx
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"minimalpanel/internal/conf"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Listener is an open listener of the panel
+type Listener struct {
+	net.Listener
+	Secure bool   // Serve TLS on it
+	Key    string // Identifies the listener when it is handed to a restarted process
+}
+
+// inheritedSocket is a listening socket passed in by systemd or by the process being restarted
+type inheritedSocket struct {
+	key     string // network|address, systemd sockets use their name as the address
+	file    *os.File
+	claimed bool
+}
+
+// inherited holds the sockets passed to the process
+var inherited struct {
+	once    sync.Once
+	sockets []*inheritedSocket
+	ready   *os.File // Closed to tell the previous process the restart succeeded
+	state   *os.File // State the previous process saved for this one
+}
+
+// Listen opens all configured listeners, taking over inherited sockets where they match
+// param: secure: TLS is enabled, listeners not marked Plain serve it
+func Listen(secure bool) ([]Listener, error) {
+	var listeners []Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	configured := conf.GetWeb().Listeners
+	if len(configured) == 0 {
+		return nil, fmt.Errorf("no listeners configured")
+	}
+	for _, settings := range configured {
+		opened, err := listen(settings)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		for _, l := range opened {
+			l.Secure = secure && !settings.Plain
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+// ListenTCP opens a plain TCP listener outside of the configured ones, such as for ACME challenges
+func ListenTCP(address string) (Listener, error) {
+	opened, err := listen(conf.Listener{Network: "tcp", Address: address})
+	if err != nil {
+		return Listener{}, err
+	}
+	return opened[0], nil
+}
+
+// listen opens one configured listener, systemd may hand over several sockets for it
+func listen(settings conf.Listener) ([]Listener, error) {
+	network := settings.Network
+	if network == "" {
+		network = "tcp"
+	}
+	key := network + "|" + settings.Address
+	if network == "systemd" && settings.Address == "" {
+		// Every systemd socket not claimed by a named listener
+		key = "systemd|"
+	}
+	if listeners, err := claimInherited(key); err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(network, settings.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", settings.Address, err)
+		}
+		return []Listener{{Listener: l, Key: key}}, nil
+	case "unix":
+		l, err := listenUnix(settings)
+		if err != nil {
+			return nil, err
+		}
+		return []Listener{{Listener: l, Key: key}}, nil
+	case "systemd":
+		if settings.Address == "" {
+			return nil, errors.New("no sockets passed by systemd")
+		}
+		return nil, fmt.Errorf("no socket named %s passed by systemd", settings.Address)
+	default:
+		return nil, fmt.Errorf("unknown listener network %q", settings.Network)
+	}
+}
+
+// claimInherited takes over the inherited sockets with the key
+// A key ending in | takes every unclaimed socket with that prefix
+func claimInherited(key string) ([]Listener, error) {
+	inherited.once.Do(loadInherited)
+
+	var listeners []Listener
+	for _, socket := range inherited.sockets {
+		matches := socket.key == key || (strings.HasSuffix(key, "|") && strings.HasPrefix(socket.key, key))
+		if socket.claimed || !matches {
+			continue
+		}
+		l, err := net.FileListener(socket.file)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use inherited socket %s: %w", socket.key, err)
+		}
+		// The listener holds its own duplicate of the descriptor
+		socket.file.Close()
+		socket.claimed = true
+		listeners = append(listeners, Listener{Listener: l, Key: socket.key})
+	}
+	return listeners, nil
+}
+
+// listenUnix opens a Unix domain socket and applies its permissions
+func listenUnix(settings conf.Listener) (net.Listener, error) {
+	// A socket left behind by an unclean exit would make the listen fail
+	if info, err := os.Lstat(settings.Address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(settings.Address); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", settings.Address, err)
+		}
+	}
+
+	l, err := net.Listen("unix", settings.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", settings.Address, err)
+	}
+
+	if settings.Mode != "" {
+		mode, err := strconv.ParseUint(settings.Mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid socket mode %q: %w", settings.Mode, err)
+		}
+		if err := os.Chmod(settings.Address, fs.FileMode(mode)); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set permissions of %s: %w", settings.Address, err)
+		}
+	}
+	if settings.Group != "" {
+		group, err := user.LookupGroup(settings.Group)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to look up group %s: %w", settings.Group, err)
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(settings.Address, -1, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change group of %s: %w", settings.Address, err)
+		}
+	}
+	return l, nil
+}
+
+// loadInherited reads the sockets passed by systemd socket activation, see sd_listen_fds(3),
+// or by the process being restarted, see Handoff
+func loadInherited() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv(handoffEnv)
+
+	if keys, ok := os.LookupEnv(handoffEnv); ok {
+		loadHandoff(keys)
+		return
+	}
+
+	// The variables are meant for this process only, not for one that inherited them
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		fd := 3 + i // SD_LISTEN_FDS_START
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		inherited.sockets = append(inherited.sockets, &inheritedSocket{
+			key:  "systemd|" + name,
+			file: os.NewFile(uintptr(fd), name),
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package netx
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+// Notify sends a state change to systemd, see sd_notify(3), and does nothing when not run by a Type=notify unit
+// Restarts need Type=notify: the old process reports the new one as MAINPID before it exits, otherwise
+// systemd takes the exit for the end of the service and kills the new process with the rest of the unit
+func Notify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // Abstract socket
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// notifyMainPID tells systemd that the process pid took over the service
+// The old process sends this as the main process, so the default NotifyAccess=main suffices
+func notifyMainPID(pid int) {
+	Notify(fmt.Sprintf("MAINPID=%d\nREADY=1", pid))
+}
@@ -0,0 +1,40 @@
+package netx
+
+import (
+	"minimalpanel/internal/conf"
+	"net/http"
+	"strings"
+)
+
+// BasePath returns the URL prefix the panel lives under without a trailing slash, empty at the root
+func BasePath() string {
+	base := strings.TrimRight(conf.GetWeb().BasePath, "/")
+	if base != "" && !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	return base
+}
+
+// Path prefixes an absolute panel path with the base path, for redirects and cookies
+func Path(path string) string {
+	return BasePath() + path
+}
+
+// StripBasePath is a middleware serving the panel under the base path
+// Routes are registered without the prefix, requests outside of it are not found
+func StripBasePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := BasePath()
+		switch {
+		case base == "":
+			next.ServeHTTP(w, r)
+		case r.URL.Path == base:
+			// Relative links in the pages only resolve below the prefix with the trailing slash
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			http.StripPrefix(base, next).ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package netx
+
+import (
+	"minimalpanel/internal/conf"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// UnixPeer stands in for the address of peers on a Unix socket
+// It only matches lists that contain it explicitly, never a loopback address or CIDR
+const UnixPeer = "unix"
+
+// FromTrustedProxy reports whether the request came straight from one of the configured reverse proxies
+func FromTrustedProxy(r *http.Request) bool {
+	return MatchAddress(peerIP(r), conf.GetWeb().TrustedProxies)
+}
+
+// ClientIP returns the address of the client that sent the request
+// Behind trusted proxies it is the nearest X-Forwarded-For entry that is not a proxy itself
+func ClientIP(r *http.Request) string {
+	peer := peerIP(r)
+	proxies := conf.GetWeb().TrustedProxies
+	if !MatchAddress(peer, proxies) {
+		return peer
+	}
+
+	// Each proxy appends the address it received the request from, so walk back from the end
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		if !MatchCIDRs(ip, proxies) {
+			return hop
+		}
+	}
+	return peer
+}
+
+// MatchAddress reports whether a client address, see ClientIP, is in a list of addresses and CIDRs
+func MatchAddress(address string, list []string) bool {
+	if address == UnixPeer {
+		return slices.Contains(list, UnixPeer)
+	}
+	return MatchCIDRs(net.ParseIP(address), list)
+}
+
+// MatchCIDRs reports whether ip is one of the addresses or inside one of the CIDRs
+func MatchCIDRs(ip net.IP, list []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range list {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the direct peer of the request
+// Peers on a Unix socket have no address and are reported as UnixPeer
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		if net.ParseIP(r.RemoteAddr) == nil {
+			return UnixPeer
+		}
+		return r.RemoteAddr
+	}
+	return host
+}
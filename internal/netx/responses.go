@@ -96,6 +96,16 @@ func WriteUnauthorized(w http.ResponseWriter, message string) error {
 	return WriteAuthError(w, http.StatusUnauthorized, message)
 }
 
+// WriteForbidden writes a forbidden response
+func WriteForbidden(w http.ResponseWriter, message string) error {
+	return WriteAuthError(w, http.StatusForbidden, message)
+}
+
+// WriteNotFound writes a not found response
+func WriteNotFound(w http.ResponseWriter, message string) error {
+	return WriteError(w, http.StatusNotFound, message, nil)
+}
+
 // WriteInternalServerError writes an internal server error response
 func WriteInternalServerError(w http.ResponseWriter, message string, err error) error {
 	return WriteError(w, http.StatusInternalServerError, message, err)
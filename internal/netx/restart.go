@@ -0,0 +1,196 @@
+package netx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"minimalpanel/internal/conf"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// handoffEnv tells a restarted process which sockets it inherited
+const handoffEnv = "MINIMALPANEL_HANDOFF"
+
+// handoffTimeout is how long the new process may take to start serving
+const handoffTimeout = 30 * time.Second
+
+// handoff describes the descriptors passed to the new process, they start at 3
+// in this order: the listeners, the ready pipe, then the state file if any
+type handoff struct {
+	Listeners []string `json:"listeners"` // Listener keys
+	State     bool     `json:"state"`
+}
+
+// Handoff starts a new copy of the panel serving on the same sockets, for restarts without downtime
+// The new process reads the config again, so it also applies config changes and upgraded binaries.
+// Under systemd the unit needs Type=notify, see Notify
+// param: state: passed to the new process, see InheritedState, may be nil
+// Returns once the new process is serving, the caller should then drain and exit
+func Handoff(listeners []Listener, state *os.File) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	description := handoff{State: state != nil}
+	for _, l := range listeners {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be handed over", l.Key)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to hand over listener %s: %w", l.Key, err)
+		}
+		files = append(files, f)
+		description.Listeners = append(description.Listeners, l.Key)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create ready pipe: %w", err)
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+	if state != nil {
+		files = append(files, state)
+	}
+
+	encoded, err := json.Marshal(description)
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the panel executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"="+string(encoded))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+	// Only the new process may hold the write end, so its exit shows up as EOF
+	readyWriter.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 1)
+		if n, _ := ready.Read(buffer); n == 1 {
+			result <- nil
+			return
+		}
+		result <- errors.New("new process exited before serving")
+	}()
+
+	select {
+	case err = <-result:
+	case <-time.After(handoffTimeout):
+		err = fmt.Errorf("new process did not start serving within %s", handoffTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	notifyMainPID(cmd.Process.Pid)
+	cmd.Process.Release()
+
+	// The socket files now belong to the new process
+	for _, l := range listeners {
+		if unix, ok := l.Listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// RestartNeeded compares the settings the sockets and certificates were set up with
+// Returns whether the listeners or the certificate source changed, which takes a restart, and the
+// names of changed settings that are only read on startup. HSTSMaxAge and the rest apply live
+func RestartNeeded(old conf.Config, new conf.Config) (bool, []string) {
+	var pending []string
+	if !slices.Equal(old.TLS.Hosts, new.TLS.Hosts) {
+		pending = append(pending, "TLS.Hosts") // Only used when generating a certificate
+	}
+	if old.TLS.ACME.Email != new.TLS.ACME.Email {
+		pending = append(pending, "TLS.ACME.Email") // Only used when creating the account
+	}
+	return !reflect.DeepEqual(old.Web.Listeners, new.Web.Listeners) ||
+		!reflect.DeepEqual(certificateSource(old.TLS), certificateSource(new.TLS)), pending
+}
+
+// certificateSource returns the TLS settings that decide where certificates come from
+func certificateSource(settings conf.TLS) conf.TLS {
+	settings.Hosts = nil
+	settings.HSTSMaxAge = 0
+	settings.ACME.Email = ""
+	return settings
+}
+
+// Ready tells the process that handed over its sockets that this one is serving
+// Inherited sockets no listener claimed were removed from the config and are closed
+func Ready() {
+	inherited.once.Do(loadInherited)
+	for _, socket := range inherited.sockets {
+		if socket.claimed {
+			continue
+		}
+		socket.file.Close()
+		socket.claimed = true
+		if path, ok := strings.CutPrefix(socket.key, "unix|"); ok {
+			os.Remove(path)
+		}
+		log.Printf("Closed listener %s, it is no longer configured", socket.key)
+	}
+
+	if inherited.ready == nil {
+		// A restarted process is announced to systemd by the one it replaces
+		Notify("READY=1")
+		return
+	}
+	if _, err := inherited.ready.Write([]byte{1}); err != nil {
+		log.Printf("Failed to notify the previous process: %v", err)
+	}
+	inherited.ready.Close()
+	inherited.ready = nil
+}
+
+// InheritedState returns the state handed over by the previous process, nil if there is none
+func InheritedState() *os.File {
+	inherited.once.Do(loadInherited)
+	state := inherited.state
+	inherited.state = nil
+	return state
+}
+
+// loadHandoff reads the descriptors described by the handoff environment variable
+func loadHandoff(value string) {
+	var description handoff
+	if err := json.Unmarshal([]byte(value), &description); err != nil {
+		log.Printf("Ignoring invalid %s: %v", handoffEnv, err)
+		return
+	}
+
+	fd := uintptr(3)
+	for _, key := range description.Listeners {
+		inherited.sockets = append(inherited.sockets, &inheritedSocket{key: key, file: os.NewFile(fd, key)})
+		fd++
+	}
+	inherited.ready = os.NewFile(fd, "ready")
+	fd++
+	if description.State {
+		inherited.state = os.NewFile(fd, "state")
+	}
+}
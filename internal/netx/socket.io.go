@@ -40,6 +40,22 @@ func (self *Socket) GetNamespace(name string) Namespace {
 	return self.Namespaces[name]
 }
 
+// DisconnectWhere disconnects the clients of every namespace that match
+func (self *Socket) DisconnectWhere(match func(client *socket.Socket) bool) {
+	for _, namespace := range self.Namespaces {
+		var matched []*socket.Socket
+		namespace.namespace.Sockets().Range(func(_ socket.SocketId, client *socket.Socket) bool {
+			if match(client) {
+				matched = append(matched, client)
+			}
+			return true
+		})
+		for _, client := range matched {
+			client.Disconnect(false)
+		}
+	}
+}
+
 // Handler returns an HTTP handler for the Socket.IO server
 func (self *Socket) Handler() http.Handler {
 	return self.sock.ServeHandler(nil)
@@ -113,6 +129,11 @@ func GetHandler() http.Handler {
 	return GetGlobalServer().Handler()
 }
 
+// CloseGlobalServer drops every Socket.IO connection, clients reconnect on their own
+func CloseGlobalServer() {
+	GetGlobalServer().sock.Close(nil)
+}
+
 // Test function, ignore this
 func Start(addr string) error {
 	server := new(Socket)
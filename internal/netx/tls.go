@@ -0,0 +1,247 @@
+package netx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"minimalpanel/internal/conf"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsActive is set once the server is about to serve HTTPS
+var tlsActive atomic.Bool
+
+// TLSActive reports whether the panel is served over HTTPS, cookies are then marked Secure
+func TLSActive() bool {
+	return tlsActive.Load()
+}
+
+// SetupTLS prepares the server's TLS config, it is nil when TLS is disabled
+// challenges answers ACME HTTP-01 challenges and is nil unless ACME.HTTPAddress is set
+func SetupTLS() (config *tls.Config, challenges http.Handler, err error) {
+	settings := conf.GetTLS()
+	if !settings.Enabled {
+		return nil, nil, nil
+	}
+
+	if len(settings.ACME.Domains) > 0 {
+		manager, err := acmeManager(settings.ACME)
+		if err != nil {
+			return nil, nil, err
+		}
+		if settings.ACME.HTTPAddress != "" {
+			challenges = manager.HTTPHandler(nil)
+		}
+		config = manager.TLSConfig()
+	} else {
+		if err := ensureCertificate(settings); err != nil {
+			return nil, nil, err
+		}
+		// Load once now so a broken pair fails at startup rather than on the first handshake
+		certificate := &certificateFile{certPath: settings.CertPath, keyPath: settings.KeyPath}
+		if _, err := certificate.get(nil); err != nil {
+			return nil, nil, err
+		}
+		config = &tls.Config{GetCertificate: certificate.get}
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	tlsActive.Store(true)
+	return config, challenges, nil
+}
+
+// StrictTransportSecurity is a middleware telling browsers to only use HTTPS from now on
+// The header is only sent over TLS, as browsers ignore it on plain HTTP
+func StrictTransportSecurity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxAge := conf.GetTLS().HSTSMaxAge; r.TLS != nil && maxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acmeManager obtains and renews certificates for the configured domains
+// Enabling ACME accepts the terms of service of the CA
+func acmeManager(settings conf.ACME) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: settings.DirectoryURL}
+	if settings.CACertPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(settings.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA certificate: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", settings.CACertPath)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(settings.CachePath),
+		HostPolicy: autocert.HostWhitelist(settings.Domains...),
+		Email:      settings.Email,
+		Client:     client,
+	}, nil
+}
+
+// certificateFile serves a certificate from disk, reloading it when the files change
+// so renewed certificates are picked up without a restart
+type certificateFile struct {
+	certPath    string
+	keyPath     string
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// get returns the current certificate, it matches tls.Config.GetCertificate
+func (self *certificateFile) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	modTime, err := latestModTime(self.certPath, self.keyPath)
+	if err != nil && self.certificate != nil {
+		// Keep serving the old pair while the files are being replaced
+		return self.certificate, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	if self.certificate != nil && modTime.Equal(self.modTime) {
+		return self.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(self.certPath, self.keyPath)
+	if err != nil {
+		if self.certificate != nil {
+			log.Printf("Failed to reload certificate, keeping the previous one: %v", err)
+			return self.certificate, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	self.certificate = &certificate
+	self.modTime = modTime
+	return self.certificate, nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ensureCertificate generates a self-signed certificate when neither file exists yet
+func ensureCertificate(settings conf.TLS) error {
+	_, certErr := os.Stat(settings.CertPath)
+	_, keyErr := os.Stat(settings.KeyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, fs.ErrNotExist) || !errors.Is(keyErr, fs.ErrNotExist) {
+		return fmt.Errorf("certificate %s and key %s must either both exist or both be missing", settings.CertPath, settings.KeyPath)
+	}
+
+	hosts := settings.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+	}
+
+	certPEM, keyPEM, err := selfSignedCertificate(hosts)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{settings.CertPath, settings.KeyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create certificate directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(settings.KeyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := os.WriteFile(settings.CertPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	log.Printf("Generated a self-signed certificate for %v at %s", hosts, settings.CertPath)
+	return nil
+}
+
+// selfSignedCertificate creates a PEM encoded certificate and key for the hosts
+func selfSignedCertificate(hosts []string) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"MinimalPanel"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(825 * 24 * time.Hour), // The longest validity browsers still accept
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false, // A server certificate, browsers reject CA certificates served as the leaf
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
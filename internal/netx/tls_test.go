@@ -0,0 +1,437 @@
+package netx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"minimalpanel/internal/conf"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idACMEIdentifier is the extension carrying the key authorization digest in TLS-ALPN-01 certificates
+var idACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// mockCA is a small in-process ACME CA in the spirit of Pebble
+// It validates TLS-ALPN-01 challenges by connecting to the panel and issues certificates from its own root
+type mockCA struct {
+	*httptest.Server
+	root       *x509.Certificate
+	rootKey    *ecdsa.PrivateKey
+	panel      string // Address the challenges are validated against
+	mu         sync.Mutex
+	thumbprint string // Of the account key
+	domain     string // Of the pending order
+	token      string
+	status     string // Of the authorization
+	leaf       []byte // Issued certificate
+}
+
+func newMockCA(t *testing.T) *mockCA {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Mock ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(der)
+	ca := &mockCA{root: root, rootKey: rootKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		ca.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/order",
+			"revokeCert": ca.URL + "/revoke",
+			"keyChange":  ca.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		ca.reply(w, http.StatusOK, "", nil)
+	})
+	mux.HandleFunc("/account", ca.handleAccount)
+	mux.HandleFunc("/order", ca.handleOrder)
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.reply(w, http.StatusOK, "", ca.order())
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.reply(w, http.StatusOK, "", ca.authorization())
+	})
+	mux.HandleFunc("/challenge/1", ca.handleChallenge)
+	mux.HandleFunc("/finalize/1", ca.handleFinalize)
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		w.Header().Set("Replay-Nonce", nonce())
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.leaf})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+	})
+	ca.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+// nonce returns a fresh Replay-Nonce, the mock does not check them
+func nonce() string {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+// reply writes an ACME response, every response carries a nonce
+func (self *mockCA) reply(w http.ResponseWriter, status int, location string, body interface{}) {
+	w.Header().Set("Replay-Nonce", nonce())
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// readJWS returns the protected header and payload of a request, signatures are not checked
+func readJWS(r *http.Request, header interface{}, payload interface{}) error {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(decoded, header); err != nil {
+		return err
+	}
+	if decoded, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil || payload == nil || len(decoded) == 0 {
+		return err
+	}
+	return json.Unmarshal(decoded, payload)
+}
+
+// handleAccount registers the account key, its thumbprint is part of every key authorization
+func (self *mockCA) handleAccount(w http.ResponseWriter, r *http.Request) {
+	var header struct {
+		JWK struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := readJWS(r, &header, nil); err != nil || header.JWK.Kty != "EC" {
+		self.reply(w, http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+	// RFC 7638: the required members in lexicographic order
+	jwk := fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)
+	sum := sha256.Sum256([]byte(jwk))
+
+	self.mu.Lock()
+	self.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	self.mu.Unlock()
+	self.reply(w, http.StatusCreated, self.URL+"/account/1", map[string]string{"status": "valid"})
+}
+
+// handleOrder starts an order for a single DNS name
+func (self *mockCA) handleOrder(w http.ResponseWriter, r *http.Request) {
+	var header struct{}
+	var payload struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if err := readJWS(r, &header, &payload); err != nil || len(payload.Identifiers) != 1 {
+		self.reply(w, http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+
+	self.mu.Lock()
+	self.domain = payload.Identifiers[0].Value
+	self.token = nonce()
+	self.status = "pending"
+	self.leaf = nil
+	self.mu.Unlock()
+	self.reply(w, http.StatusCreated, self.URL+"/order/1", self.order())
+}
+
+// order describes the pending order
+func (self *mockCA) order() map[string]interface{} {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	status := "pending"
+	if self.leaf != nil {
+		status = "valid"
+	} else if self.status == "valid" {
+		status = "ready"
+	}
+	order := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": self.domain}},
+		"authorizations": []string{self.URL + "/authz/1"},
+		"finalize":       self.URL + "/finalize/1",
+	}
+	if self.leaf != nil {
+		order["certificate"] = self.URL + "/cert/1"
+	}
+	return order
+}
+
+// authorization describes the authorization of the order's name, only TLS-ALPN-01 is offered
+func (self *mockCA) authorization() map[string]interface{} {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return map[string]interface{}{
+		"status":     self.status,
+		"identifier": map[string]string{"type": "dns", "value": self.domain},
+		"challenges": []map[string]string{{
+			"type":   "tls-alpn-01",
+			"url":    self.URL + "/challenge/1",
+			"token":  self.token,
+			"status": self.status,
+		}},
+	}
+}
+
+// handleChallenge validates TLS-ALPN-01 by connecting to the panel like a real CA would
+func (self *mockCA) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	self.mu.Lock()
+	domain, token := self.domain, self.token
+	keyAuthorization := token + "." + self.thumbprint
+	self.mu.Unlock()
+
+	status := "invalid"
+	if err := validateALPN(self.panel, domain, keyAuthorization); err == nil {
+		status = "valid"
+	}
+	self.mu.Lock()
+	self.status = status
+	self.mu.Unlock()
+
+	self.reply(w, http.StatusOK, "", map[string]string{
+		"type":   "tls-alpn-01",
+		"url":    self.URL + "/challenge/1",
+		"token":  token,
+		"status": status,
+	})
+}
+
+// validateALPN checks the certificate the panel presents for the acme-tls/1 protocol
+func validateALPN(address string, domain string, keyAuthorization string) error {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true, // Challenge certificates are self-signed
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("acme-tls/1 was not negotiated")
+	}
+	certificate := state.PeerCertificates[0]
+	if err := certificate.VerifyHostname(domain); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(keyAuthorization))
+	want, _ := asn1.Marshal(sum[:])
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(idACMEIdentifier) && string(extension.Value) == string(want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching acmeIdentifier extension")
+}
+
+// handleFinalize signs the CSR of a ready order
+func (self *mockCA) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	var header struct{}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := readJWS(r, &header, &payload); err != nil {
+		self.reply(w, http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+	der, _ := base64.RawURLEncoding.DecodeString(payload.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+
+	self.mu.Lock()
+	ready := self.status == "valid"
+	domain := self.domain
+	self.mu.Unlock()
+	if err != nil || !ready || len(csr.DNSNames) != 1 || csr.DNSNames[0] != domain {
+		self.reply(w, http.StatusForbidden, "", map[string]string{"type": "urn:ietf:params:acme:error:orderNotReady"})
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, self.root, csr.PublicKey, self.rootKey)
+	if err != nil {
+		self.reply(w, http.StatusInternalServerError, "", map[string]string{"type": "urn:ietf:params:acme:error:serverInternal"})
+		return
+	}
+	self.mu.Lock()
+	self.leaf = leaf
+	self.mu.Unlock()
+	self.reply(w, http.StatusOK, self.URL+"/order/1", self.order())
+}
+
+// useTLS enables TLS with the given settings for the test
+func useTLS(t *testing.T, settings conf.TLS) {
+	saved := conf.Conf
+	t.Cleanup(func() {
+		conf.Conf = saved
+		tlsActive.Store(false)
+	})
+	settings.Enabled = true
+	conf.Conf.TLS = settings
+}
+
+// serveTLS serves the config on a loopback port and returns its address
+func serveTLS(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func TestACMEIssuesCertificate(t *testing.T) {
+	ca := newMockCA(t)
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	useTLS(t, conf.TLS{ACME: conf.ACME{
+		Domains:      []string{"panel.test"},
+		DirectoryURL: ca.URL + "/dir",
+		CACertPath:   caPath, // The directory itself is served with a test certificate
+		CachePath:    filepath.Join(dir, "acme"),
+	}})
+
+	config, challenges, err := SetupTLS()
+	if err != nil {
+		t.Fatalf("SetupTLS: %v", err)
+	}
+	if challenges != nil {
+		t.Error("HTTP-01 handler set up without HTTPAddress")
+	}
+	ca.panel = serveTLS(t, config)
+
+	// The first handshake for the domain obtains the certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	conn, err := tls.Dial("tcp", ca.panel, &tls.Config{ServerName: "panel.test", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("handshake with a certificate from the CA: %v", err)
+	}
+	conn.Close()
+
+	// Names outside Domains get nothing
+	conn, err = tls.Dial("tcp", ca.panel, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Error("handshake for a name outside Domains succeeded")
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	useTLS(t, conf.TLS{
+		CertPath: filepath.Join(dir, "tls", "cert.pem"),
+		KeyPath:  filepath.Join(dir, "tls", "key.pem"),
+		Hosts:    []string{"panel.test", "127.0.0.1"},
+	})
+
+	config, _, err := SetupTLS()
+	if err != nil {
+		t.Fatalf("SetupTLS: %v", err)
+	}
+	address := serveTLS(t, config)
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: "panel.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	conn.Close()
+
+	if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Error("served leaf is a CA certificate")
+	}
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 || len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("leaf is not a server certificate: key usage %v, extended %v", leaf.KeyUsage, leaf.ExtKeyUsage)
+	}
+	// Users trust it by adding the certificate itself
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	for _, host := range []string{"panel.test", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("%s: %v", host, err)
+		}
+	}
+	if !strings.Contains(leaf.Subject.String(), "MinimalPanel") {
+		t.Errorf("unexpected subject %s", leaf.Subject)
+	}
+
+	// A second start keeps the generated pair
+	before, _ := os.ReadFile(filepath.Join(dir, "tls", "cert.pem"))
+	if _, _, err := SetupTLS(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(filepath.Join(dir, "tls", "cert.pem"))
+	if string(before) != string(after) {
+		t.Error("certificate was generated again")
+	}
+}
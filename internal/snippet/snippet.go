@@ -0,0 +1,138 @@
+package snippet
+
+import (
+	"fmt"
+	"minimalpanel/internal/conf"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Snippet is a saved command
+type Snippet struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Global  bool     `json:"global"`
+	Vars    []string `json:"vars"` // Variables the command expects
+}
+
+// varPattern matches {{name}} placeholders, not clashing with shell ${name}
+var varPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// List returns the global snippets and the user's own, sorted by name
+func List(username string) []Snippet {
+	lib := conf.GetLibrary()
+
+	list := make([]Snippet, 0, len(lib.Snippets)+len(lib.UserSnippets[username]))
+	for name, command := range lib.Snippets {
+		list = append(list, Snippet{Name: name, Command: command, Global: true, Vars: Vars(command)})
+	}
+	for name, command := range lib.UserSnippets[username] {
+		list = append(list, Snippet{Name: name, Command: command, Vars: Vars(command)})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == list[j].Name {
+			return !list[i].Global
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Get finds a snippet by name, the user's own snippets take precedence over global ones
+func Get(username string, name string) (Snippet, bool) {
+	lib := conf.GetLibrary()
+
+	if command, exists := lib.UserSnippets[username][name]; exists {
+		return Snippet{Name: name, Command: command, Vars: Vars(command)}, true
+	}
+	if command, exists := lib.Snippets[name]; exists {
+		return Snippet{Name: name, Command: command, Global: true, Vars: Vars(command)}, true
+	}
+	return Snippet{}, false
+}
+
+// Save creates or replaces a snippet and saves it to the config file
+func Save(username string, name string, command string, global bool) error {
+	if name == "" || command == "" {
+		return fmt.Errorf("snippet name and command are required")
+	}
+
+	err := conf.Modify(conf.Change{Author: username, Reason: describe("Save", name, global)}, func(c *conf.Config) error {
+		if global {
+			c.Library.Snippets[name] = command
+			return nil
+		}
+		if c.Library.UserSnippets[username] == nil {
+			c.Library.UserSnippets[username] = make(map[string]string)
+		}
+		c.Library.UserSnippets[username][name] = command
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a snippet and saves the config file
+func Delete(username string, name string, global bool) error {
+	err := conf.Modify(conf.Change{Author: username, Reason: describe("Delete", name, global)}, func(c *conf.Config) error {
+		if global {
+			delete(c.Library.Snippets, name)
+		} else {
+			delete(c.Library.UserSnippets[username], name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// describe words a snippet change for the config history
+func describe(action string, name string, global bool) string {
+	if global {
+		return fmt.Sprintf("%s global snippet %s", action, name)
+	}
+	return fmt.Sprintf("%s snippet %s", action, name)
+}
+
+// Vars returns the distinct variable names used by a command, in order of appearance
+func Vars(command string) []string {
+	seen := make(map[string]bool)
+	var vars []string
+	for _, match := range varPattern.FindAllStringSubmatch(command, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			vars = append(vars, match[1])
+		}
+	}
+	return vars
+}
+
+// Expand substitutes {{name}} placeholders in a command
+// Returns an error naming every variable without a value
+func Expand(command string, values map[string]string) (string, error) {
+	var missing []string
+	for _, name := range Vars(command) {
+		if _, ok := values[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing snippet variables: %s", strings.Join(missing, ", "))
+	}
+
+	return varPattern.ReplaceAllStringFunc(command, func(placeholder string) string {
+		return values[varPattern.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// Startup returns the commands to run after a shell on the host starts
+// param: host: SSH config alias of the host, see sshc.ResolveAlias
+func Startup(host string) []string {
+	return conf.GetLibrary().HostStartup[host]
+}
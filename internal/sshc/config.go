@@ -53,9 +53,108 @@ func LoadConfig(hostAlias string, configPath string) (*Host, error) {
 
 	host.IdentityFile = os.ExpandEnv(host.IdentityFile)
 
+	// SendEnv may repeat and list several patterns per line
+	sendEnv, _ := sshConfig.GetAll(hostAlias, "SendEnv")
+	for _, line := range sendEnv {
+		host.SendEnv = append(host.SendEnv, splitArgs(line)...)
+	}
+
+	// SetEnv holds NAME=value pairs, only the first occurrence of a name counts
+	host.SetEnv = make(map[string]string)
+	setEnv, _ := sshConfig.GetAll(hostAlias, "SetEnv")
+	for _, line := range setEnv {
+		for _, kv := range splitArgs(line) {
+			name, value, ok := strings.Cut(kv, "=")
+			if _, exists := host.SetEnv[name]; ok && !exists {
+				host.SetEnv[name] = value
+			}
+		}
+	}
+
 	return host, nil
 }
 
+// splitArgs splits a config value into words like ssh does, so SetEnv NAME="a b" keeps its spaces
+// Double and single quotes group words and are removed, a backslash escapes the next character outside single quotes
+func splitArgs(line string) []string {
+	var args []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args
+}
+
+// ResolveAlias finds the Host entry of the SSH config a host refers to, by its alias or its HostName,
+// so "web1" and "web1.example.com" resolve alike
+// configPath: optional path to SSH config file (empty string uses default ~/.ssh/config)
+// Returns host itself if no entry matches or the config cannot be read
+func ResolveAlias(host string, configPath string) string {
+	if configPath == "" {
+		configPath = "$HOME/.ssh/config"
+	}
+	f, err := os.Open(os.ExpandEnv(configPath))
+	if err != nil {
+		return host
+	}
+	defer f.Close()
+	sshConfig, err := ssh_config.Decode(f)
+	if err != nil {
+		return host
+	}
+
+	var byHostname string
+	for _, h := range sshConfig.Hosts {
+		for _, pattern := range h.Patterns {
+			alias := pattern.String()
+			// Wildcard and negated patterns match many hosts, they are no alias
+			if strings.ContainsAny(alias, "*?!") {
+				continue
+			}
+			if strings.EqualFold(alias, host) {
+				return alias
+			}
+			hostname, _ := sshConfig.Get(alias, "HostName")
+			if byHostname == "" && strings.EqualFold(hostname, host) {
+				byHostname = alias
+			}
+		}
+	}
+	if byHostname != "" {
+		return byHostname
+	}
+	return host
+}
+
 // saveConfig saves a Host configuration to the SSH config file
 // host: the Host struct to save
 // configPath: optional path to SSH config file (empty string uses default ~/.ssh/config)
@@ -18,6 +18,8 @@ type Host struct {
 	Hostname     string
 	IdentityFile string
 	Timeout      time.Duration
+	SendEnv      []string          // Patterns of local variables to forward
+	SetEnv       map[string]string // Variables to set on the remote side
 }
 
 type Identity struct {
@@ -126,6 +128,53 @@ func Connect(host *Host, auth []ssh.AuthMethod) (*ssh.Client, error) {
 	return client, err
 }
 
+// defaultKeepaliveCountMax matches ServerAliveCountMax of OpenSSH
+const defaultKeepaliveCountMax = 3
+
+// KeepAlive periodically sends keepalive@openssh.com requests over the connection
+// interval: time between requests, also the time allowed for each reply
+// maxMissed: consecutive unanswered requests before the connection is considered dead, 0 for the OpenSSH default of 3
+// stop: closing it ends the loop
+// Returns an error once the connection is dead, nil if stopped
+func KeepAlive(client *ssh.Client, interval time.Duration, maxMissed int, stop <-chan struct{}) error {
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepaliveCountMax
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		// SendRequest blocks until the reply arrives, which never happens on a dead link
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-stop:
+			return nil
+		case err := <-reply:
+			if err != nil {
+				return fmt.Errorf("keepalive failed: %w", err)
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= maxMissed {
+				return fmt.Errorf("no keepalive reply after %d attempts", missed)
+			}
+		}
+	}
+}
+
 func stdoutPrint(stdout io.Reader) {
 	for {
 		buffer := make([]byte, 1024)
@@ -153,7 +202,7 @@ func Client() {
 	//
 	//session, err := client.NewSession()
 	//
-	//stdin, stdout, err := setupTerminal(session, 10, 20)
+	//stdin, stdout, err := setupTerminal(session, &Terminal{Term: "xterm-256color", Rows: 10, Cols: 20})
 	//session.Shell()
 	//
 	//go stdoutPrint(stdout)
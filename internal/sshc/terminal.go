@@ -4,16 +4,89 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
-func SetupTerminal(session *ssh.Session, height int, width int) (stdin io.WriteCloser, stdout io.Reader, err error) {
+// Terminal describes the pseudo terminal requested for a session
+type Terminal struct {
+	Term string            // TERM type, e.g. xterm-256color
+	Rows int               // Initial height
+	Cols int               // Initial width
+	Env  map[string]string // Environment variables sent before the PTY is requested
+}
+
+// DefaultTerminal returns a 24x80 xterm-256color terminal without environment variables
+func DefaultTerminal() *Terminal {
+	return &Terminal{
+		Term: "xterm-256color",
+		Rows: 24,
+		Cols: 80,
+		Env:  make(map[string]string),
+	}
+}
+
+// panelEnvPrefix starts the panel's own settings, which may hold secrets and never leave the panel
+const panelEnvPrefix = "MINIMALPANEL_"
+
+// HostEnv returns the environment a host asks for in its SSH config
+// SendEnv patterns pick variables from the panel's own environment, but only those the allow patterns permit.
+// SetEnv values are taken as is
+// allow: patterns of panel variables that may be forwarded, e.g. "LANG" or "LC_*"
+func HostEnv(host *Host, allow []string) map[string]string {
+	env := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, panelEnvPrefix) || !matchAny(allow, name) {
+			continue
+		}
+		if matchAny(host.SendEnv, name) {
+			env[name] = value
+		}
+	}
+
+	for name, value := range host.SetEnv {
+		env[name] = value
+	}
+	return env
+}
+
+// matchAny reports whether name matches one of the shell patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func SetupTerminal(session *ssh.Session, term *Terminal) (stdin io.WriteCloser, stdout io.Reader, err error) {
+	// Sorted so the requests are sent in a stable order
+	names := make([]string, 0, len(term.Env))
+	for name := range term.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// Servers only accept what AcceptEnv allows, a refusal is not fatal
+		if err := session.Setenv(name, term.Env[name]); err != nil {
+			log.Printf("Server refused environment variable %s: %v", name, err)
+		}
+	}
+
 	modes := ssh.TerminalModes{
 		ssh.ECHO:          1,
 		ssh.ECHOCTL:       0,
 		ssh.TTY_OP_ISPEED: 14400,
 		ssh.TTY_OP_OSPEED: 14400,
 	}
-	err = session.RequestPty("xterm-256color", height, width, modes)
+	err = session.RequestPty(term.Term, term.Rows, term.Cols, modes)
 	if err != nil {
 		return nil, nil, fmt.Errorf("request pseudo terminal failed: %v", err)
 	}
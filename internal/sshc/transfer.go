@@ -0,0 +1,109 @@
+package sshc
+
+import "bytes"
+
+// TransferProtocol is an in-band file transfer protocol spoken over a terminal
+type TransferProtocol string
+
+const (
+	ZModem TransferProtocol = "zmodem" // rz / sz
+	Trzsz  TransferProtocol = "trzsz"  // trz / tsz
+)
+
+// TransferDirection is seen from the browser
+type TransferDirection string
+
+const (
+	Upload   TransferDirection = "upload"   // Browser sends files to the remote host
+	Download TransferDirection = "download" // Remote host sends files to the browser
+)
+
+// Transfer describes a detected file transfer handshake
+type Transfer struct {
+	Protocol  TransferProtocol
+	Direction TransferDirection
+	Offset    int // Where the handshake starts in the scanned output
+}
+
+var (
+	// ZMODEM hex header, followed by a two digit frame type
+	zmodemHeader = []byte("**\x18B")
+	// trzsz handshake, followed by R (trz), S (tsz) or D (trz -d)
+	trzszHeader = []byte("::TRZSZ:TRANSFER:")
+
+	// ZModemCancel aborts a ZMODEM transfer on the remote side
+	ZModemCancel = []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08")
+	// TrzszCancel interrupts trz and tsz, they stop on Ctrl+C in their input
+	TrzszCancel = []byte("\x03")
+)
+
+// longestHandshake is the most output DetectTransfer needs to recognize a handshake
+var longestHandshake = len(trzszHeader) + 1
+
+// Cancel returns what aborts the transfer when written to the remote side
+func (self *Transfer) Cancel() []byte {
+	if self.Protocol == ZModem {
+		return ZModemCancel
+	}
+	return TrzszCancel
+}
+
+// DetectTransfer looks for a ZMODEM or trzsz handshake in a chunk of terminal output
+// Use a TransferScanner to also find handshakes split across reads
+func DetectTransfer(output []byte) (*Transfer, bool) {
+	if i := bytes.Index(output, zmodemHeader); i >= 0 {
+		frame := output[i+len(zmodemHeader):]
+		switch {
+		case bytes.HasPrefix(frame, []byte("00")): // ZRQINIT, remote sz wants to send
+			return &Transfer{Protocol: ZModem, Direction: Download, Offset: i}, true
+		case bytes.HasPrefix(frame, []byte("01")): // ZRINIT, remote rz is ready to receive
+			return &Transfer{Protocol: ZModem, Direction: Upload, Offset: i}, true
+		}
+	}
+
+	if i := bytes.Index(output, trzszHeader); i >= 0 {
+		mode := output[i+len(trzszHeader):]
+		switch {
+		case bytes.HasPrefix(mode, []byte("S")):
+			return &Transfer{Protocol: Trzsz, Direction: Download, Offset: i}, true
+		case bytes.HasPrefix(mode, []byte("R")), bytes.HasPrefix(mode, []byte("D")):
+			return &Transfer{Protocol: Trzsz, Direction: Upload, Offset: i}, true
+		}
+	}
+
+	return nil, false
+}
+
+// TransferScanner looks for handshakes in a stream of terminal output, including ones split across reads
+type TransferScanner struct {
+	tail []byte // End of the output scanned last, too short to hold a whole handshake
+}
+
+// Scan looks for a handshake in the next chunk of output
+// Returns the output before the handshake, and if one was found the transfer and the stream from the start of
+// the handshake. A handshake that started in the previous chunk is repeated in full, its first bytes were
+// already returned as output
+func (self *TransferScanner) Scan(chunk []byte) ([]byte, *Transfer, []byte) {
+	window := chunk
+	if len(self.tail) > 0 {
+		window = append(self.tail, chunk...)
+	}
+
+	transfer, found := DetectTransfer(window)
+	if !found {
+		keep := min(len(window), longestHandshake-1)
+		self.tail = append([]byte(nil), window[len(window)-keep:]...)
+		return chunk, nil, nil
+	}
+
+	start := max(transfer.Offset-(len(window)-len(chunk)), 0)
+	rest := window[transfer.Offset:]
+	transfer.Offset = start
+	self.tail = nil
+	return chunk[:start], transfer, rest
+}
+
+// Reset forgets the output scanned so far
+func (self *TransferScanner) Reset() {
+	self.tail = nil
+}
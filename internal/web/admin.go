@@ -0,0 +1,148 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+	"minimalpanel/internal/auth"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"time"
+)
+
+// SSHSessionInfo describes a live terminal for the admin API
+type SSHSessionInfo struct {
+	Id        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Remote    string    `json:"remote"`
+	ClientIP  string    `json:"client_ip"`
+	StartedAt time.Time `json:"started_at"`
+	IdleTime  string    `json:"idle_time"`
+	BytesIn   uint64    `json:"bytes_in"`  // Read from the remote host
+	BytesOut  uint64    `json:"bytes_out"` // Written to the remote host
+	Attendees int       `json:"attendees"`
+}
+
+// TerminateRequest represents the terminate session request payload
+type TerminateRequest struct {
+	SessionId string `json:"session_id"`
+	Reason    string `json:"reason"`
+}
+
+// StartAdmin registers all administrative routes with the given mux
+func StartAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/ssh/sessions", auth.RequireAdmin(handleListSSHSessions))
+	mux.HandleFunc("/admin/ssh/terminate", auth.RequireAdmin(handleTerminateSSHSession))
+}
+
+// ListSSHSessions returns information about every live SSH session
+func ListSSHSessions() []SSHSessionInfo {
+	sessionManager.mutex.RLock()
+	defer sessionManager.mutex.RUnlock()
+
+	list := make([]SSHSessionInfo, 0, len(sessionManager.sessions))
+	for _, session := range sessionManager.sessions {
+		session.mutex.Lock()
+		attendees := len(session.attendees)
+		session.mutex.Unlock()
+
+		idle := time.Since(time.Unix(0, session.lastInput.Load()))
+		list = append(list, SSHSessionInfo{
+			Id:        session.ID,
+			Owner:     session.Owner,
+			Remote:    session.Remote,
+			ClientIP:  session.ClientIP,
+			StartedAt: session.StartedAt,
+			IdleTime:  idle.Round(time.Second).String(),
+			BytesIn:   session.bytesIn.Load(),
+			BytesOut:  session.bytesOut.Load(),
+			Attendees: attendees,
+		})
+	}
+	return list
+}
+
+// TerminateSSHSession closes the session with the given id and tells every attached browser why
+// Returns false if no such session exists
+func TerminateSSHSession(id string, reason string) bool {
+	session, exists := sessionManager.findById(id)
+	if !exists {
+		return false
+	}
+
+	// ssh_error shows the administrator's reason in the terminal itself, ssh_closed then ends it
+	session.broadcast("ssh_error", reason)
+	session.end(reason, -1)
+	return true
+}
+
+// TerminateUserSSHSessions closes every session a user owns and detaches them from sessions shared with them
+// Returns how many sessions were closed or left
+func TerminateUserSSHSessions(username string, reason string) int {
+	var owned []*SSHSession
+	var attending []*socket.Socket
+	sessionManager.mutex.RLock()
+	for _, session := range sessionManager.sessions {
+		if session.Owner == username {
+			owned = append(owned, session)
+			continue
+		}
+		session.mutex.Lock()
+		for _, attendee := range session.attendees {
+			if attendee.Username == username {
+				attending = append(attending, attendee.Socket)
+			}
+		}
+		session.mutex.Unlock()
+	}
+	sessionManager.mutex.RUnlock()
+
+	for _, session := range owned {
+		session.broadcast("ssh_error", reason)
+		session.end(reason, -1)
+	}
+	for _, client := range attending {
+		client.Emit("ssh_error", reason)
+		client.Emit("ssh_closed", map[string]interface{}{
+			"reason":      reason,
+			"exit_status": -1,
+		})
+		cleanupSession(string(client.Id()))
+	}
+	return len(owned) + len(attending)
+}
+
+// handleListSSHSessions lists all live SSH sessions
+func handleListSSHSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	netx.WriteSuccess(w, "Active SSH sessions", ListSSHSessions())
+}
+
+// handleTerminateSSHSession force-terminates an SSH session
+func handleTerminateSSHSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req TerminateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	reason := "Session terminated by an administrator"
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+
+	if !TerminateSSHSession(req.SessionId, reason) {
+		netx.WriteNotFound(w, "SSH session not found")
+		return
+	}
+
+	netx.WriteSuccess(w, "SSH session terminated", nil)
+}
@@ -0,0 +1,140 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimalpanel/internal/auth"
+	"minimalpanel/internal/conf"
+	perr "minimalpanel/internal/error"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"strconv"
+)
+
+// RollbackRequest represents the config rollback request payload
+type RollbackRequest struct {
+	Version int    `json:"version"`
+	Reason  string `json:"reason"` // Optional, recorded with the new version
+}
+
+// ConfigDiff is a unified diff between two config versions
+type ConfigDiff struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Diff string `json:"diff"` // Empty if the versions are equal
+}
+
+// StartConfig registers the config history routes with the given mux
+func StartConfig(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/config/history", auth.RequireAdmin(handleConfigHistory))
+	mux.HandleFunc("/admin/config/diff", auth.RequireAdmin(handleConfigDiff))
+	mux.HandleFunc("/admin/config/rollback", auth.RequireAdmin(handleConfigRollback))
+}
+
+// writeConfigError maps config history errors to responses
+func writeConfigError(w http.ResponseWriter, message string, err error) {
+	var problems *conf.Errors
+	switch {
+	case errors.Is(err, perr.VersionNotFound):
+		netx.WriteNotFound(w, "Version not found")
+	case errors.As(err, &problems):
+		netx.WriteError(w, http.StatusUnprocessableEntity, "Version is not a valid config", err)
+	default:
+		netx.WriteInternalServerError(w, message, err)
+	}
+}
+
+// handleConfigHistory lists the recorded config versions, newest first
+func handleConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	versions, err := conf.Versions()
+	if err != nil {
+		writeConfigError(w, "Failed to list config versions", err)
+		return
+	}
+	netx.WriteSuccess(w, "Config history", versions)
+}
+
+// handleConfigDiff compares two config versions
+// Query: to defaults to the latest version, from to the one before to
+func handleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	query := r.URL.Query()
+	to, err := versionParam(query.Get("to"))
+	if err != nil {
+		netx.WriteBadRequest(w, "Invalid version")
+		return
+	}
+	if to == 0 {
+		versions, err := conf.Versions()
+		if err != nil {
+			writeConfigError(w, "Failed to list config versions", err)
+			return
+		}
+		if len(versions) == 0 {
+			netx.WriteNotFound(w, "No config versions recorded")
+			return
+		}
+		to = versions[0].Number
+	}
+	from, err := versionParam(query.Get("from"))
+	if err != nil {
+		netx.WriteBadRequest(w, "Invalid version")
+		return
+	}
+	if from == 0 {
+		from = to - 1
+	}
+
+	diff, err := conf.Diff(from, to)
+	if err != nil {
+		writeConfigError(w, "Failed to compare config versions", err)
+		return
+	}
+	netx.WriteSuccess(w, "Config diff", ConfigDiff{From: from, To: to, Diff: diff})
+}
+
+// versionParam parses an optional version number, 0 when it is missing
+func versionParam(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version %q", value)
+	}
+	return version, nil
+}
+
+// handleConfigRollback restores a config version, validated and reloaded like an edited file
+func handleConfigRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	reason := fmt.Sprintf("Roll back to version %d", req.Version)
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+	if err := conf.Rollback(req.Version, conf.Change{Author: actor(r), Reason: reason}); err != nil {
+		writeConfigError(w, "Failed to roll back config", err)
+		return
+	}
+	netx.WriteSuccess(w, "Config rolled back", nil)
+}
@@ -5,8 +5,8 @@ import (
 	"minimalpanel/internal/auth"
 	"minimalpanel/internal/netx"
 	"minimalpanel/internal/system"
+	"net/http"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -87,7 +87,9 @@ func SetupDashboardService() {
 	dashNamespace.RegisterEvents()
 
 	// Auth - commented out for development/testing
+	dashNamespace.AddMiddleware(auth.CheckOriginSocketIO)
 	dashNamespace.AddMiddleware(auth.RequireAuthSocketIO)
+	dashNamespace.AddMiddleware(auth.RequireScopeSocketIO(auth.ScopeMetricsRead))
 }
 
 // handleDashboardConnect handles dashboard connection requests
@@ -279,22 +281,8 @@ func startPeriodicUpdates(session *DashboardSession) {
 
 // getUsernameFromSocket extracts username from socket authentication
 func getUsernameFromSocket(client *socket.Socket) string {
-	// Try to get username from cookie (if auth is enabled)
-	cookieHeader := client.Handshake().Headers["Cookie"]
-	if cookieHeader != nil {
-		if cookieSlice, ok := cookieHeader.([]string); ok && len(cookieSlice) > 0 {
-			cookies := cookieSlice[0]
-			parts := strings.Split(cookies, ";")
-			for _, p := range parts {
-				p = strings.TrimSpace(p)
-				if strings.HasPrefix(p, auth.CookieName+"=") {
-					token := strings.TrimPrefix(p, auth.CookieName+"=")
-					if username, valid := auth.ValidateSession(token); valid {
-						return username
-					}
-				}
-			}
-		}
+	if principal, ok := auth.SocketPrincipal(client); ok {
+		return principal.Username
 	}
 	return "Administrator" // Default fallback
 }
@@ -392,6 +380,26 @@ func cleanupDashboardSession(clientId string) {
 	fmt.Printf("Dashboard client disconnected: %s\n", clientId)
 }
 
+// StartMetrics registers the metrics API route with the given mux
+func StartMetrics(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", auth.RequireScope(auth.ScopeMetricsRead, handleMetrics))
+}
+
+// handleMetrics serves current system metrics as JSON
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	metrics, err := collectSystemMetrics()
+	if err != nil {
+		netx.WriteInternalServerError(w, "Failed to collect system metrics", err)
+		return
+	}
+	netx.WriteSuccess(w, "System metrics", metrics)
+}
+
 // StartDashboard starts the dashboard service (deprecated - use SetupDashboardService instead)
 func StartDashboard() {
 	SetupDashboardService()
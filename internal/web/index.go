@@ -2,10 +2,8 @@ package web
 
 import (
 	"minimalpanel/internal/auth"
-	"minimalpanel/internal/conf"
 	"minimalpanel/internal/netx"
 	"net/http"
-	"path/filepath"
 )
 
 // StartIndex registers index/dashboard routes with the given mux
@@ -20,5 +18,5 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, filepath.Join(conf.GetWeb().RootPath, "index.html"))
+	serveFrontend(w, r, "index.html")
 }
@@ -2,7 +2,9 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"minimalpanel/internal/auth"
+	perr "minimalpanel/internal/error"
 	"minimalpanel/internal/netx"
 	"net/http"
 )
@@ -11,6 +13,7 @@ import (
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Remember bool   `json:"remember"` // Keep the login across browser restarts
 }
 
 // StartLogin registers all login-related routes with the given mux
@@ -19,6 +22,14 @@ func StartLogin(mux *http.ServeMux) {
 	mux.HandleFunc("/login", handleLogin)
 	mux.HandleFunc("/logout", handleLogout)
 	mux.HandleFunc("/check-auth", handleCheckAuth)
+	mux.HandleFunc("/login/methods", handleLoginMethods)
+}
+
+// LoginMethods tells the login page which ways of signing in are available
+type LoginMethods struct {
+	Password bool `json:"password"`
+	OIDC     bool `json:"oidc"`
+	Passkey  bool `json:"passkey"`
 }
 
 // handleLogin processes login requests
@@ -34,16 +45,28 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify credentials using user.go functions
-	if !auth.VerifyPassword(loginReq.Username, loginReq.Password) {
+	// Backends may name the user differently than they logged in, e.g. with a prefix
+	username, valid := auth.VerifyPassword(loginReq.Username, loginReq.Password)
+	if !valid {
 		netx.WriteUnauthorized(w, "Invalid username or password")
 		return
 	}
 
+	// Users with a registered authenticator must also present it
+	if auth.PasskeyRequired(username) {
+		id, options, err := auth.BeginPasskeyLogin(r, username, loginReq.Remember)
+		if err != nil {
+			netx.WriteInternalServerError(w, "Failed to start passkey login", err)
+			return
+		}
+		netx.WriteSuccess(w, "Security key required", PasskeyChallenge{Id: id, Options: options, SecondFactor: true})
+		return
+	}
+
 	// Create session using cookie.go functions
-	token, err := auth.CreateSession(loginReq.Username)
+	token, err := auth.CreateSession(username, loginReq.Remember, r)
 	if err != nil {
-		netx.WriteInternalServerError(w, "Failed to create session", err)
+		writeSessionError(w, err)
 		return
 	}
 
@@ -51,7 +74,16 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	auth.SetCookie(w, token)
 
 	// Return both cookie (for browser) and token (for frontend token-based auth)
-	netx.WriteAuthSuccessWithToken(w, "Login successful", loginReq.Username, token)
+	netx.WriteAuthSuccessWithToken(w, "Login successful", username, token)
+}
+
+// writeSessionError answers a failed auth.CreateSession
+func writeSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, perr.AccessDenied) {
+		netx.WriteForbidden(w, "Login from this address is not allowed")
+		return
+	}
+	netx.WriteInternalServerError(w, "Failed to create session", err)
 }
 
 // handleLogout processes logout requests
@@ -87,5 +119,20 @@ func handleCheckAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auth.RefreshCookie(w, r)
 	netx.WriteAuthSuccess(w, "Authenticated", username)
 }
+
+// handleLoginMethods lists the available login methods
+func handleLoginMethods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	netx.WriteSuccess(w, "Login methods", LoginMethods{
+		Password: true,
+		OIDC:     auth.OIDCEnabled(),
+		Passkey:  true,
+	})
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"errors"
+	"minimalpanel/internal/auth"
+	perr "minimalpanel/internal/error"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"net/url"
+)
+
+// StartOIDC registers the single sign-on routes with the given mux
+func StartOIDC(mux *http.ServeMux) {
+	mux.HandleFunc("/oidc/login", handleOIDCLogin)
+	mux.HandleFunc("/oidc/callback", handleOIDCCallback)
+}
+
+// handleOIDCLogin sends the browser to the provider
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+	if !auth.OIDCEnabled() {
+		netx.WriteNotFound(w, "Single sign-on is not configured")
+		return
+	}
+
+	target, err := auth.OIDCLoginURL(w, r, r.URL.Query().Get("remember") == "true")
+	if err != nil {
+		netx.WriteInternalServerError(w, "Failed to start single sign-on", err)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback completes the login when the provider sends the browser back
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		if description := query.Get("error_description"); description != "" {
+			reason = description
+		}
+		loginFailed(w, r, "Single sign-on failed: "+reason)
+		return
+	}
+
+	username, remember, err := auth.OIDCLogin(w, r)
+	if err != nil {
+		loginFailed(w, r, "Single sign-on failed: "+err.Error())
+		return
+	}
+
+	token, err := auth.CreateSession(username, remember, r)
+	if errors.Is(err, perr.AccessDenied) {
+		loginFailed(w, r, "Login from this address is not allowed")
+		return
+	} else if err != nil {
+		loginFailed(w, r, "Failed to create session")
+		return
+	}
+	auth.SetCookie(w, token)
+	http.Redirect(w, r, netx.Path("/"), http.StatusFound)
+}
+
+// loginFailed sends the browser back to the login page, which shows the message
+func loginFailed(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, netx.Path("/pages/login.html")+"?error="+url.QueryEscape(message), http.StatusFound)
+}
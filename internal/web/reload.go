@@ -0,0 +1,19 @@
+package web
+
+import (
+	"log"
+	"minimalpanel/internal/conf"
+)
+
+// ConfigChanged brings the web state in line with a new config, register it with conf.Subscribe
+func ConfigChanged(old conf.Config, new conf.Config) {
+	// A removed user must not keep terminals open, whether deleted here, from the command line or in the file
+	for name := range old.Auth.Users {
+		if _, exists := new.Auth.Users[name]; exists {
+			continue
+		}
+		if closed := TerminateUserSSHSessions(name, "user deleted"); closed > 0 {
+			log.Printf("User %s removed from the config, %d SSH sessions closed", name, closed)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"encoding/json"
+	"minimalpanel/internal/auth"
+	"minimalpanel/internal/netx"
+	"net/http"
+)
+
+// RevokeSessionRequest represents the revoke login session request payload
+type RevokeSessionRequest struct {
+	Id string `json:"id"`
+}
+
+// StartSessions registers all login session routes with the given mux
+func StartSessions(mux *http.ServeMux) {
+	mux.HandleFunc("/sessions", auth.RequireAuthAPI(handleListSessions))
+	mux.HandleFunc("/sessions/revoke", auth.RequireAuthAPI(handleRevokeSession))
+}
+
+// handleListSessions lists the user's login sessions, admins may pass ?all=true for every user's
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if r.URL.Query().Get("all") == "true" {
+		if !auth.IsAdmin(username) {
+			netx.WriteForbidden(w, "Administrator privileges required")
+			return
+		}
+		username = ""
+	}
+
+	token, _ := auth.GetSessionToken(r)
+	netx.WriteSuccess(w, "Sessions", auth.ListSessions(username, token))
+}
+
+// handleRevokeSession logs out one of the user's sessions, admins may revoke any session
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req RevokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Id == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	owner := username
+	if auth.IsAdmin(username) {
+		owner = ""
+	}
+
+	if !auth.RevokeSession(req.Id, owner) {
+		netx.WriteNotFound(w, "Session not found")
+		return
+	}
+	netx.WriteSuccess(w, "Session revoked", nil)
+}
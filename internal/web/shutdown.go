@@ -0,0 +1,83 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Shutdown tells every connected browser that the panel is going away, closes all SSH sessions
+// and stops the dashboard updates
+// SSH sessions cannot move to another process, so on a restart they stay open until they end
+// or ctx is done, then they are closed like on a shutdown
+// param: ctx: deadline for open SSH sessions, Web.ShutdownTimeout
+// param: restarting: a new process takes over, dashboards reconnect to it on their own
+func Shutdown(ctx context.Context, restarting bool) {
+	reason := "panel is shutting down"
+	if restarting {
+		reason = "panel is restarting"
+	}
+
+	dashboardManager.mutex.RLock()
+	dashboards := make(map[string]*DashboardSession, len(dashboardManager.sessions))
+	for id, session := range dashboardManager.sessions {
+		dashboards[id] = session
+	}
+	dashboardManager.mutex.RUnlock()
+
+	for id, session := range dashboards {
+		session.Socket.Emit("server_shutdown", map[string]interface{}{
+			"reason":     reason,
+			"restarting": restarting,
+		})
+		cleanupDashboardSession(id)
+	}
+
+	if restarting {
+		drainSSHSessions(ctx)
+	}
+
+	// Attendees are told by end as well, then the remote shells are closed
+	for _, session := range listSSHSessions() {
+		session.end(reason, -1)
+	}
+}
+
+// drainSSHSessions warns open terminals that the panel restarted and waits until they are closed or ctx is done
+func drainSSHSessions(ctx context.Context) {
+	sessions := listSSHSessions()
+	if len(sessions) == 0 {
+		return
+	}
+
+	message := "Panel restarted, this terminal keeps running on the old process until it is closed"
+	if deadline, ok := ctx.Deadline(); ok {
+		message = fmt.Sprintf("Panel restarted, this terminal will be closed in %s, open a new one to continue",
+			time.Until(deadline).Round(time.Second))
+	}
+	for _, session := range sessions {
+		session.broadcast("ssh_error", message)
+	}
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for len(listSSHSessions()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listSSHSessions returns a snapshot of the live SSH sessions
+func listSSHSessions() []*SSHSession {
+	sessionManager.mutex.RLock()
+	defer sessionManager.mutex.RUnlock()
+
+	sessions := make([]*SSHSession, 0, len(sessionManager.sessions))
+	for _, session := range sessionManager.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"minimalpanel/internal/auth"
+	"minimalpanel/internal/netx"
+	"minimalpanel/internal/snippet"
+	"net/http"
+	"time"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// SnippetRequest represents the save/delete snippet request payload
+type SnippetRequest struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	Global  bool   `json:"global"`
+}
+
+// StartSnippets registers all snippet routes with the given mux
+func StartSnippets(mux *http.ServeMux) {
+	mux.HandleFunc("/snippets", auth.RequireAuthAPI(handleListSnippets))
+	mux.HandleFunc("/snippets/save", auth.RequireAuthAPI(handleSaveSnippet))
+	mux.HandleFunc("/snippets/delete", auth.RequireAuthAPI(handleDeleteSnippet))
+}
+
+// handleListSnippets lists the global snippets and the user's own
+func handleListSnippets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	netx.WriteSuccess(w, "Snippets", snippet.List(username))
+}
+
+// decodeSnippetRequest parses a snippet request, only admins may touch global snippets
+func decodeSnippetRequest(w http.ResponseWriter, r *http.Request) (string, *SnippetRequest, bool) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return "", nil, false
+	}
+
+	var req SnippetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return "", nil, false
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if req.Global && !auth.IsAdmin(username) {
+		netx.WriteForbidden(w, "Administrator privileges required for global snippets")
+		return "", nil, false
+	}
+	return username, &req, true
+}
+
+// handleSaveSnippet creates or replaces a snippet
+func handleSaveSnippet(w http.ResponseWriter, r *http.Request) {
+	username, req, ok := decodeSnippetRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := snippet.Save(username, req.Name, req.Command, req.Global); err != nil {
+		netx.WriteInternalServerError(w, "Failed to save snippet", err)
+		return
+	}
+	netx.WriteSuccess(w, "Snippet saved", nil)
+}
+
+// handleDeleteSnippet removes a snippet
+func handleDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	username, req, ok := decodeSnippetRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := snippet.Delete(username, req.Name, req.Global); err != nil {
+		netx.WriteInternalServerError(w, "Failed to delete snippet", err)
+		return
+	}
+	netx.WriteSuccess(w, "Snippet deleted", nil)
+}
+
+// handleRunSnippet types a saved snippet into the session, substituting its variables
+func handleRunSnippet(client *socket.Socket, data ...any) {
+	runData, ok := eventData(data...)
+	if !ok {
+		client.Emit("ssh_error", "Invalid snippet data format")
+		return
+	}
+
+	session, permission, exists := sessionManager.lookup(string(client.Id()))
+	if !exists || !session.active {
+		client.Emit("ssh_error", "No active SSH session")
+		return
+	}
+	if permission != ShareReadWrite {
+		client.Emit("ssh_error", "Read-only access to shared session")
+		return
+	}
+	if !allowsHost(client, session.Host) {
+		return
+	}
+
+	name, _ := runData["name"].(string)
+	saved, found := snippet.Get(getUsernameFromSocket(client), name)
+	if !found {
+		client.Emit("ssh_error", fmt.Sprintf("Snippet not found: %s", name))
+		return
+	}
+
+	values := make(map[string]string)
+	if vars, ok := runData["vars"].(map[string]interface{}); ok {
+		for k, v := range vars {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+
+	command, err := snippet.Expand(saved.Command, values)
+	if err != nil {
+		client.Emit("ssh_error", err.Error())
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.Stdin != nil {
+		n, err := session.Stdin.Write([]byte(command + "\r"))
+		session.bytesOut.Add(uint64(n))
+		session.lastInput.Store(time.Now().UnixNano())
+		if err != nil {
+			client.Emit("ssh_error", "Failed to send input")
+		}
+	}
+}
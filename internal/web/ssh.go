@@ -1,39 +1,61 @@
 package web
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"minimalpanel/internal/auth"
+	"minimalpanel/internal/conf"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zishang520/socket.io/servers/socket/v3"
 	"golang.org/x/crypto/ssh"
 	"minimalpanel/internal/netx"
+	"minimalpanel/internal/snippet"
 	"minimalpanel/internal/sshc"
 )
 
 // SSHSession represents an active SSH session with its connections
 type SSHSession struct {
-	Client  *ssh.Client
-	Session *ssh.Session
-	Stdin   io.WriteCloser
-	Stdout  io.Reader
-	Socket  *socket.Socket
-	mutex   sync.Mutex
-	active  bool
+	ID           string // Public id used by attendees to join
+	Owner        string // Panel user who opened the session
+	Client       *ssh.Client
+	Session      *ssh.Session
+	Stdin        io.WriteCloser
+	Stdout       io.Reader
+	Socket       *socket.Socket
+	ClientIP     string                     // Address of the owner's browser
+	Remote       string                     // user@host:port of the SSH server
+	Host         string                     // Host as the owner asked for it, token scopes are checked against it
+	StartedAt    time.Time                  // When the shell was started
+	params       connectParams              // Replayed on automatic reconnect, empty if reconnect is disabled
+	lastInput    atomic.Int64               // Unix nano of the last terminal input
+	bytesIn      atomic.Uint64              // Bytes read from the remote host
+	bytesOut     atomic.Uint64              // Bytes written to the remote host
+	attendees    map[string]*Attendee       // Attached sockets keyed by client id
+	invites      map[string]SharePermission // Invited panel users
+	transfer     *sshc.Transfer             // Active file transfer, nil in terminal mode
+	scanner      sshc.TransferScanner       // Finds transfer handshakes in the output, used by the output pump only
+	transferSeen atomic.Int64               // Unix nano of the last transfer data in either direction
+	mutex        sync.Mutex
+	active       bool
 }
 
 // SSHSessionManager manages multiple SSH sessions
 type SSHSessionManager struct {
-	sessions map[string]*SSHSession
-	mutex    sync.RWMutex
+	sessions  map[string]*SSHSession // Keyed by owner client id
+	attendees map[string]*SSHSession // Keyed by attendee client id
+	dialing   map[string]int         // Sessions being established, keyed by owner
+	mutex     sync.RWMutex
 }
 
 var sessionManager = &SSHSessionManager{
-	sessions: make(map[string]*SSHSession),
+	sessions:  make(map[string]*SSHSession),
+	attendees: make(map[string]*SSHSession),
+	dialing:   make(map[string]int),
 }
 
 // SetupSSHService sets up the SSH socket.io namespace on the global server
@@ -50,15 +72,52 @@ func SetupSSHService() {
 	// Handle window resize
 	sshNamespace.AddEvent("resize", handleWindowResize)
 
+	// Handle saved command snippets
+	sshNamespace.AddEvent("run_snippet", handleRunSnippet)
+
+	// Handle rz/sz and trz/tsz file transfers
+	sshNamespace.AddEvent("transfer_input", handleTransferInput)
+	sshNamespace.AddEvent("transfer_end", handleTransferEnd)
+
+	// Handle session sharing
+	sshNamespace.AddEvent("share_ssh", handleShareSSH)
+	sshNamespace.AddEvent("join_ssh", handleJoinSSH)
+	sshNamespace.AddEvent("list_attendees", handleListAttendees)
+	sshNamespace.AddEvent("kick_attendee", handleKickAttendee)
+
 	// Handle disconnect (standard Socket.IO event)
 	sshNamespace.AddEvent("disconnect", handleSSHDisconnect)
 
 	sshNamespace.RegisterEvents()
 
 	// Auth
+	sshNamespace.AddMiddleware(auth.CheckOriginSocketIO)
 	sshNamespace.AddMiddleware(auth.RequireAuthSocketIO)
 }
 
+// connectParams holds the connect_ssh parameters, kept so the session can be re-established
+type connectParams struct {
+	Host       string
+	Port       string
+	Username   string
+	Password   string
+	PrivateKey string
+	Passphrase string
+	Term       string            // TERM type, empty for the default
+	Rows       int               // Initial height, 0 for the default
+	Cols       int               // Initial width, 0 for the default
+	Env        map[string]string // Overrides the host's SendEnv/SetEnv variables
+}
+
+// sshConnection bundles the pieces of an established remote shell
+type sshConnection struct {
+	host    *sshc.Host
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
 // handleSSHConnect handles SSH connection requests
 func handleSSHConnect(client *socket.Socket, data ...any) {
 
@@ -86,22 +145,116 @@ func handleSSHConnect(client *socket.Socket, data ...any) {
 	}
 
 	// Extract connection parameters
-	host, _ := connData["host"].(string)
-	port, _ := connData["port"].(string)
-	username, _ := connData["username"].(string)
-	password, _ := connData["password"].(string)
-	privateKey, _ := connData["privateKey"].(string)
-	passphrase, _ := connData["passphrase"].(string)
-
-	if host == "" || username == "" {
+	params := connectParams{}
+	params.Host, _ = connData["host"].(string)
+	params.Port, _ = connData["port"].(string)
+	params.Username, _ = connData["username"].(string)
+	params.Password, _ = connData["password"].(string)
+	params.PrivateKey, _ = connData["privateKey"].(string)
+	params.Passphrase, _ = connData["passphrase"].(string)
+	params.Term, _ = connData["term"].(string)
+	rows, _ := connData["rows"].(float64)
+	cols, _ := connData["cols"].(float64)
+	params.Rows, params.Cols = int(rows), int(cols)
+	params.Env = make(map[string]string)
+	if env, ok := connData["env"].(map[string]interface{}); ok {
+		for name, value := range env {
+			if name != "" {
+				params.Env[name] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	if params.Host == "" || params.Username == "" {
 		client.Emit("ssh_error", "Host and username are required")
 		return
 	}
 
-	if port == "" {
-		port = "22"
+	if params.Port == "" {
+		params.Port = "22"
+	}
+
+	// One socket drives one terminal, a second session would be lost track of
+	clientId := string(client.Id())
+	if _, _, attached := sessionManager.lookup(clientId); attached {
+		client.Emit("ssh_error", "Client is already attached to an SSH session")
+		return
+	}
+
+	if !allowsHost(client, params.Host) {
+		return
+	}
+
+	// Claim the slot before dialing, so parallel requests cannot exceed the limit
+	owner := getUsernameFromSocket(client)
+	if limit := conf.GetTerminal().MaxUserSessions; !sessionManager.reserveSession(owner, limit) {
+		client.Emit("ssh_error", fmt.Sprintf("Concurrent session limit reached (%d)", limit))
+		return
+	}
+
+	conn, err := dialSSH(params)
+	if err != nil {
+		sessionManager.release(owner)
+		client.Emit("ssh_error", err.Error())
+		return
+	}
+
+	sessionId, err := auth.GenerateToken()
+	if err != nil {
+		sessionManager.release(owner)
+		conn.close()
+		client.Emit("ssh_error", fmt.Sprintf("Failed to create session id: %v", err))
+		return
 	}
 
+	// Create SSH session object
+	sshSession := &SSHSession{
+		ID:        sessionId[:16],
+		Owner:     owner,
+		Socket:    client,
+		ClientIP:  netx.ClientIP(client.Request().Request()),
+		Remote:    conn.host.User + "@" + net.JoinHostPort(conn.host.Hostname, conn.host.Port),
+		Host:      params.Host,
+		StartedAt: time.Now(),
+		attendees: make(map[string]*Attendee),
+		invites:   make(map[string]SharePermission),
+		active:    true,
+	}
+	// Credentials stay in memory only as long as a reconnect may need them
+	if conf.GetTerminal().ReconnectAttempts > 0 {
+		sshSession.params = params
+	}
+	sshSession.attach(conn)
+	sshSession.lastInput.Store(sshSession.StartedAt.UnixNano())
+
+	// Store session, unless the socket connected or joined elsewhere while dialing
+	if !sessionManager.store(clientId, sshSession) {
+		conn.close()
+		client.Emit("ssh_error", "Client is already attached to an SSH session")
+		return
+	}
+
+	// Enforce idle timeout and max duration
+	go watchSession(sshSession)
+
+	// Pump output and watch the connection until it ends
+	go sshSession.run(conn)
+
+	// Emit connection success
+	client.Emit("ssh_connected", map[string]interface{}{
+		"host":       params.Host,
+		"port":       params.Port,
+		"user":       params.Username,
+		"session_id": sshSession.ID,
+	})
+
+}
+
+// dialSSH connects to the host and starts an interactive shell
+func dialSSH(params connectParams) (*sshConnection, error) {
+	host, port, username := params.Host, params.Port, params.Username
+	password, privateKey, passphrase := params.Password, params.PrivateKey, params.Passphrase
+
 	// Try to load SSH config for the host alias first
 	var hostConfig *sshc.Host
 
@@ -149,8 +302,7 @@ func handleSSHConnect(client *socket.Socket, data ...any) {
 
 		keyAuthMethods, err := sshc.LoadAuth("", identities)
 		if err != nil {
-			client.Emit("ssh_error", fmt.Sprintf("Failed to load private key authentication: %v", err))
-			return
+			return nil, fmt.Errorf("Failed to load private key authentication: %v", err)
 		}
 		authMethods = append(authMethods, keyAuthMethods...)
 	} else if hostConfig.IdentityFile != "" {
@@ -191,32 +343,40 @@ func handleSSHConnect(client *socket.Socket, data ...any) {
 	}
 
 	if len(authMethods) == 0 {
-		client.Emit("ssh_error", "No valid authentication method provided. Please provide either a password or a valid private key.")
-		return
+		return nil, fmt.Errorf("No valid authentication method provided. Please provide either a password or a valid private key.")
 	}
 
 	// Connect to SSH server
 	sshClient, err := sshc.Connect(hostConfig, authMethods)
 	if err != nil {
-		client.Emit("ssh_error", fmt.Sprintf("SSH connection failed: %v", err))
-		return
+		return nil, fmt.Errorf("SSH connection failed: %v", err)
 	}
 
 	// Create SSH session
 	session, err := sshClient.NewSession()
 	if err != nil {
 		sshClient.Close()
-		client.Emit("ssh_error", fmt.Sprintf("Failed to create SSH session: %v", err))
-		return
+		return nil, fmt.Errorf("Failed to create SSH session: %v", err)
 	}
 
-	// Setup terminal
-	stdin, stdout, err := sshc.SetupTerminal(session, 24, 80)
+	// Setup terminal, request values win over the host's SSH config
+	terminal := sshc.DefaultTerminal()
+	terminal.Env = sshc.HostEnv(hostConfig, conf.GetTerminal().ForwardEnv)
+	for name, value := range params.Env {
+		terminal.Env[name] = value
+	}
+	if params.Term != "" {
+		terminal.Term = params.Term
+	}
+	if params.Rows > 0 && params.Cols > 0 {
+		terminal.Rows, terminal.Cols = params.Rows, params.Cols
+	}
+
+	stdin, stdout, err := sshc.SetupTerminal(session, terminal)
 	if err != nil {
 		session.Close()
 		sshClient.Close()
-		client.Emit("ssh_error", fmt.Sprintf("Failed to setup terminal: %v", err))
-		return
+		return nil, fmt.Errorf("Failed to setup terminal: %v", err)
 	}
 
 	// Start shell
@@ -224,51 +384,63 @@ func handleSSHConnect(client *socket.Socket, data ...any) {
 	if err != nil {
 		session.Close()
 		sshClient.Close()
-		client.Emit("ssh_error", fmt.Sprintf("Failed to start shell: %v", err))
-		return
+		return nil, fmt.Errorf("Failed to start shell: %v", err)
 	}
 
-	// Create SSH session object
-	sshSession := &SSHSession{
-		Client:  sshClient,
-		Session: session,
-		Stdin:   stdin,
-		Stdout:  stdout,
-		Socket:  client,
-		active:  true,
+	// Run the host's startup commands, kept by SSH config alias whichever name was typed
+	for _, command := range snippet.Startup(sshc.ResolveAlias(host, "")) {
+		if _, err := stdin.Write([]byte(command + "\r")); err != nil {
+			session.Close()
+			sshClient.Close()
+			return nil, fmt.Errorf("Failed to run startup command: %v", err)
+		}
 	}
 
-	// Store session
-	sessionManager.mutex.Lock()
-	sessionManager.sessions[string(client.Id())] = sshSession
-	sessionManager.mutex.Unlock()
-
-	// Start reading from stdout
-	go func() {
+	return &sshConnection{
+		host:    hostConfig,
+		client:  sshClient,
+		session: session,
+		stdin:   stdin,
+		stdout:  stdout,
+	}, nil
+}
 
-		reader := bufio.NewReader(stdout)
-		buffer := make([]byte, 1024)
+// close tears down the shell and its connection
+func (self *sshConnection) close() {
+	if self.stdin != nil {
+		self.stdin.Close()
+	}
+	if self.session != nil {
+		self.session.Close()
+	}
+	if self.client != nil {
+		self.client.Close()
+	}
+}
 
-		for sshSession.active {
-			n, err := reader.Read(buffer)
-			if err != nil {
-				break
-			}
+// attach makes conn the session's current connection
+// Returns false if the session was closed in the meantime
+func (self *SSHSession) attach(conn *sshConnection) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 
-			if n > 0 {
-				data := string(buffer[:n])
-				client.Emit("terminal_output", data)
-			}
-		}
-	}()
-
-	// Emit connection success
-	client.Emit("ssh_connected", map[string]interface{}{
-		"host": host,
-		"port": port,
-		"user": username,
-	})
+	if !self.active {
+		return false
+	}
+	self.Client = conn.client
+	self.Session = conn.session
+	self.Stdin = conn.stdin
+	self.Stdout = conn.stdout
+	self.transfer = nil
+	self.scanner.Reset()
+	return true
+}
 
+// isActive reports whether the session is still open
+func (self *SSHSession) isActive() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.active
 }
 
 // handleTerminalInput handles input from the terminal
@@ -291,20 +463,35 @@ func handleTerminalInput(client *socket.Socket, data ...any) {
 		return
 	}
 
-	sessionManager.mutex.RLock()
-	session, exists := sessionManager.sessions[string(client.Id())]
-	sessionManager.mutex.RUnlock()
-
+	session, permission, exists := sessionManager.lookup(string(client.Id()))
 	if !exists || !session.active {
 		client.Emit("ssh_error", "No active SSH session")
 		return
 	}
 
+	if permission != ShareReadWrite {
+		client.Emit("ssh_error", "Read-only access to shared session")
+		return
+	}
+
+	session.mutex.Lock()
+	transferring := session.transfer != nil
+	session.mutex.Unlock()
+	if transferring {
+		// Keystrokes would corrupt the transfer, Ctrl+C is the way back to the terminal
+		if strings.Contains(input, "\x03") {
+			session.endTransfer(true, "interrupted")
+		}
+		return
+	}
+
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
 	if session.Stdin != nil {
-		_, err := session.Stdin.Write([]byte(input))
+		n, err := session.Stdin.Write([]byte(input))
+		session.bytesOut.Add(uint64(n))
+		session.lastInput.Store(time.Now().UnixNano())
 		if err != nil {
 			client.Emit("ssh_error", "Failed to send input")
 		}
@@ -334,11 +521,8 @@ func handleWindowResize(client *socket.Socket, data ...any) {
 	cols, _ := resizeData["cols"].(float64)
 	rows, _ := resizeData["rows"].(float64)
 
-	sessionManager.mutex.RLock()
-	session, exists := sessionManager.sessions[string(client.Id())]
-	sessionManager.mutex.RUnlock()
-
-	if !exists || !session.active {
+	session, permission, exists := sessionManager.lookup(string(client.Id()))
+	if !exists || !session.active || permission != ShareReadWrite {
 		return
 	}
 
@@ -348,6 +532,11 @@ func handleWindowResize(client *socket.Socket, data ...any) {
 	if session.Session != nil {
 		session.Session.WindowChange(int(rows), int(cols))
 	}
+
+	// Reconnects come back with the current size
+	if rows > 0 && cols > 0 {
+		session.params.Rows, session.params.Cols = int(rows), int(cols)
+	}
 }
 
 // handleSSHDisconnect handles SSH disconnection
@@ -355,32 +544,75 @@ func handleSSHDisconnect(client *socket.Socket, data ...any) {
 	cleanupSession(string(client.Id()))
 }
 
-// cleanupSession cleans up an SSH session
+// cleanupSession detaches a client from the session it attends and closes the session it owns
 func cleanupSession(clientId string) {
 	sessionManager.mutex.Lock()
-	defer sessionManager.mutex.Unlock()
+	shared, isAttendee := sessionManager.attendees[clientId]
+	if isAttendee {
+		delete(sessionManager.attendees, clientId)
+		shared.mutex.Lock()
+		delete(shared.attendees, clientId)
+		shared.mutex.Unlock()
+	}
+	session, owns := sessionManager.sessions[clientId]
+	sessionManager.mutex.Unlock()
 
-	session, exists := sessionManager.sessions[clientId]
-	if !exists {
-		return
+	// Attendees only detach, the session keeps running for its owner
+	if isAttendee {
+		shared.notifyAttendees()
 	}
+	if owns {
+		session.close()
+	}
+}
 
-	session.mutex.Lock()
-	session.active = false
-	session.mutex.Unlock()
+// close stops the session, detaches everyone who was watching and closes the connection
+// The manager only forgets it while it is still the session registered for its socket
+func (self *SSHSession) close() {
+	sessionManager.mutex.Lock()
+	defer sessionManager.mutex.Unlock()
 
-	// Close connections
-	if session.Stdin != nil {
-		session.Stdin.Close()
+	clientId := string(self.Socket.Id())
+	if sessionManager.sessions[clientId] == self {
+		delete(sessionManager.sessions, clientId)
 	}
-	if session.Session != nil {
-		session.Session.Close()
+
+	self.mutex.Lock()
+	if !self.active {
+		self.mutex.Unlock()
+		return
 	}
-	if session.Client != nil {
-		session.Client.Close()
+	self.active = false
+	self.params = connectParams{}
+	attendees := self.attendees
+	self.attendees = make(map[string]*Attendee)
+	conn := &sshConnection{
+		client:  self.Client,
+		session: self.Session,
+		stdin:   self.Stdin,
 	}
+	self.mutex.Unlock()
 
-	delete(sessionManager.sessions, clientId)
+	for id, attendee := range attendees {
+		if sessionManager.attendees[id] == self {
+			delete(sessionManager.attendees, id)
+		}
+		attendee.Socket.Emit("ssh_closed", map[string]interface{}{
+			"reason":      "shared session has ended",
+			"exit_status": -1,
+		})
+	}
+
+	conn.close()
+}
+
+// allowsHost checks that a token authenticated client may use terminals on a host, and tells it if not
+func allowsHost(client *socket.Socket, host string) bool {
+	if principal, ok := auth.SocketPrincipal(client); ok && !principal.AllowsHost(host) {
+		client.Emit("ssh_error", fmt.Sprintf("Token does not allow terminals on %s", host))
+		return false
+	}
+	return true
 }
 
 // StartSSH starts the SSH service (deprecated - use SetupSSHService instead)
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/sshc"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxReconnectDelay caps the exponential backoff between reconnect attempts
+const maxReconnectDelay = 30 * time.Second
+
+// run pumps the output of conn to the browsers until the connection ends,
+// then reconnects or tells the browsers why the session closed
+func (self *SSHSession) run(conn *sshConnection) {
+	for {
+		lost := self.pump(conn)
+		if !self.isActive() {
+			// Closed by the panel (disconnect, terminate, timeout)
+			return
+		}
+
+		if lost == nil {
+			status, err := exitStatus(conn.session.Wait())
+			if err == nil {
+				self.end("exit", status)
+				return
+			}
+			lost = err
+		}
+
+		conn.close()
+		next, ok := self.reconnect(lost)
+		if !ok {
+			self.end(fmt.Sprintf("connection lost: %v", lost), -1)
+			return
+		}
+		conn = next
+	}
+}
+
+// pump forwards output while keepalives watch the link
+// Returns the keepalive error if the connection was found dead, nil if output simply ended
+func (self *SSHSession) pump(conn *sshConnection) error {
+	stop := make(chan struct{})
+	dead := make(chan error, 1)
+
+	limits := conf.GetTerminal()
+	if limits.KeepaliveInterval > 0 {
+		go func() {
+			if err := sshc.KeepAlive(conn.client, limits.KeepaliveInterval, limits.KeepaliveCountMax, stop); err != nil {
+				dead <- err
+				// Unblock the reader below
+				conn.client.Close()
+			}
+		}()
+	}
+
+	reader := bufio.NewReader(conn.stdout)
+	buffer := make([]byte, 1024)
+
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			self.bytesIn.Add(uint64(n))
+			self.output(buffer[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+
+	select {
+	case err := <-dead:
+		return err
+	default:
+		return nil
+	}
+}
+
+// exitStatus interprets the result of session.Wait
+// Returns an error if the shell did not exit but lost its connection
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+
+	var missingErr *ssh.ExitMissingError
+	if errors.As(err, &missingErr) {
+		return -1, errors.New("remote closed the connection without an exit status")
+	}
+	return -1, err
+}
+
+// reconnect replays the connect_ssh parameters with exponential backoff
+// Returns false if reconnect is disabled, every attempt failed or the session was closed meanwhile
+func (self *SSHSession) reconnect(cause error) (*sshConnection, bool) {
+	attempts := conf.GetTerminal().ReconnectAttempts
+	delay := time.Second
+
+	// Without reconnect at the start of the session its credentials were not kept
+	self.mutex.Lock()
+	kept := self.params.Host != ""
+	self.mutex.Unlock()
+	if !kept {
+		return nil, false
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		self.broadcast("ssh_reconnecting", map[string]interface{}{
+			"attempt":      attempt,
+			"max_attempts": attempts,
+			"delay":        int(delay.Seconds()),
+			"reason":       cause.Error(),
+		})
+
+		time.Sleep(delay)
+		if !self.isActive() {
+			return nil, false
+		}
+
+		self.mutex.Lock()
+		params := self.params
+		self.mutex.Unlock()
+
+		conn, err := dialSSH(params)
+		if err == nil {
+			if !self.attach(conn) {
+				conn.close()
+				return nil, false
+			}
+			self.broadcast("ssh_reconnected", map[string]interface{}{
+				"attempt": attempt,
+			})
+			return conn, true
+		}
+		cause = err
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+	return nil, false
+}
+
+// end tells every attached browser why the session closed and cleans it up
+func (self *SSHSession) end(reason string, status int) {
+	self.broadcast("ssh_closed", map[string]interface{}{
+		"reason":      reason,
+		"exit_status": status,
+	})
+	self.close()
+}
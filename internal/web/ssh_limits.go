@@ -0,0 +1,127 @@
+package web
+
+import (
+	"fmt"
+	"minimalpanel/internal/conf"
+	"time"
+)
+
+// watchInterval is how often session timeouts are checked
+const watchInterval = time.Second
+
+// reserveSession claims one of the user's concurrent session slots before dialing
+// Returns false if the limit is reached. A claimed slot is released by store or release
+func (self *SSHSessionManager) reserveSession(username string, limit int) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if limit > 0 && self.countUserSessions(username)+self.dialing[username] >= limit {
+		return false
+	}
+	self.dialing[username]++
+	return true
+}
+
+// release gives back a slot claimed by reserveSession whose dial failed
+func (self *SSHSessionManager) release(username string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.releaseLocked(username)
+}
+
+// store adds an established session, turning the owner's claimed slot into a live session
+// Returns false if the client owns or attends another session by now, the slot is released either way
+func (self *SSHSessionManager) store(clientId string, session *SSHSession) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.releaseLocked(session.Owner)
+
+	if _, owns := self.sessions[clientId]; owns {
+		return false
+	}
+	if _, attends := self.attendees[clientId]; attends {
+		return false
+	}
+	self.sessions[clientId] = session
+	return true
+}
+
+// releaseLocked gives back a claimed slot, the caller must hold the lock
+func (self *SSHSessionManager) releaseLocked(username string) {
+	self.dialing[username]--
+	if self.dialing[username] <= 0 {
+		delete(self.dialing, username)
+	}
+}
+
+// countUserSessions returns the number of live sessions owned by a panel user, the caller must hold the lock
+func (self *SSHSessionManager) countUserSessions(username string) int {
+	count := 0
+	for _, session := range self.sessions {
+		if session.Owner == username {
+			count++
+		}
+	}
+	return count
+}
+
+// nextTimeout returns when the session will be closed and why
+// Returns a zero time if neither idle timeout nor max duration is configured
+func (self *SSHSession) nextTimeout(limits conf.Terminal) (time.Time, string) {
+	var deadline time.Time
+	var reason string
+
+	if limits.IdleTimeout > 0 {
+		deadline = time.Unix(0, self.lastInput.Load()).Add(limits.IdleTimeout)
+		reason = "idle"
+	}
+	if limits.MaxDuration > 0 {
+		end := self.StartedAt.Add(limits.MaxDuration)
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			reason = "max_duration"
+		}
+	}
+	return deadline, reason
+}
+
+// watchSession enforces idle timeout, max duration and the file transfer timeout until the session ends
+// Limits are re-read on every tick so config changes apply to running sessions
+func watchSession(session *SSHSession) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var warnedFor time.Time // Deadline the last warning was sent for
+
+	for range ticker.C {
+		if !session.isActive() {
+			return
+		}
+		session.checkTransfer()
+
+		limits := conf.GetTerminal()
+		deadline, reason := session.nextTimeout(limits)
+		if deadline.IsZero() {
+			continue
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			message := "maximum duration reached"
+			if reason == "idle" {
+				message = fmt.Sprintf("no input for %s", limits.IdleTimeout)
+			}
+			session.end(message, -1)
+			return
+		}
+
+		// Warn once per deadline, activity moves the idle deadline and re-arms the warning
+		if remaining <= limits.TimeoutWarning && !deadline.Equal(warnedFor) {
+			warnedFor = deadline
+			session.broadcast("ssh_timeout_warning", map[string]interface{}{
+				"reason":    reason,
+				"remaining": int(remaining.Round(time.Second).Seconds()),
+			})
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package web
+
+import (
+	"time"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// SharePermission controls what an attendee may do in a shared session
+type SharePermission string
+
+const (
+	ShareReadOnly  SharePermission = "read"  // Attendee only receives output
+	ShareReadWrite SharePermission = "write" // Attendee may also type and resize
+)
+
+// Attendee represents a socket attached to someone else's SSH session
+type Attendee struct {
+	Socket     *socket.Socket
+	Username   string
+	Permission SharePermission
+	JoinedAt   time.Time
+}
+
+// AttendeeInfo is the attendee data sent to the session owner
+type AttendeeInfo struct {
+	Id         string          `json:"id"`
+	Username   string          `json:"username"`
+	Permission SharePermission `json:"permission"`
+	JoinedAt   time.Time       `json:"joined_at"`
+}
+
+// lookup finds the session a client is attached to, either as owner or attendee
+func (self *SSHSessionManager) lookup(clientId string) (*SSHSession, SharePermission, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if session, exists := self.sessions[clientId]; exists {
+		return session, ShareReadWrite, true
+	}
+
+	session, exists := self.attendees[clientId]
+	if !exists {
+		return nil, "", false
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	attendee, attached := session.attendees[clientId]
+	if !attached {
+		return nil, "", false
+	}
+	return session, attendee.Permission, true
+}
+
+// findById finds a session by its public id
+func (self *SSHSessionManager) findById(id string) (*SSHSession, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for _, session := range self.sessions {
+		if session.ID == id {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// broadcast emits an event to the owner and every attendee of the session
+func (self *SSHSession) broadcast(event string, data ...any) {
+	self.mutex.Lock()
+	sockets := make([]*socket.Socket, 0, len(self.attendees)+1)
+	sockets = append(sockets, self.Socket)
+	for _, attendee := range self.attendees {
+		sockets = append(sockets, attendee.Socket)
+	}
+	self.mutex.Unlock()
+
+	for _, s := range sockets {
+		s.Emit(event, data...)
+	}
+}
+
+// listAttendees returns a snapshot of the attached attendees
+func (self *SSHSession) listAttendees() []AttendeeInfo {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	list := make([]AttendeeInfo, 0, len(self.attendees))
+	for id, attendee := range self.attendees {
+		list = append(list, AttendeeInfo{
+			Id:         id,
+			Username:   attendee.Username,
+			Permission: attendee.Permission,
+			JoinedAt:   attendee.JoinedAt,
+		})
+	}
+	return list
+}
+
+// notifyAttendees sends the current attendee list to the session owner
+func (self *SSHSession) notifyAttendees() {
+	self.Socket.Emit("attendees", self.listAttendees())
+}
+
+// eventData extracts the payload map of a Socket.IO event, handling the nested array format
+func eventData(data ...any) (map[string]interface{}, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	if payload, ok := data[0].(map[string]interface{}); ok {
+		return payload, true
+	}
+	if dataArray, isArray := data[0].([]interface{}); isArray && len(dataArray) > 0 {
+		payload, ok := dataArray[0].(map[string]interface{})
+		return payload, ok
+	}
+	return nil, false
+}
+
+// ownedSession returns the session owned by the client, emitting an error if there is none
+func ownedSession(client *socket.Socket) (*SSHSession, bool) {
+	sessionManager.mutex.RLock()
+	session, exists := sessionManager.sessions[string(client.Id())]
+	sessionManager.mutex.RUnlock()
+
+	if !exists || !session.active {
+		client.Emit("ssh_error", "No active SSH session owned by this client")
+		return nil, false
+	}
+	return session, true
+}
+
+// handleShareSSH invites another panel user into the client's session
+func handleShareSSH(client *socket.Socket, data ...any) {
+	shareData, ok := eventData(data...)
+	if !ok {
+		client.Emit("ssh_error", "Invalid share data format")
+		return
+	}
+
+	session, ok := ownedSession(client)
+	if !ok {
+		return
+	}
+
+	username, _ := shareData["username"].(string)
+	if username == "" {
+		client.Emit("ssh_error", "Username is required")
+		return
+	}
+
+	rawPermission, _ := shareData["permission"].(string)
+	permission := SharePermission(rawPermission)
+	switch permission {
+	case "":
+		permission = ShareReadOnly
+	case ShareReadOnly, ShareReadWrite:
+	default:
+		client.Emit("ssh_error", "Permission must be either read or write")
+		return
+	}
+
+	session.mutex.Lock()
+	session.invites[username] = permission
+	// Apply the new permission to sockets the user already has attached
+	for _, attendee := range session.attendees {
+		if attendee.Username == username {
+			attendee.Permission = permission
+		}
+	}
+	session.mutex.Unlock()
+
+	client.Emit("ssh_shared", map[string]interface{}{
+		"session_id": session.ID,
+		"username":   username,
+		"permission": permission,
+	})
+	session.notifyAttendees()
+}
+
+// handleJoinSSH attaches the client to a session it was invited to
+func handleJoinSSH(client *socket.Socket, data ...any) {
+	joinData, ok := eventData(data...)
+	if !ok {
+		client.Emit("ssh_error", "Invalid join data format")
+		return
+	}
+
+	sessionId, _ := joinData["session_id"].(string)
+	session, exists := sessionManager.findById(sessionId)
+	if !exists || !session.active {
+		client.Emit("ssh_error", "Shared session not found")
+		return
+	}
+
+	if !allowsHost(client, session.Host) {
+		return
+	}
+
+	clientId := string(client.Id())
+	username := getUsernameFromSocket(client)
+
+	// Checked under both locks, so the session cannot end between the check and the insert
+	sessionManager.mutex.Lock()
+	_, owns := sessionManager.sessions[clientId]
+	_, attends := sessionManager.attendees[clientId]
+	session.mutex.Lock()
+	active := session.active
+	permission, invited := session.invites[username]
+	joined := active && invited && !owns && !attends
+	if joined {
+		session.attendees[clientId] = &Attendee{
+			Socket:     client,
+			Username:   username,
+			Permission: permission,
+			JoinedAt:   time.Now(),
+		}
+		sessionManager.attendees[clientId] = session
+	}
+	session.mutex.Unlock()
+	sessionManager.mutex.Unlock()
+
+	switch {
+	case owns || attends:
+		client.Emit("ssh_error", "Client is already attached to an SSH session")
+		return
+	case !active:
+		client.Emit("ssh_error", "Shared session has ended")
+		return
+	case !invited:
+		client.Emit("ssh_error", "You are not invited to this session")
+		return
+	}
+
+	client.Emit("ssh_connected", map[string]interface{}{
+		"session_id": session.ID,
+		"owner":      session.Owner,
+		"permission": permission,
+	})
+	session.notifyAttendees()
+}
+
+// handleListAttendees sends the attendee list to the session owner
+func handleListAttendees(client *socket.Socket, data ...any) {
+	session, ok := ownedSession(client)
+	if !ok {
+		return
+	}
+	session.notifyAttendees()
+}
+
+// handleKickAttendee revokes a user's invitation and detaches their sockets
+func handleKickAttendee(client *socket.Socket, data ...any) {
+	kickData, ok := eventData(data...)
+	if !ok {
+		client.Emit("ssh_error", "Invalid kick data format")
+		return
+	}
+
+	session, ok := ownedSession(client)
+	if !ok {
+		return
+	}
+
+	username, _ := kickData["username"].(string)
+	if username == "" {
+		client.Emit("ssh_error", "Username is required")
+		return
+	}
+
+	sessionManager.mutex.Lock()
+	session.mutex.Lock()
+	delete(session.invites, username)
+	var kicked []*socket.Socket
+	for id, attendee := range session.attendees {
+		if attendee.Username == username {
+			kicked = append(kicked, attendee.Socket)
+			delete(session.attendees, id)
+			delete(sessionManager.attendees, id)
+		}
+	}
+	session.mutex.Unlock()
+	sessionManager.mutex.Unlock()
+
+	for _, s := range kicked {
+		s.Emit("ssh_closed", map[string]interface{}{
+			"reason":      "removed from the shared session",
+			"exit_status": -1,
+		})
+	}
+	session.notifyAttendees()
+}
@@ -0,0 +1,166 @@
+package web
+
+import (
+	"minimalpanel/internal/conf"
+	"minimalpanel/internal/sshc"
+	"time"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+	"github.com/zishang520/socket.io/v3/pkg/types"
+)
+
+// transferTimeout returns a session to terminal mode after this long without transfer data in either
+// direction, so a browser that cannot run the transfer or output mistaken for a handshake does not leave
+// the terminal blank
+const transferTimeout = time.Minute
+
+// output forwards a chunk of remote output, switching to transfer mode on a rz/sz or trz/tsz handshake
+func (self *SSHSession) output(chunk []byte) {
+	self.mutex.Lock()
+	transfer := self.transfer
+	self.mutex.Unlock()
+
+	if transfer == nil && conf.GetTerminal().FileTransfer {
+		if text, detected, rest := self.scanner.Scan(chunk); detected != nil {
+			if len(text) > 0 {
+				self.broadcast("terminal_output", string(text))
+			}
+			chunk = rest
+			transfer = detected
+
+			self.mutex.Lock()
+			self.transfer = detected
+			self.mutex.Unlock()
+			self.transferSeen.Store(time.Now().UnixNano())
+
+			self.broadcast("transfer_start", map[string]interface{}{
+				"protocol":  detected.Protocol,
+				"direction": detected.Direction,
+			})
+		}
+	}
+
+	if transfer == nil {
+		self.broadcast("terminal_output", string(chunk))
+		return
+	}
+
+	// Binary frames only go to the owner, whose browser runs the transfer
+	self.transferSeen.Store(time.Now().UnixNano())
+	self.Socket.Emit("transfer_output", append([]byte(nil), chunk...))
+}
+
+// endTransfer returns the session to terminal mode
+// param: abort: also cancel the transfer on the remote side
+// param: reason: why the panel ended the transfer, empty if the browser did
+func (self *SSHSession) endTransfer(abort bool, reason string) {
+	self.mutex.Lock()
+	transfer := self.transfer
+	if transfer == nil {
+		self.mutex.Unlock()
+		return
+	}
+	if abort && self.Stdin != nil {
+		self.Stdin.Write(transfer.Cancel())
+	}
+	self.transfer = nil
+	self.mutex.Unlock()
+
+	end := map[string]interface{}{
+		"protocol": transfer.Protocol,
+		"aborted":  abort,
+	}
+	if reason != "" {
+		end["reason"] = reason
+	}
+	self.broadcast("transfer_end", end)
+}
+
+// checkTransfer aborts a transfer that has been silent for too long
+func (self *SSHSession) checkTransfer() {
+	self.mutex.Lock()
+	transferring := self.transfer != nil
+	self.mutex.Unlock()
+
+	if transferring && time.Since(time.Unix(0, self.transferSeen.Load())) > transferTimeout {
+		self.endTransfer(true, "timeout")
+	}
+}
+
+// eventBytes extracts a binary payload of a Socket.IO event, handling the nested array format
+func eventBytes(data ...any) ([]byte, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	payload := data[0]
+	if dataArray, isArray := payload.([]interface{}); isArray && len(dataArray) > 0 {
+		payload = dataArray[0]
+	}
+
+	switch v := payload.(type) {
+	case types.BufferInterface:
+		return v.Bytes(), true
+	case []byte:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// transferSession returns the session owned by the client if it is in transfer mode
+func transferSession(client *socket.Socket) (*SSHSession, *sshc.Transfer, bool) {
+	session, ok := ownedSession(client)
+	if !ok {
+		return nil, nil, false
+	}
+
+	session.mutex.Lock()
+	transfer := session.transfer
+	session.mutex.Unlock()
+
+	if transfer == nil {
+		client.Emit("ssh_error", "No file transfer in progress")
+		return nil, nil, false
+	}
+	return session, transfer, true
+}
+
+// handleTransferInput writes binary frames from the browser to the remote transfer tool
+func handleTransferInput(client *socket.Socket, data ...any) {
+	frame, ok := eventBytes(data...)
+	if !ok {
+		client.Emit("ssh_error", "Invalid transfer data format")
+		return
+	}
+
+	session, _, ok := transferSession(client)
+	if !ok {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.Stdin != nil {
+		n, err := session.Stdin.Write(frame)
+		session.bytesOut.Add(uint64(n))
+		session.lastInput.Store(time.Now().UnixNano())
+		session.transferSeen.Store(time.Now().UnixNano())
+		if err != nil {
+			client.Emit("ssh_error", "Failed to send transfer data")
+		}
+	}
+}
+
+// handleTransferEnd returns the session to terminal mode once the browser finished or aborted the transfer
+func handleTransferEnd(client *socket.Socket, data ...any) {
+	session, _, ok := transferSession(client)
+	if !ok {
+		return
+	}
+
+	endData, _ := eventData(data...)
+	abort, _ := endData["abort"].(bool)
+	session.endTransfer(abort, "")
+}
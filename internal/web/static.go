@@ -1,33 +1,179 @@
 package web
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"minimalpanel/internal/conf"
+	frontend "minimalpanel/web"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
+// staticFile is an embedded frontend file with its precompressed variants
+type staticFile struct {
+	content     []byte
+	gzip        []byte // nil when compression does not pay off
+	brotli      []byte
+	etag        string
+	contentType string
+}
+
+// staticFiles indexes the embedded frontend by path, built on first use
+var staticFiles struct {
+	once  sync.Once
+	files map[string]*staticFile
+}
+
+// compressible lists the types worth compressing, images other than SVG already are
+var compressible = map[string]bool{
+	".html": true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+}
+
+// StartPages registers the pages with the given mux
 func StartPages(mux *http.ServeMux) {
-	mux.Handle(
-		"/pages/", http.StripPrefix(
-			"/pages",
-			http.FileServer(
-				http.Dir(
-					filepath.Join(conf.GetWeb().RootPath, "pages"),
-				),
-			),
-		),
-	)
+	// Compressing takes a moment, get it done before the first browser asks
+	go staticFiles.once.Do(loadStaticFiles)
+	mux.Handle("/pages/", http.StripPrefix("/pages", frontendDir("pages")))
 }
 
+// StartAssets registers the icons and other assets with the given mux
 func StartAssets(mux *http.ServeMux) {
-	mux.Handle(
-		"/assets/", http.StripPrefix(
-			"/assets",
-			http.FileServer(
-				http.Dir(
-					filepath.Join(conf.GetWeb().RootPath, "assets"),
-				),
-			),
-		),
-	)
+	mux.Handle("/assets/", http.StripPrefix("/assets", frontendDir("assets")))
+}
+
+// frontendDir serves a directory of the frontend
+func frontendDir(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveFrontend(w, r, path.Join(dir, path.Clean("/"+r.URL.Path)))
+	})
+}
+
+// serveFrontend serves a frontend file, from RootPath on disk when configured or else embedded
+// param: name: slash separated path below the frontend root
+func serveFrontend(w http.ResponseWriter, r *http.Request, name string) {
+	if root := conf.GetWeb().RootPath; root != "" {
+		// Edits show up right away during development
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filepath.Join(root, filepath.FromSlash(name)))
+		return
+	}
+
+	staticFiles.once.Do(loadStaticFiles)
+	file, ok := staticFiles.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", file.contentType)
+	// URLs are not versioned, so browsers revalidate on every load and get a 304 while the ETag matches.
+	// A max-age would keep serving old scripts next to new pages for its duration after an upgrade
+	header.Set("Cache-Control", "no-cache")
+
+	content, etag := file.content, file.etag
+	if file.gzip != nil {
+		header.Add("Vary", "Accept-Encoding")
+		encodings := r.Header.Get("Accept-Encoding")
+		if file.brotli != nil && acceptsEncoding(encodings, "br") {
+			content, etag = file.brotli, etag+"-br"
+			header.Set("Content-Encoding", "br")
+		} else if acceptsEncoding(encodings, "gzip") {
+			content, etag = file.gzip, etag+"-gz"
+			header.Set("Content-Encoding", "gzip")
+		}
+	}
+	header.Set("ETag", `"`+etag+`"`)
+
+	// ServeContent answers If-None-Match and range requests
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the encoding
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		// Only an explicit q=0 refuses it
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// loadStaticFiles hashes and compresses the embedded frontend once
+func loadStaticFiles() {
+	staticFiles.files = make(map[string]*staticFile)
+	err := fs.WalkDir(frontend.Files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(frontend.Files, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(content)
+		file := &staticFile{
+			content:     content,
+			etag:        hex.EncodeToString(sum[:8]),
+			contentType: mime.TypeByExtension(path.Ext(name)),
+		}
+		if file.contentType == "" {
+			file.contentType = http.DetectContentType(content)
+		}
+		if compressible[path.Ext(name)] {
+			file.gzip = compress(content, func(buffer *bytes.Buffer) io.WriteCloser {
+				writer, _ := gzip.NewWriterLevel(buffer, gzip.BestCompression)
+				return writer
+			})
+			file.brotli = compress(content, func(buffer *bytes.Buffer) io.WriteCloser {
+				return brotli.NewWriterLevel(buffer, brotli.BestCompression)
+			})
+			if file.gzip == nil {
+				file.brotli = nil
+			}
+		}
+		staticFiles.files[name] = file
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to load the embedded frontend: %v", err)
+	}
+}
+
+// compress returns the compressed content, or nil if it would not be smaller
+func compress(content []byte, newWriter func(*bytes.Buffer) io.WriteCloser) []byte {
+	var buffer bytes.Buffer
+	writer := newWriter(&buffer)
+	if _, err := writer.Write(content); err != nil {
+		return nil
+	}
+	if err := writer.Close(); err != nil || buffer.Len() >= len(content) {
+		return nil
+	}
+	return buffer.Bytes()
 }
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"encoding/json"
+	"minimalpanel/internal/auth"
+	"minimalpanel/internal/netx"
+	"net/http"
+	"time"
+)
+
+// CreateTokenRequest represents the create API token request payload
+type CreateTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"` // Go duration such as 720h, empty for no expiry
+}
+
+// RevokeTokenRequest represents the revoke API token request payload
+type RevokeTokenRequest struct {
+	Id string `json:"id"`
+}
+
+// StartTokens registers all API token routes with the given mux
+// Only login sessions may manage tokens, a token can never mint another one
+func StartTokens(mux *http.ServeMux) {
+	mux.HandleFunc("/tokens", auth.RequireAuthAPI(handleListTokens))
+	mux.HandleFunc("/tokens/create", auth.RequireAuthAPI(handleCreateToken))
+	mux.HandleFunc("/tokens/revoke", auth.RequireAuthAPI(handleRevokeToken))
+}
+
+// handleListTokens lists the user's tokens, admins may pass ?all=true for every user's
+func handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if r.URL.Query().Get("all") == "true" {
+		if !auth.IsAdmin(username) {
+			netx.WriteForbidden(w, "Administrator privileges required")
+			return
+		}
+		username = ""
+	}
+
+	netx.WriteSuccess(w, "API tokens", auth.ListAPITokens(username))
+}
+
+// handleCreateToken creates an API token and returns its secret once
+func handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	var lifespan time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		lifespan, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || lifespan <= 0 {
+			netx.WriteBadRequest(w, "Invalid expiry")
+			return
+		}
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	token, apiToken, err := auth.CreateAPIToken(username, req.Name, req.Scopes, lifespan)
+	if err != nil {
+		netx.WriteBadRequest(w, err.Error())
+		return
+	}
+	apiToken.Hash = ""
+
+	netx.WriteSuccess(w, "API token created", map[string]interface{}{
+		"token": token,
+		"info":  apiToken,
+	})
+}
+
+// handleRevokeToken revokes one of the user's tokens, admins may revoke any token
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req RevokeTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Id == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	owner := username
+	if auth.IsAdmin(username) {
+		owner = ""
+	}
+
+	if err := auth.RevokeAPIToken(req.Id, owner); err != nil {
+		netx.WriteNotFound(w, "API token not found")
+		return
+	}
+	netx.WriteSuccess(w, "API token revoked", nil)
+}
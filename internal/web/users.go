@@ -0,0 +1,170 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"minimalpanel/internal/auth"
+	perr "minimalpanel/internal/error"
+	"minimalpanel/internal/netx"
+	"net/http"
+)
+
+// UserRequest represents the add/update/delete user request payload
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+
+	RevokeSessions bool `json:"revoke_sessions"` // Log the user out everywhere after a password reset
+}
+
+// PasswordRequest represents the change own password request payload
+type PasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	RevokeSessions  bool   `json:"revoke_sessions"` // Log out every other session of the user
+}
+
+// StartUsers registers all user management routes with the given mux
+func StartUsers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/users", auth.RequireAdmin(handleListUsers))
+	mux.HandleFunc("/admin/users/add", auth.RequireAdmin(handleAddUser))
+	mux.HandleFunc("/admin/users/passwd", auth.RequireAdmin(handleSetUserPassword))
+	mux.HandleFunc("/admin/users/delete", auth.RequireAdmin(handleDeleteUser))
+	mux.HandleFunc("/account/password", auth.RequireAuthAPI(handleChangePassword))
+}
+
+// decodeUserRequest parses a user management request
+func decodeUserRequest(w http.ResponseWriter, r *http.Request) (*UserRequest, bool) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return nil, false
+	}
+
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return nil, false
+	}
+	return &req, true
+}
+
+// actor returns who a request is authenticated as, API tokens included, for the config history
+func actor(r *http.Request) string {
+	if principal, ok := auth.Authenticate(r); ok {
+		return principal.Username
+	}
+	return ""
+}
+
+// writeUserError maps user management errors to responses
+func writeUserError(w http.ResponseWriter, message string, err error) {
+	switch {
+	case errors.Is(err, perr.UserNotFound):
+		netx.WriteNotFound(w, "User not found")
+	case errors.Is(err, perr.UserExists):
+		netx.WriteError(w, http.StatusConflict, "User already exists", nil)
+	case errors.Is(err, perr.WrongPassword):
+		netx.WriteForbidden(w, "Current password is wrong")
+	case errors.Is(err, perr.PasswordRequired):
+		netx.WriteBadRequest(w, "Password is required")
+	default:
+		netx.WriteInternalServerError(w, message, err)
+	}
+}
+
+// handleListUsers lists all panel users
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	netx.WriteSuccess(w, "Users", auth.ListUsers())
+}
+
+// handleAddUser creates a panel user
+func handleAddUser(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeUserRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Password == "" {
+		netx.WriteBadRequest(w, "Password is required")
+		return
+	}
+
+	by := actor(r)
+	if err := auth.NewUser(req.Username, req.Password, req.Admin, by); err != nil {
+		writeUserError(w, "Failed to add user", err)
+		return
+	}
+
+	netx.WriteSuccess(w, "User added", nil)
+}
+
+// handleSetUserPassword resets another user's password
+func handleSetUserPassword(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	by := actor(r)
+	if err := auth.SetPassword(req.Username, req.Password, by); err != nil {
+		writeUserError(w, "Failed to set password", err)
+		return
+	}
+	if req.RevokeSessions {
+		auth.DeleteUserSessions(req.Username)
+	}
+
+	netx.WriteSuccess(w, "Password updated", nil)
+}
+
+// handleDeleteUser deletes a panel user
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	by := actor(r)
+	if by == req.Username {
+		netx.WriteBadRequest(w, "You cannot delete yourself")
+		return
+	}
+
+	if err := auth.DeleteUser(req.Username, by); err != nil {
+		writeUserError(w, "Failed to delete user", err)
+		return
+	}
+
+	netx.WriteSuccess(w, "User deleted", nil)
+}
+
+// handleChangePassword lets the logged in user change their own password
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if err := auth.ChangePassword(username, req.CurrentPassword, req.NewPassword); err != nil {
+		writeUserError(w, "Failed to change password", err)
+		return
+	}
+	if req.RevokeSessions {
+		token, _ := auth.GetSessionToken(r)
+		auth.DeleteOtherSessions(username, token)
+	}
+
+	netx.WriteSuccess(w, "Password changed", nil)
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"minimalpanel/internal/auth"
+	perr "minimalpanel/internal/error"
+	"minimalpanel/internal/netx"
+	"net/http"
+)
+
+// PasskeyChallenge is the start of a WebAuthn ceremony, the browser answers it with the same id
+type PasskeyChallenge struct {
+	Id           string      `json:"id"`
+	Options      interface{} `json:"options"`                 // For navigator.credentials.create or get
+	SecondFactor bool        `json:"second_factor,omitempty"` // The password was accepted, the authenticator is still required
+}
+
+// PasskeyLoginRequest represents the passwordless login request payload
+type PasskeyLoginRequest struct {
+	Remember bool `json:"remember"`
+}
+
+// PasskeyRequest represents the register, rename and delete passkey request payloads
+type PasskeyRequest struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// StartWebAuthn registers all passkey routes with the given mux
+func StartWebAuthn(mux *http.ServeMux) {
+	mux.HandleFunc("/webauthn/login/begin", handlePasskeyLoginBegin)
+	mux.HandleFunc("/webauthn/login/finish", handlePasskeyLoginFinish)
+	mux.HandleFunc("/webauthn/register/begin", auth.RequireAuthAPI(handlePasskeyRegisterBegin))
+	mux.HandleFunc("/webauthn/register/finish", auth.RequireAuthAPI(handlePasskeyRegisterFinish))
+	mux.HandleFunc("/webauthn/credentials", auth.RequireAuthAPI(handleListPasskeys))
+	mux.HandleFunc("/webauthn/credentials/rename", auth.RequireAuthAPI(handleRenamePasskey))
+	mux.HandleFunc("/webauthn/credentials/delete", auth.RequireAuthAPI(handleDeletePasskey))
+}
+
+// handlePasskeyLoginBegin starts a passwordless login
+func handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req PasskeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	id, options, err := auth.BeginPasskeyLogin(r, "", req.Remember)
+	if err != nil {
+		netx.WriteInternalServerError(w, "Failed to start passkey login", err)
+		return
+	}
+	netx.WriteSuccess(w, "Passkey challenge", PasskeyChallenge{Id: id, Options: options})
+}
+
+// handlePasskeyLoginFinish completes a passwordless or second factor login, the body is the browser's assertion
+func handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, remember, err := auth.FinishPasskeyLogin(r, r.URL.Query().Get("id"))
+	if err != nil {
+		netx.WriteUnauthorized(w, err.Error())
+		return
+	}
+
+	token, err := auth.CreateSession(username, remember, r)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	auth.SetCookie(w, token)
+	netx.WriteAuthSuccessWithToken(w, "Login successful", username, token)
+}
+
+// handlePasskeyRegisterBegin starts registering an authenticator for the logged in user
+func handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req PasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	id, options, err := auth.BeginPasskeyRegistration(r, username, req.Name)
+	if errors.Is(err, perr.UserNotFound) {
+		netx.WriteBadRequest(w, "Passkeys are only available to accounts of a password backend")
+		return
+	}
+	if err != nil {
+		netx.WriteInternalServerError(w, "Failed to start passkey registration", err)
+		return
+	}
+	netx.WriteSuccess(w, "Passkey challenge", PasskeyChallenge{Id: id, Options: options})
+}
+
+// handlePasskeyRegisterFinish stores the authenticator, the body is the browser's attestation
+func handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	passkey, err := auth.FinishPasskeyRegistration(r, r.URL.Query().Get("id"), username)
+	if err != nil {
+		netx.WriteBadRequest(w, err.Error())
+		return
+	}
+	netx.WriteSuccess(w, "Passkey registered", passkey)
+}
+
+// handleListPasskeys lists the user's authenticators
+func handleListPasskeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	netx.WriteSuccess(w, "Passkeys", auth.ListPasskeys(username))
+}
+
+// handleRenamePasskey renames one of the user's authenticators
+func handleRenamePasskey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req PasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Id == "" || req.Name == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if err := auth.RenamePasskey(username, req.Id, req.Name); err != nil {
+		netx.WriteNotFound(w, err.Error())
+		return
+	}
+	netx.WriteSuccess(w, "Passkey renamed", nil)
+}
+
+// handleDeletePasskey removes one of the user's authenticators
+func handleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		netx.WriteMethodNotAllowed(w)
+		return
+	}
+
+	var req PasskeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Id == "" {
+		netx.WriteBadRequest(w, "Invalid request format")
+		return
+	}
+
+	username, _ := auth.IsAuthenticated(r)
+	if err := auth.DeletePasskey(username, req.Id); err != nil {
+		netx.WriteNotFound(w, err.Error())
+		return
+	}
+	netx.WriteSuccess(w, "Passkey deleted", nil)
+}
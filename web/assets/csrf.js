@@ -0,0 +1,18 @@
+// Double-submit CSRF token shared by the pages: the server sets the cookie on every page and
+// requires it echoed in a header on state-changing requests, see internal/auth/csrf.go
+const CSRF_COOKIE = 'mp-csrf';
+const CSRF_HEADER = 'X-CSRF-Token';
+
+// csrfToken returns the token from the cookie, empty before the server has set one
+function csrfToken() {
+    const match = document.cookie.match(new RegExp('(?:^|;\\s*)' + CSRF_COOKIE + '=([^;]*)'));
+    return match ? decodeURIComponent(match[1]) : '';
+}
+
+// jsonHeaders returns the headers of a JSON request carrying the token
+function jsonHeaders() {
+    return {
+        'Content-Type': 'application/json',
+        [CSRF_HEADER]: csrfToken(),
+    };
+}
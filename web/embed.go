@@ -0,0 +1,9 @@
+// Package web holds the frontend, embedded into the binary
+package web
+
+import "embed"
+
+// Files is the frontend as laid out in this directory
+//
+//go:embed index.html pages assets
+var Files embed.FS